@@ -1,20 +1,40 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"log/slog"
 	"mime"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	app "github.com/IqbalLx/inspectro-llm/server"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/auth"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/backup"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/catalog"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/cli"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/config"
 	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/healthAPI"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/keysAPI"
 	"github.com/IqbalLx/inspectro-llm/server/src/modules/llmAPI"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/metrics"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/projectsAPI"
 	"github.com/IqbalLx/inspectro-llm/server/src/modules/proxy"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/rollup"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/teamsAPI"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/tracing"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/usage"
 	"github.com/IqbalLx/inspectro-llm/server/src/modules/usageAPI"
 	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
 )
@@ -67,29 +87,161 @@ func handleStatic(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	db, err := database.OpenDB()
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	// flags may also follow "serve"
+	if len(args) > 0 && args[0] == "serve" {
+		flags := os.Args[1 : len(os.Args)-len(args)]
+		cfg, args, err = config.Load(append(flags, args[1:]...))
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		} else if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(args) > 0 {
+			log.Fatalf("unexpected arguments %v", args)
+		}
+	}
+
+	level, _ := cfg.SlogLevel()
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	if len(args) > 0 {
+		if err := cli.Run(context.Background(), cfg, args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	database.UseRemote(cfg.Remote())
+
+	db, err := database.OpenDB(cfg.DBDSN)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	defer database.CloseDB(db)
 
-	if err = watcher.SyncLLM(db); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.TracesExporter, cfg.TracesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = watcher.SyncLLM(ctx, db, cfg.ConfigPath); err != nil {
 		log.Fatalf("LLMS config err: %v", err)
 	}
 
+	auth.WarnIfNoUsers(ctx, db, cfg.AdminToken)
+
+	if err = usage.Start(db, cfg.UsageSpoolDir, cfg.UsageBufferSize, cfg.UsageBatchSize, cfg.UsageFlushEvery); err != nil {
+		log.Fatal(err)
+	}
+
+	rollup.Start(ctx, db, rollup.Retention{Raw: cfg.UsageRetention, Hourly: cfg.HourlyRetention})
+
+	if cfg.BackupDir != "" {
+		backup.Start(ctx, db, cfg.BackupDir, cfg.BackupEvery, cfg.BackupKeep)
+	}
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", handleStatic)
 
+	mux.HandleFunc("GET /healthz", healthAPI.DoHealthz())
+	mux.HandleFunc("GET /readyz", healthAPI.DoReadyz(db))
+	mux.Handle("GET /metrics", metrics.Handler())
+
 	mux.HandleFunc("/proxy/", proxy.ProxyRequest(db, false, "/proxy/"))
+	mux.HandleFunc("/proxy/p/{project}/", proxy.ProxyRequest(db, false, "/proxy/p/"))
 	mux.HandleFunc("/proxy", proxy.ProxyRequest(db, true, "/proxy"))
 
+	mux.HandleFunc("GET /login", auth.DoGetLoginPage())
+	mux.HandleFunc("POST /api/auth/login", auth.DoLogin(db, cfg.SessionTTL))
+	mux.HandleFunc("POST /api/auth/logout", auth.DoLogout(db))
+	mux.HandleFunc("GET /api/auth/me", auth.DoGetMe())
+
 	mux.HandleFunc("/api/llm", llmAPI.DoGetLLM(db))
+	mux.HandleFunc("POST /api/llm/providers", auth.RequireAdmin(llmAPI.DoCreateLLMProvider(db)))
+	mux.HandleFunc("PUT /api/llm/providers/{name}", auth.RequireAdmin(llmAPI.DoUpdateLLMProvider(db)))
+	mux.HandleFunc("DELETE /api/llm/providers/{name}", auth.RequireAdmin(llmAPI.DoDeleteLLMProvider(db)))
+	mux.HandleFunc("POST /api/llm/models", auth.RequireAdmin(llmAPI.DoCreateLLMModel(db)))
+	mux.HandleFunc("PUT /api/llm/models/{name...}", auth.RequireAdmin(llmAPI.DoUpdateLLMModel(db)))
+	mux.HandleFunc("DELETE /api/llm/models/{name...}", auth.RequireAdmin(llmAPI.DoDeleteLLMModel(db)))
+	mux.HandleFunc("GET /api/providers/status", healthAPI.DoGetProviderStatus(db))
+	mux.HandleFunc("GET /api/catalog", catalog.DoGetCatalog())
+	mux.HandleFunc("POST /api/catalog/import", auth.RequireAdmin(catalog.DoImportCatalog(db)))
 	mux.HandleFunc("/api/usage", usageAPI.DoGetLLMUsage(db))
+	mux.HandleFunc("POST /api/usage/recompute", auth.RequireAdmin(usageAPI.DoRecomputeLLMUsage(db)))
+	mux.HandleFunc("GET /api/keys", keysAPI.DoListKeys(db))
+	mux.HandleFunc("POST /api/keys", auth.RequireRole(keysAPI.DoCreateKey(db), auth.ROLE_ADMIN, auth.ROLE_TEAM_ADMIN))
+	mux.HandleFunc("DELETE /api/keys/{name}", auth.RequireRole(keysAPI.DoRevokeKey(db), auth.ROLE_ADMIN, auth.ROLE_TEAM_ADMIN))
+	mux.HandleFunc("GET /api/projects", projectsAPI.DoListProjects(db))
+	mux.HandleFunc("GET /api/projects/{name}/budget", projectsAPI.DoGetProjectBudget(db))
+	mux.HandleFunc("GET /api/teams", auth.RequireAdmin(teamsAPI.DoListTeams(db)))
+	mux.HandleFunc("POST /api/teams", auth.RequireAdmin(teamsAPI.DoCreateTeam(db)))
+	mux.HandleFunc("DELETE /api/teams/{name}", auth.RequireAdmin(teamsAPI.DoDeleteTeam(db)))
+	mux.HandleFunc("GET /api/teams/{name}/budget", teamsAPI.DoGetTeamBudget(db))
+	mux.HandleFunc("PUT /api/teams/{name}/budget", auth.RequireAdmin(teamsAPI.DoSetTeamBudget(db)))
+
+	server := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           auth.Middleware(db, cfg.AdminToken, mux),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+
+	go func() {
+		log.Println("starting web on", cfg.Addr)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Println("serving failed:", err)
+		}
+		stop()
+	}()
 
-	log.Println("starting web on :7865")
-	if err := http.ListenAndServe(":7865", mux); err != nil {
-		log.Println("serving failed:", err)
+	<-ctx.Done()
+	stop() // a second signal kills the process right away
+
+	// load balancers see /readyz fail while requests are still served
+	healthAPI.StartShutdown()
+	if cfg.ShutdownDelay > 0 {
+		log.Println("shutting down, failing readiness for", cfg.ShutdownDelay)
+		time.Sleep(cfg.ShutdownDelay)
+	}
+
+	log.Println("shutting down, draining for up to", cfg.ShutdownTimeout)
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelDrain()
+
+	if err := server.Shutdown(drainCtx); err != nil {
+		log.Println("drain timed out, closing remaining connections:", err)
+		server.Close()
 	}
+
+	// streams cut above still log usage and spans, so flushing gets its own timeout
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelFlush()
+
+	if err := usage.Wait(flushCtx); err != nil {
+		log.Println("gave up waiting for usage writes:", err)
+	}
+
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Println("failed flushing traces:", err)
+	}
+
+	watcher.Wait()
+	rollup.Wait()
+	backup.Wait()
 }
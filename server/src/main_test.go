@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/keys"
+)
+
+// RUN_MAIN makes the test binary run main, so commands are tested with the
+// exit codes and output inspectro itself has.
+const RUN_MAIN = "INSPECTRO_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(RUN_MAIN) != "" {
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestCLI(t *testing.T) {
+	dataDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dataDir, "config"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "config", "llm.yaml"), []byte(`providers:
+  - name: ollama
+    apiBase: http://127.0.0.1:11434
+models:
+  - name: llama
+    provider: ollama
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args   []string
+		stdin  string
+		code   int
+		stdout []string
+		stderr []string
+	}{
+		{[]string{"help"}, "", 0, []string{"usage: inspectro", "keys create [flags] <name>"}, nil},
+		{[]string{"-h"}, "", 0, nil, []string{"-data-dir"}},
+		{[]string{"bogus"}, "", 1, nil, []string{"usage: inspectro", "unknown command: [bogus]"}},
+		{[]string{"migrate"}, "", 0, []string{"database is up to date"}, nil},
+		{[]string{"migrate", "now"}, "", 1, nil, []string{"migrate: unexpected arguments [now]"}},
+		{[]string{"validate-config"}, "", 0, []string{"llm.yaml is valid: 1 providers, 1 models"}, nil},
+		{[]string{"teams", "create", "red"}, "", 0, []string{"created team red"}, nil},
+		{[]string{"teams", "create", "red"}, "", 1, nil, []string{"teams create:"}},
+		{[]string{"teams", "list"}, "", 0, []string{"NAME  CREATED", "red "}, nil},
+		{[]string{"keys", "create"}, "", 1, nil, []string{"keys create: expected a key name"}},
+		{[]string{"keys", "create", "--no-such-flag", "ci"}, "", 1, nil, []string{"flag provided but not defined"}},
+		// the key goes to stdout to be piped elsewhere, the notice to stderr
+		{[]string{"keys", "create", "--team", "red", "ci"}, "", 0, []string{keys.KEY_PREFIX}, []string{"created key ci, it won't be shown again"}},
+		{[]string{"keys", "list", "--team", "red"}, "", 0, []string{"NAME  TEAM  PROJECT", "ci    red   -"}, nil},
+		{[]string{"keys", "revoke", "ci"}, "", 0, []string{"revoked key ci"}, nil},
+		{[]string{"users", "create", "--role", "viewer", "--team", "red", "ann"}, "secret-password\n", 0, []string{"created viewer ann"}, []string{"password for ann:"}},
+		{[]string{"users", "list"}, "", 0, []string{"ann   viewer  red"}, nil},
+		{[]string{"projects", "list", "extra"}, "", 1, nil, []string{"projects list: unexpected arguments [extra]"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], append([]string{"--data-dir", dataDir}, tt.args...)...)
+			cmd.Env = append(os.Environ(), RUN_MAIN+"=1")
+			cmd.Stdin = strings.NewReader(tt.stdin)
+
+			var stdout, stderr bytes.Buffer
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+			code := 0
+			var exitErr *exec.ExitError
+			if err := cmd.Run(); errors.As(err, &exitErr) {
+				code = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if code != tt.code {
+				t.Fatalf("exit code %d, want %d\nstdout: %s\nstderr: %s", code, tt.code, stdout.String(), stderr.String())
+			}
+			for _, want := range tt.stdout {
+				if !strings.Contains(stdout.String(), want) {
+					t.Fatalf("stdout %q, want %q in it", stdout.String(), want)
+				}
+			}
+			for _, want := range tt.stderr {
+				if !strings.Contains(stderr.String(), want) {
+					t.Fatalf("stderr %q, want %q in it", stderr.String(), want)
+				}
+			}
+		})
+	}
+}
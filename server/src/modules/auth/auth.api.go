@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>inspectro - sign in</title>
+<style>
+body { font-family: system-ui, sans-serif; display: flex; justify-content: center; margin-top: 15vh; }
+form { display: flex; flex-direction: column; gap: .75rem; width: 18rem; }
+input, button { padding: .5rem; font-size: 1rem; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<form method="post" action="/api/auth/login">
+<h2>inspectro</h2>
+{{if .Error}}<p class="error">Invalid username or password</p>{{end}}
+<input name="username" placeholder="Username" autocomplete="username" required autofocus>
+<input name="password" type="password" placeholder="Password" autocomplete="current-password" required>
+<input name="next" type="hidden" value="{{.Next}}">
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// safeNext only allows redirects back into inspectro after login.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+
+	return next
+}
+
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func DoGetLoginPage() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginPage.Execute(w, map[string]any{
+			"Error": r.URL.Query().Get("error") != "",
+			"Next":  safeNext(r.URL.Query().Get("next")),
+		})
+	}
+}
+
+// DoLogin accepts a JSON body, answering with the user, or the login page
+// form, answering with a redirect.
+func DoLogin(db *sql.DB, sessionTTL time.Duration) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+
+		var login LoginRequest
+		next := "/"
+		if isJSON {
+			if err := json.NewDecoder(r.Body).Decode(&login); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else {
+			login.Username = r.PostFormValue("username")
+			login.Password = r.PostFormValue("password")
+			next = safeNext(r.PostFormValue("next"))
+		}
+
+		user, err := authenticate(r.Context(), db, login.Username, login.Password)
+		if errors.Is(err, ErrInvalidCredentials) {
+			if isJSON {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			} else {
+				http.Redirect(w, r, "/login?error=1&next="+url.QueryEscape(next), http.StatusSeeOther)
+			}
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		token, expiresAt, err := createSession(r.Context(), db, user, sessionTTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     SESSION_COOKIE,
+			Value:    token,
+			Path:     "/",
+			Expires:  expiresAt,
+			HttpOnly: true,
+			Secure:   isSecure(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		if !isJSON {
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(user)
+	}
+}
+
+func DoLogout(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(SESSION_COOKIE); err == nil {
+			if err := deleteSession(r.Context(), db, cookie.Value); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     SESSION_COOKIE,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   isSecure(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func DoGetMe() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFrom(r.Context())
+		if !ok {
+			http.Error(w, "authentication is disabled", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(user)
+	}
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/keys"
+)
+
+// ADMIN_USER is the user requests carrying the admin token act as.
+const ADMIN_USER = "admin"
+
+type userKey struct{}
+
+// UserFrom returns the user Middleware authenticated the request as.
+func UserFrom(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userKey{}).(User)
+	return user, ok
+}
+
+// publicPaths are served without authentication: the proxy has virtual keys
+// of its own, probes and scrapers carry no credentials.
+var publicPaths = []string{"/proxy", "/healthz", "/readyz", "/metrics", "/login", "/api/auth/login", "/assets/"}
+
+func isPublic(path string) bool {
+	for _, public := range publicPaths {
+		if path == public || (strings.HasPrefix(path, public) && (strings.HasSuffix(public, "/") || path[len(public)] == '/')) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func authenticateRequest(r *http.Request, db *sql.DB, adminToken string) (User, bool) {
+	if token, ok := keys.BearerToken(r); ok && adminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return User{Name: ADMIN_USER, Role: ROLE_ADMIN}, true
+	}
+
+	cookie, err := r.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return User{}, false
+	}
+
+	user, err := lookupSession(r.Context(), db, cookie.Value)
+	if err != nil {
+		return User{}, false
+	}
+
+	return user, true
+}
+
+// isUnsafe tells whether a request may change state.
+func isUnsafe(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+
+	return true
+}
+
+// Middleware guards the dashboard and /api/* behind a session cookie or the
+// admin token, also on a fresh install, whose first admin is created with
+// the users create command. Requests changing state with a session cookie
+// must be JSON, which no cross-site form can send.
+func Middleware(db *sql.DB, adminToken string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, ok := authenticateRequest(r, db, adminToken)
+		if !ok {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+
+		if _, bearer := keys.BearerToken(r); !bearer && isUnsafe(r) &&
+			!strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "requests changing state must send Content-Type: application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// WarnIfNoUsers logs when nobody can sign in to the dashboard yet.
+func WarnIfNoUsers(ctx context.Context, db *sql.DB, adminToken string) {
+	if adminToken != "" {
+		return
+	}
+
+	if enabled, err := hasUsers(ctx, db); err == nil && !enabled {
+		slog.Warn("nobody can sign in yet, create the first admin with \"inspectro users create <name>\" or set an admin token")
+	}
+}
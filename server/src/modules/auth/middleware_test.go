@@ -0,0 +1,181 @@
+package auth_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/auth"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
+)
+
+// whoAmI answers with the user the request was authenticated as, none on
+// public paths.
+func whoAmI(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFrom(r.Context())
+	fmt.Fprint(w, user.Name)
+}
+
+func TestPublicPaths(t *testing.T) {
+	api := auth.Middleware(openDB(t), ADMIN_TOKEN, http.HandlerFunc(whoAmI))
+
+	tests := []struct {
+		path     string
+		status   int
+		location string
+	}{
+		{"/proxy", http.StatusOK, ""},
+		{"/proxy/v1/chat/completions", http.StatusOK, ""},
+		{"/healthz", http.StatusOK, ""},
+		{"/metrics", http.StatusOK, ""},
+		{"/login", http.StatusOK, ""},
+		{"/api/auth/login", http.StatusOK, ""},
+		{"/assets/index.js", http.StatusOK, ""},
+		// sharing a prefix with a public path is not enough
+		{"/proxyx", http.StatusSeeOther, "/login?next=%2Fproxyx"},
+		{"/healthz-debug", http.StatusSeeOther, "/login?next=%2Fhealthz-debug"},
+		{"/api/auth/me", http.StatusUnauthorized, ""},
+		{"/api/keys", http.StatusUnauthorized, ""},
+		{"/usage?from=today", http.StatusSeeOther, "/login?next=%2Fusage%3Ffrom%3Dtoday"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d", rec.Code, tt.status)
+			}
+			if location := rec.Header().Get("Location"); location != tt.location {
+				t.Fatalf("redirected to %q, want %q", location, tt.location)
+			}
+		})
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	db := openDB(t)
+
+	tests := []struct {
+		name       string
+		adminToken string
+		header     string
+		status     int
+		user       string
+	}{
+		{"admin token", ADMIN_TOKEN, "Bearer " + ADMIN_TOKEN, http.StatusOK, auth.ADMIN_USER},
+		{"wrong token", ADMIN_TOKEN, "Bearer not-the-token", http.StatusUnauthorized, ""},
+		{"not a bearer", ADMIN_TOKEN, "Basic " + ADMIN_TOKEN, http.StatusUnauthorized, ""},
+		// an unset admin token matches nothing, an empty bearer included
+		{"no admin token", "", "Bearer ", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := auth.Middleware(db, tt.adminToken, http.HandlerFunc(whoAmI))
+
+			// no cross-site form carries the token, it needs no JSON
+			req := httptest.NewRequest(http.MethodPost, "/api/keys", strings.NewReader("name=key"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Authorization", tt.header)
+
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status == http.StatusOK && rec.Body.String() != tt.user {
+				t.Fatalf("authenticated as %q, want %q", rec.Body.String(), tt.user)
+			}
+		})
+	}
+}
+
+func TestCookieNeedsJSON(t *testing.T) {
+	db := openDB(t)
+	api := newAPI(db)
+
+	if err := auth.CreateUser(context.Background(), db, "root", PASSWORD, auth.ROLE_ADMIN, ""); err != nil {
+		t.Fatal(err)
+	}
+	cookie := login(t, api, "root")
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		status      int
+	}{
+		{"form", http.MethodPost, "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"plain text", http.MethodPost, "text/plain", http.StatusUnsupportedMediaType},
+		{"none", http.MethodPost, "", http.StatusUnsupportedMediaType},
+		{"json", http.MethodPost, "application/json; charset=utf-8", http.StatusCreated},
+		// reading changes nothing, whatever it is sent as
+		{"reading", http.MethodGet, "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/keys", strings.NewReader(`{"name":"`+strings.ReplaceAll(tt.name, " ", "-")+`"}`))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			req.AddCookie(cookie)
+
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	api := newAPI(db)
+
+	for _, name := range []string{"root", "other"} {
+		if err := auth.CreateUser(ctx, db, name, PASSWORD, auth.ROLE_ADMIN, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cookie := login(t, api, "root")
+	if expires := time.Until(cookie.Expires); expires <= SESSION_TTL-time.Minute || expires > SESSION_TTL {
+		t.Fatalf("session cookie expires in %s, want %s", expires, SESSION_TTL)
+	}
+
+	rec := call(api, cookie, http.MethodGet, "/api/auth/me", "")
+	var user auth.User
+	if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+		t.Fatalf("%d %s: %v", rec.Code, rec.Body.String(), err)
+	}
+	if user.Name != "root" {
+		t.Fatalf("signed in as %q, want root", user.Name)
+	}
+
+	// the cookie outliving the session on the server does not help
+	if _, err := db.Exec(`UPDATE sessions SET expires_at = ?`, utils.FormatDatetime(time.Now().Add(-time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	if rec := call(api, cookie, http.MethodGet, "/api/auth/me", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expired session: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	// and is cleaned up by the next login
+	login(t, api, "other")
+	var sessions int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sessions`).Scan(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if sessions != 1 {
+		t.Fatalf("%d sessions left, want the one just created", sessions)
+	}
+}
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"slices"
+)
+
+// TeamScope returns the team a request is limited to, or "" when it may see
+// every team. It is false when the request may see none, without a user or
+// for a non-admin without a team.
+func TeamScope(ctx context.Context) (string, bool) {
+	user, ok := UserFrom(ctx)
+	if !ok {
+		return "", false
+	}
+
+	if user.Role == ROLE_ADMIN {
+		return "", true
+	}
+
+	return user.Team, user.Team != ""
+}
+
+// RequireRole answers 403 unless the user has one of roles.
+func RequireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFrom(r.Context())
+		if !ok || !slices.Contains(roles, user.Role) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return RequireRole(next, ROLE_ADMIN)
+}
@@ -0,0 +1,196 @@
+package auth_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/auth"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/budgets"
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/keys"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/keysAPI"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/teams"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/teamsAPI"
+)
+
+const (
+	ADMIN_TOKEN = "test-admin-token"
+	PASSWORD    = "test-password"
+	SESSION_TTL = time.Hour
+)
+
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// newAPI returns the routes of main.go the tests go through, behind
+// auth.Middleware.
+func newAPI(db *sql.DB) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/auth/login", auth.DoLogin(db, SESSION_TTL))
+	mux.HandleFunc("GET /api/auth/me", auth.DoGetMe())
+	mux.HandleFunc("GET /api/keys", keysAPI.DoListKeys(db))
+	mux.HandleFunc("POST /api/keys", auth.RequireRole(keysAPI.DoCreateKey(db), auth.ROLE_ADMIN, auth.ROLE_TEAM_ADMIN))
+	mux.HandleFunc("GET /api/teams", auth.RequireAdmin(teamsAPI.DoListTeams(db)))
+	mux.HandleFunc("GET /api/teams/{name}/budget", teamsAPI.DoGetTeamBudget(db))
+	mux.HandleFunc("PUT /api/teams/{name}/budget", auth.RequireAdmin(teamsAPI.DoSetTeamBudget(db)))
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return auth.Middleware(db, ADMIN_TOKEN, mux)
+}
+
+// login signs name in and returns the session cookie.
+func login(t *testing.T, api http.Handler, name string) *http.Cookie {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/login",
+		strings.NewReader(`{"username":"`+name+`","password":"`+PASSWORD+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("logging in %s: %d %s", name, rec.Code, rec.Body.String())
+	}
+
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == auth.SESSION_COOKIE {
+			return cookie
+		}
+	}
+
+	t.Fatalf("logging in %s set no session cookie", name)
+	return nil
+}
+
+// call sends a request as the user of cookie, JSON when it has a body.
+func call(api http.Handler, cookie *http.Cookie, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestTeamScope(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	api := newAPI(db)
+
+	for _, team := range []string{"red", "blue"} {
+		if err := teams.Create(ctx, db, team); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := keys.Create(ctx, db, team+"-key", team, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users := []struct{ name, role, team string }{
+		{"root", auth.ROLE_ADMIN, ""},
+		{"red-admin", auth.ROLE_TEAM_ADMIN, "red"},
+		{"red-viewer", auth.ROLE_VIEWER, "red"},
+	}
+	for _, user := range users {
+		if err := auth.CreateUser(ctx, db, user.name, PASSWORD, user.role, user.team); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, redAdmin, redViewer := login(t, api, "root"), login(t, api, "red-admin"), login(t, api, "red-viewer")
+
+	listKeys := func(cookie *http.Cookie) []string {
+		t.Helper()
+
+		rec := call(api, cookie, http.MethodGet, "/api/keys", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("listing keys: %d %s", rec.Code, rec.Body.String())
+		}
+
+		var virtualKeys []keys.VirtualKey
+		if err := json.Unmarshal(rec.Body.Bytes(), &virtualKeys); err != nil {
+			t.Fatal(err)
+		}
+
+		names := make([]string, 0, len(virtualKeys))
+		for _, key := range virtualKeys {
+			names = append(names, key.Name)
+		}
+
+		return names
+	}
+
+	if names := listKeys(root); len(names) != 2 {
+		t.Fatalf("admin sees keys %v, want both teams", names)
+	}
+	if names := listKeys(redViewer); len(names) != 1 || names[0] != "red-key" {
+		t.Fatalf("red viewer sees keys %v, want red-key only", names)
+	}
+
+	// a team admin creates keys for their own team whatever they ask for
+	if rec := call(api, redAdmin, http.MethodPost, "/api/keys", `{"name":"sneaky","team":"blue"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("team admin creating a key: %d %s", rec.Code, rec.Body.String())
+	}
+	if names := listKeys(redViewer); len(names) != 2 {
+		t.Fatalf("red viewer sees keys %v, want the key their team admin created", names)
+	}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"viewer creating a key", redViewer, http.MethodPost, "/api/keys", `{"name":"nope"}`, http.StatusForbidden},
+		{"team admin listing teams", redAdmin, http.MethodGet, "/api/teams", "", http.StatusForbidden},
+		{"team admin setting a budget", redAdmin, http.MethodPut, "/api/teams/red/budget", `{"budget":100}`, http.StatusForbidden},
+		{"admin setting a budget", root, http.MethodPut, "/api/teams/red/budget", `{"budget":100}`, http.StatusNoContent},
+		{"admin setting a negative budget", root, http.MethodPut, "/api/teams/red/budget", `{"budget":-1}`, http.StatusBadRequest},
+		{"viewer reading their budget", redViewer, http.MethodGet, "/api/teams/red/budget", "", http.StatusOK},
+		{"viewer reading another budget", redViewer, http.MethodGet, "/api/teams/blue/budget", "", http.StatusForbidden},
+		{"admin reading any budget", root, http.MethodGet, "/api/teams/blue/budget", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := call(api, tt.cookie, tt.method, tt.path, tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+
+	rec := call(api, redViewer, http.MethodGet, "/api/teams/red/budget", "")
+	var status budgets.Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Name != "red" || status.Budget != 100 {
+		t.Fatalf("red budget %+v, want 100", status)
+	}
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
+	"github.com/leporo/sqlf"
+)
+
+const SESSION_COOKIE = "inspectro_session"
+
+var ErrSessionNotFound = errors.New("session not found or expired")
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSession returns a new session token for user, only its hash is
+// stored.
+func createSession(ctx context.Context, db *sql.DB, user User, ttl time.Duration) (string, time.Time, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", time.Time{}, fmt.Errorf("error generating session: %w", err)
+	}
+	token := hex.EncodeToString(secret)
+	expiresAt := time.Now().Add(ttl)
+
+	query := sqlf.InsertInto("sessions").
+		NewRow().
+		Set("token_hash", hashToken(token)).
+		Set("user_name", user.Name).
+		Set("expires_at", utils.FormatDatetime(expiresAt))
+
+	if _, err := query.Exec(ctx, db); err != nil {
+		return "", time.Time{}, fmt.Errorf("error creating session: %w", err)
+	}
+
+	// expired sessions are cleaned up whenever someone logs in
+	if _, err := sqlf.DeleteFrom("sessions").
+		Where("expires_at <= ?", utils.FormatDatetime(time.Now())).
+		Exec(ctx, db); err != nil {
+		return "", time.Time{}, fmt.Errorf("error deleting expired sessions: %w", err)
+	}
+
+	return token, expiresAt, nil
+}
+
+func lookupSession(ctx context.Context, db *sql.DB, token string) (User, error) {
+	var user User
+	query := sqlf.From("sessions as s").
+		Join("users as u", "u.name = s.user_name").
+		Where("s.token_hash = ?", hashToken(token)).
+		Where("s.expires_at > ?", utils.FormatDatetime(time.Now())).
+		Select("u.name").To(&user.Name).
+		Select("u.role").To(&user.Role).
+		Select("COALESCE(u.team_name, '')").To(&user.Team).
+		Select("u.created_at").To(&user.CreatedAt)
+	if err := query.QueryRowAndClose(ctx, db); errors.Is(err, sql.ErrNoRows) {
+		return user, ErrSessionNotFound
+	} else if err != nil {
+		return user, fmt.Errorf("error querying session: %w", err)
+	}
+
+	return user, nil
+}
+
+func deleteSession(ctx context.Context, db *sql.DB, token string) error {
+	if _, err := sqlf.DeleteFrom("sessions").Where("token_hash = ?", hashToken(token)).Exec(ctx, db); err != nil {
+		return fmt.Errorf("error deleting session: %w", err)
+	}
+
+	return nil
+}
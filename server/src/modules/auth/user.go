@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/teams"
+	"github.com/leporo/sqlf"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const MIN_PASSWORD_LENGTH = 8
+
+// Admins see and change everything. Team admins manage the virtual keys of
+// their team, viewers only read what belongs to their team.
+const (
+	ROLE_ADMIN      = "admin"
+	ROLE_TEAM_ADMIN = "team-admin"
+	ROLE_VIEWER     = "viewer"
+)
+
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrUserExists         = errors.New("user already exists")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+)
+
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("inspectro"), bcrypt.DefaultCost)
+	return hash
+})
+
+type User struct {
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Team      string    `json:"team,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateUser adds a user with role. Every role but admin needs a team.
+func CreateUser(ctx context.Context, db *sql.DB, name string, password string, role string, team string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("user name is required")
+	}
+
+	switch role {
+	case ROLE_ADMIN:
+		team = ""
+	case ROLE_TEAM_ADMIN, ROLE_VIEWER:
+		if team == "" {
+			return fmt.Errorf("role %s needs a team", role)
+		}
+
+		exists, err := teams.Exists(ctx, db, team)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: %s", teams.ErrTeamNotFound, team)
+		}
+	default:
+		return fmt.Errorf("unknown role %q, use %s, %s or %s", role, ROLE_ADMIN, ROLE_TEAM_ADMIN, ROLE_VIEWER)
+	}
+
+	if len(password) < MIN_PASSWORD_LENGTH {
+		return fmt.Errorf("password must be at least %d characters", MIN_PASSWORD_LENGTH)
+	}
+
+	var count int
+	query := sqlf.From("users").Select("COUNT(*)").To(&count).Where("name = ?", name)
+	if err := query.QueryRowAndClose(ctx, db); err != nil {
+		return fmt.Errorf("error creating user: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %s", ErrUserExists, name)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+
+	insert := sqlf.InsertInto("users").
+		NewRow().
+		Set("name", name).
+		Set("password_hash", string(hash)).
+		Set("role", role).
+		Set("team_name", team)
+
+	if _, err := insert.Exec(ctx, db); err != nil {
+		return fmt.Errorf("error creating user: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteUser removes the user called name and ends their sessions.
+func DeleteUser(ctx context.Context, db *sql.DB, name string) error {
+	result, err := sqlf.DeleteFrom("users").Where("name = ?", name).Exec(ctx, db)
+	if err != nil {
+		return fmt.Errorf("error deleting user: %w", err)
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, name)
+	}
+
+	if _, err := sqlf.DeleteFrom("sessions").Where("user_name = ?", name).Exec(ctx, db); err != nil {
+		return fmt.Errorf("error deleting user sessions: %w", err)
+	}
+
+	return nil
+}
+
+func ListUsers(ctx context.Context, db *sql.DB) ([]User, error) {
+	query := sqlf.From("users").
+		OrderBy("name ASC").
+		Select("name").
+		Select("role").
+		Select("COALESCE(team_name, '')").
+		Select("created_at")
+
+	users := make([]User, 0)
+
+	rows, err := db.QueryContext(ctx, query.String(), query.Args()...)
+	if err != nil {
+		return users, fmt.Errorf("error querying user: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.Name, &user.Role, &user.Team, &user.CreatedAt); err != nil {
+			return users, fmt.Errorf("error querying user: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return users, fmt.Errorf("error querying user: %w", err)
+	}
+
+	return users, nil
+}
+
+func hasUsers(ctx context.Context, db *sql.DB) (bool, error) {
+	var count int
+	if err := sqlf.From("users").Select("COUNT(*)").To(&count).QueryRowAndClose(ctx, db); err != nil {
+		return false, fmt.Errorf("error querying user: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// authenticate checks password against the stored hash of name.
+func authenticate(ctx context.Context, db *sql.DB, name string, password string) (User, error) {
+	user := User{Name: name}
+
+	var hash string
+	query := sqlf.From("users").
+		Where("name = ?", name).
+		Select("password_hash").To(&hash).
+		Select("role").To(&user.Role).
+		Select("COALESCE(team_name, '')").To(&user.Team).
+		Select("created_at").To(&user.CreatedAt)
+	if err := query.QueryRowAndClose(ctx, db); errors.Is(err, sql.ErrNoRows) {
+		// keep the timing close to a wrong password
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return user, ErrInvalidCredentials
+	} else if err != nil {
+		return user, fmt.Errorf("error querying user: %w", err)
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return user, ErrInvalidCredentials
+	}
+
+	return user, nil
+}
@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+)
+
+// NAME_LAYOUT names backups by the UTC time they were taken, so sorting
+// names sorts backups by age.
+const NAME_LAYOUT = "inspectro-20060102T150405.000000Z.db"
+
+var running sync.WaitGroup
+
+// Write takes a backup of db into dir and returns its path. It is written
+// under a temporary name first, so an interrupted backup is never mistaken
+// for a complete one.
+func Write(ctx context.Context, db *sql.DB, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", fmt.Errorf("error creating dir %s: %w", dir, err)
+	}
+
+	path := filepath.Join(dir, time.Now().UTC().Format(NAME_LAYOUT))
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("error backing up db: %s already exists", path)
+	}
+	partial := path + ".partial"
+
+	// VACUUM INTO refuses to overwrite, a crashed earlier attempt may remain
+	os.Remove(partial)
+
+	if err := database.Current().Backup(ctx, db, partial); err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+
+	if err := os.Rename(partial, path); err != nil {
+		return "", fmt.Errorf("error backing up db: %w", err)
+	}
+
+	return path, nil
+}
+
+// List returns the backups in dir, oldest first.
+func List(dir string) ([]string, error) {
+	backups, err := filepath.Glob(filepath.Join(dir, "inspectro-*Z.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(backups)
+
+	return backups, nil
+}
+
+// Rotate deletes all but the newest keep backups in dir.
+func Rotate(dir string, keep int) error {
+	backups, err := List(dir)
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > max(keep, 1) {
+		if err := os.Remove(backups[0]); err != nil {
+			return fmt.Errorf("error rotating backups: %w", err)
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// Start backs db up into dir every interval, keeping the newest keep
+// backups, until ctx is done. Nothing is scheduled on backends without
+// backup support, each tick would fail.
+func Start(ctx context.Context, db *sql.DB, dir string, interval time.Duration, keep int) {
+	if backend := database.Current(); !backend.SupportsBackup() {
+		slog.Warn("scheduled backups are not supported, use the tools of the database", "backend", backend.Name())
+		return
+	}
+
+	running.Add(1)
+	go func() {
+		defer running.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			path, err := Write(ctx, db, dir)
+			if err != nil {
+				slog.Error("scheduled backup failed", "err", err)
+				continue
+			}
+			slog.Info("backed up database", "path", path)
+
+			if err := Rotate(dir, keep); err != nil {
+				slog.Warn("failed rotating backups", "err", err)
+			}
+		}
+	}()
+}
+
+// Wait blocks until the loop started by Start has stopped.
+func Wait() {
+	running.Wait()
+}
@@ -0,0 +1,61 @@
+package backup_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/backup"
+)
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	names := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		names = append(names, start.Add(time.Duration(i)*time.Hour).Format(backup.NAME_LAYOUT))
+	}
+
+	// written out of order, and next to files that are no backups
+	for _, name := range []string{names[2], names[0], names[3], names[1], names[3] + ".partial", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		keep int
+		want []string
+	}{
+		{3, names[1:]},
+		{2, names[2:]},
+		// the newest backup is always kept
+		{0, names[3:]},
+	} {
+		if err := backup.Rotate(dir, tt.keep); err != nil {
+			t.Fatal(err)
+		}
+
+		backups, err := backup.List(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := make([]string, 0, len(tt.want))
+		for _, name := range tt.want {
+			want = append(want, filepath.Join(dir, name))
+		}
+		if !slices.Equal(backups, want) {
+			t.Fatalf("keeping %d left %v, want %v", tt.keep, backups, want)
+		}
+	}
+
+	for _, name := range []string{names[3] + ".partial", "notes.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("rotating removed %s: %v", name, err)
+		}
+	}
+}
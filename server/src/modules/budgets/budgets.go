@@ -0,0 +1,122 @@
+package budgets
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/currency"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/projects"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/teams"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/usageAPI"
+)
+
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Status is what a team or a project spent of its budget in the current
+// period. Budgets run per calendar month in UTC and are in the reporting
+// currency.
+type Status struct {
+	Name        string    `json:"name"`
+	Budget      float64   `json:"budget"`
+	Spent       float64   `json:"spent"`
+	Currency    string    `json:"currency"`
+	PeriodStart time.Time `json:"period_start"`
+}
+
+// PeriodStart returns the start of the budget period now falls in.
+func PeriodStart(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func status(ctx context.Context, db *sql.DB, name string, budget float64, scope usageAPI.Scope) (Status, error) {
+	now := time.Now()
+	status := Status{Name: name, Budget: budget, PeriodStart: PeriodStart(now)}
+
+	rates, err := currency.LoadRates(ctx, db)
+	if err != nil {
+		return status, err
+	}
+	status.Currency = rates.Reporting
+
+	spending, err := usageAPI.GetSpending(ctx, db, uint64(status.PeriodStart.Unix()), uint64(now.Unix()), scope, rates, rates.Reporting)
+	if err != nil {
+		return status, fmt.Errorf("error querying budget of %s: %w", name, err)
+	}
+	status.Spent = spending.Money
+
+	return status, nil
+}
+
+// TeamStatus returns what the team called name spent of its budget.
+func TeamStatus(ctx context.Context, db *sql.DB, name string) (Status, error) {
+	budget, err := teams.Budget(ctx, db, name)
+	if err != nil {
+		return Status{Name: name}, err
+	}
+
+	return status(ctx, db, name, budget, usageAPI.Scope{Team: name})
+}
+
+// CheckTeam fails with ErrBudgetExceeded once the team called name spent its
+// budget. Keys without a team, and teams without a budget, are not capped.
+func CheckTeam(ctx context.Context, db *sql.DB, name string) error {
+	if name == "" {
+		return nil
+	}
+
+	budget, err := teams.Budget(ctx, db, name)
+	if errors.Is(err, teams.ErrTeamNotFound) {
+		return nil // its keys outlive a deleted team
+	} else if err != nil || budget == 0 {
+		return err
+	}
+
+	status, err := status(ctx, db, name, budget, usageAPI.Scope{Team: name})
+	if err != nil {
+		return err
+	}
+
+	if status.Spent >= status.Budget {
+		return fmt.Errorf("%w: team %s spent %.2f of %.2f %s", ErrBudgetExceeded, name, status.Spent, status.Budget, status.Currency)
+	}
+
+	return nil
+}
+
+// ProjectStatus returns what the project called name spent of its budget.
+func ProjectStatus(ctx context.Context, db *sql.DB, name string) (Status, error) {
+	project, err := projects.Get(ctx, db, name)
+	if err != nil {
+		return Status{Name: name}, err
+	}
+
+	return status(ctx, db, name, project.Budget, usageAPI.Scope{Project: name})
+}
+
+// CheckProject fails with ErrBudgetExceeded once the project called name
+// spent its budget.
+func CheckProject(ctx context.Context, db *sql.DB, name string) error {
+	if name == "" {
+		return nil
+	}
+
+	project, err := projects.Get(ctx, db, name)
+	if err != nil || project.Budget == 0 {
+		return err
+	}
+
+	status, err := status(ctx, db, name, project.Budget, usageAPI.Scope{Project: name})
+	if err != nil {
+		return err
+	}
+
+	if status.Spent >= status.Budget {
+		return fmt.Errorf("%w: project %s spent %.2f of %.2f %s", ErrBudgetExceeded, name, status.Spent, status.Budget, status.Currency)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package catalog
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
+)
+
+func DoGetCatalog() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		catalog, err := LoadCatalog()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(catalog)
+	}
+}
+
+func DoImportCatalog(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := Import(func(update func(llms *watcher.LLMModels) error) error {
+			return watcher.UpdateLLM(r.Context(), db, update)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,150 @@
+package catalog
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
+	"gopkg.in/yaml.v3"
+)
+
+func catalogPath() string {
+	return filepath.Join(watcher.ConfigRoot(), "catalog.yaml")
+}
+
+//go:embed catalog.yaml
+var bundledCatalog []byte
+
+type CatalogModel struct {
+	Name             string `yaml:"name" json:"name"`
+	Provider         string `yaml:"provider" json:"provider"`
+	entities.LLMCost `yaml:",inline"`
+}
+
+type Catalog struct {
+	UpdatedAt string         `yaml:"updatedAt" json:"updatedAt"`
+	Models    []CatalogModel `yaml:"models" json:"models"`
+}
+
+type ImportResult struct {
+	Imported  []entities.LLM `json:"imported"`
+	Unmatched []string       `json:"unmatched"`
+}
+
+var errNothingToImport = errors.New("nothing to import")
+
+// LoadCatalog returns the bundled catalog with entries of catalog.yaml next to
+// llm.yaml, when present, replacing bundled ones of the same name.
+func LoadCatalog() (*Catalog, error) {
+	catalog := &Catalog{}
+	if err := yaml.Unmarshal(bundledCatalog, catalog); err != nil {
+		return nil, fmt.Errorf("error reading bundled catalog: %w", err)
+	}
+
+	path := catalogPath()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return catalog, nil
+		}
+		return nil, fmt.Errorf("error loading %s: %w", path, err)
+	}
+
+	override := &Catalog{}
+	if err := yaml.Unmarshal(content, override); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	for _, model := range override.Models {
+		if idx := catalog.find(model.Name); idx >= 0 {
+			catalog.Models[idx] = model
+		} else {
+			catalog.Models = append(catalog.Models, model)
+		}
+	}
+
+	if override.UpdatedAt > catalog.UpdatedAt {
+		catalog.UpdatedAt = override.UpdatedAt
+	}
+
+	return catalog, nil
+}
+
+func (c *Catalog) find(name string) int {
+	for i, model := range c.Models {
+		if model.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Lookup finds a model by name, also trying the name without a routing
+// prefix such as "openai/gpt-4o".
+func (c *Catalog) Lookup(name string) (CatalogModel, bool) {
+	if idx := c.find(name); idx >= 0 {
+		return c.Models[idx], true
+	}
+
+	if slash := strings.LastIndex(name, "/"); slash >= 0 {
+		if idx := c.find(name[slash+1:]); idx >= 0 {
+			return c.Models[idx], true
+		}
+	}
+
+	return CatalogModel{}, false
+}
+
+// Import prices every model in llm.yaml that has no price of its own from the
+// catalog. apply is given the change to make to llm.yaml, so callers pick
+// between watcher.UpdateLLMConfig and watcher.UpdateLLM.
+func Import(apply func(update func(llms *watcher.LLMModels) error) error) (ImportResult, error) {
+	result := ImportResult{
+		Imported:  make([]entities.LLM, 0),
+		Unmatched: make([]string, 0),
+	}
+
+	catalog, err := LoadCatalog()
+	if err != nil {
+		return result, err
+	}
+
+	err = apply(func(llms *watcher.LLMModels) error {
+		unpriced, err := watcher.UnpricedModels()
+		if err != nil {
+			return err
+		}
+
+		for i, llm := range llms.Models {
+			if !unpriced[llm.Name] {
+				continue
+			}
+
+			model, ok := catalog.Lookup(llm.Name)
+			if !ok {
+				result.Unmatched = append(result.Unmatched, llm.Name)
+				continue
+			}
+
+			llms.Models[i].LLMCost = model.LLMCost
+			result.Imported = append(result.Imported, llms.Models[i])
+		}
+
+		if len(result.Imported) == 0 {
+			return errNothingToImport
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNothingToImport) {
+		return result, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,172 @@
+package catalog_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/catalog"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
+)
+
+// useConfigRoot points llm.yaml into a directory of its own, holding
+// catalog.yaml when catalogYAML is set, and returns the llm.yaml path.
+func useConfigRoot(t *testing.T, catalogYAML string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	if catalogYAML != "" {
+		if err := os.WriteFile(filepath.Join(root, "catalog.yaml"), []byte(catalogYAML), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	configPath := filepath.Join(root, "llm.yaml")
+	watcher.UseConfigPath(configPath)
+
+	return configPath
+}
+
+func loadCatalog(t *testing.T) *catalog.Catalog {
+	t.Helper()
+
+	c, err := catalog.LoadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestLoadCatalog(t *testing.T) {
+	useConfigRoot(t, "")
+	bundled := loadCatalog(t)
+
+	gpt4o, ok := bundled.Lookup("gpt-4o")
+	if !ok || gpt4o.Provider != "openai" || gpt4o.CostPerMillionInputTokens != 2.5 {
+		t.Fatalf("bundled gpt-4o %+v, %v", gpt4o, ok)
+	}
+
+	tests := []struct {
+		name      string
+		updatedAt string
+		want      string
+	}{
+		{"newer", "2030-01-01", "2030-01-01"},
+		// an older override keeps the date of the bundled prices
+		{"older", "2020-01-01", bundled.UpdatedAt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfigRoot(t, `updatedAt: `+tt.updatedAt+`
+models:
+  - name: gpt-4o
+    provider: azure
+    costPerMillionInputToken: 2
+    costPerMillionOutputToken: 8
+  - name: house-model
+    provider: ollama
+    costPerMillionInputToken: 0.1
+    costPerMillionOutputToken: 0.2
+`)
+			merged := loadCatalog(t)
+
+			if len(merged.Models) != len(bundled.Models)+1 {
+				t.Fatalf("merged %d models, want the %d bundled and house-model", len(merged.Models), len(bundled.Models))
+			}
+			if model, _ := merged.Lookup("gpt-4o"); model.Provider != "azure" || model.CostPerMillionInputTokens != 2 || model.CostPerMillionCachedInputTokens != nil {
+				t.Fatalf("gpt-4o %+v, want the override as a whole", model)
+			}
+			if model, ok := merged.Lookup("house-model"); !ok || model.CostPerMillionOutputTokens != 0.2 {
+				t.Fatalf("house-model %+v, %v", model, ok)
+			}
+			if merged.UpdatedAt != tt.want {
+				t.Fatalf("updated at %s, want %s", merged.UpdatedAt, tt.want)
+			}
+		})
+	}
+
+	useConfigRoot(t, "models: [")
+	if _, err := catalog.LoadCatalog(); err == nil {
+		t.Fatal("loaded a broken catalog.yaml")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	useConfigRoot(t, "")
+	c := loadCatalog(t)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"gpt-4o", "gpt-4o"},
+		{"openai/gpt-4o", "gpt-4o"},
+		{"openrouter/openai/gpt-4o-mini", "gpt-4o-mini"},
+		// names are matched whole, not by prefix
+		{"gpt-4o-2024-08-06", ""},
+		{"openai/", ""},
+		{"unknown", ""},
+	}
+
+	for _, tt := range tests {
+		model, ok := c.Lookup(tt.name)
+		if ok != (tt.want != "") || model.Name != tt.want {
+			t.Fatalf("looking up %s found %q, %v, want %q", tt.name, model.Name, ok, tt.want)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	configPath := useConfigRoot(t, "")
+	if err := os.WriteFile(configPath, []byte(`providers:
+  - name: openai
+    apiBase: https://api.openai.com/v1
+models:
+  - name: openai/gpt-4o
+    provider: openai
+  - name: gpt-4o-mini
+    provider: openai
+    costPerMillionInputToken: 1
+    costPerMillionOutputToken: 1
+  - name: mystery
+    provider: openai
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := catalog.Import(watcher.UpdateLLMConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := make([]string, 0)
+	for _, llm := range result.Imported {
+		imported = append(imported, llm.Name)
+	}
+	if !slices.Equal(imported, []string{"openai/gpt-4o"}) || !slices.Equal(result.Unmatched, []string{"mystery"}) {
+		t.Fatalf("imported %v, unmatched %v", imported, result.Unmatched)
+	}
+
+	llms, err := watcher.LoadLLMConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, llm := range llms.Models {
+		want := map[string]float64{"openai/gpt-4o": 2.5, "gpt-4o-mini": 1, "mystery": 0}[llm.Name]
+		if llm.CostPerMillionInputTokens != want {
+			t.Fatalf("%s priced at %v, want %v", llm.Name, llm.CostPerMillionInputTokens, want)
+		}
+	}
+
+	// what is left has no catalog price, which is no error
+	result, err = catalog.Import(watcher.UpdateLLMConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Imported) != 0 || !slices.Equal(result.Unmatched, []string{"mystery"}) {
+		t.Fatalf("imported %v again, unmatched %v", result.Imported, result.Unmatched)
+	}
+}
@@ -0,0 +1,362 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/auth"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/backup"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/catalog"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/config"
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/keys"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/llmAPI"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/projects"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/teams"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
+)
+
+func runMigrate(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %v", args)
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		fmt.Println("database is up to date")
+		return nil
+	})
+}
+
+func runValidateConfig(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %v", args)
+	}
+
+	llms, err := watcher.LoadLLMConfig()
+	if err != nil {
+		return err
+	}
+
+	err = errors.Join(llmAPI.ValidateLLMModels(llms), watcher.ValidateCurrency(llms.Currency))
+	if err != nil {
+		return fmt.Errorf("%s is invalid:\n%w", cfg.ConfigPath, err)
+	}
+
+	fmt.Printf("%s is valid: %d providers, %d models\n", cfg.ConfigPath, len(llms.Providers), len(llms.Models))
+	return nil
+}
+
+func runKeysCreate(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	fs := newFlagSet("keys create")
+	team := fs.String("team", "", "team the key belongs to")
+	project := fs.String("project", "", "project the key is limited to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a key name")
+	}
+	name := fs.Arg(0)
+
+	return withDB(cfg, func(db *sql.DB) error {
+		key, err := keys.Create(ctx, db, name, *team, *project)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "created key %s, it won't be shown again\n", name)
+		fmt.Println(key)
+		return nil
+	})
+}
+
+func runKeysRevoke(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a key name")
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		if err := keys.Revoke(ctx, db, args[0], ""); err != nil {
+			return err
+		}
+
+		fmt.Printf("revoked key %s\n", args[0])
+		return nil
+	})
+}
+
+func runKeysList(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	fs := newFlagSet("keys list")
+	team := fs.String("team", "", "only list keys of this team")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		virtualKeys, err := keys.List(ctx, db, *team)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tTEAM\tPROJECT\tPREFIX\tCREATED\tREVOKED")
+		for _, key := range virtualKeys {
+			revoked := "-"
+			if key.RevokedAt != nil {
+				revoked = utils.FormatDatetime(*key.RevokedAt)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", key.Name, orDash(key.Team), orDash(key.Project), key.Prefix, utils.FormatDatetime(key.CreatedAt), revoked)
+		}
+
+		return tw.Flush()
+	})
+}
+
+func runDBVacuum(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %v", args)
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		if _, err := db.ExecContext(ctx, `VACUUM`); err != nil {
+			return fmt.Errorf("error vacuuming db: %w", err)
+		}
+
+		fmt.Println("vacuumed database")
+		return nil
+	})
+}
+
+// runDBBackup copies the database in a way that is safe while the server
+// keeps writing to it. Without a path the copy goes into the backup dir,
+// rotated like scheduled backups.
+func runDBBackup(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("expected a single backup path")
+	}
+
+	if len(args) == 0 {
+		if cfg.BackupDir == "" {
+			return fmt.Errorf("expected a backup path or --backup-dir")
+		}
+
+		return withDB(cfg, func(db *sql.DB) error {
+			path, err := backup.Write(ctx, db, cfg.BackupDir)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("backed up database to %s\n", path)
+			return backup.Rotate(cfg.BackupDir, cfg.BackupKeep)
+		})
+	}
+
+	path := args[0]
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return fmt.Errorf("error creating dir %s: %w", filepath.Dir(path), err)
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		if err := database.Current().Backup(ctx, db, path); err != nil {
+			return err
+		}
+
+		fmt.Printf("backed up database to %s\n", path)
+		return nil
+	})
+}
+
+// runDBRestore replaces the database with a backup and migrates it to the
+// schema of this build.
+func runDBRestore(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a backup path")
+	}
+
+	if err := database.RestoreDB(ctx, cfg.DBDSN, args[0]); err != nil {
+		return err
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		fmt.Printf("restored database from %s\n", args[0])
+		return nil
+	})
+}
+
+func runCatalogImport(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %v", args)
+	}
+
+	result, err := catalog.Import(watcher.UpdateLLMConfig)
+	if err != nil {
+		return err
+	}
+
+	for _, llm := range result.Imported {
+		fmt.Printf("imported price of %s\n", llm.Name)
+	}
+	for _, name := range result.Unmatched {
+		fmt.Printf("no catalog price for %s\n", name)
+	}
+
+	return nil
+}
+
+// runUsersCreate reads the password from the first line of stdin, so it
+// stays out of the shell history.
+func runUsersCreate(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	fs := newFlagSet("users create")
+	role := fs.String("role", auth.ROLE_ADMIN, "admin, team-admin or viewer")
+	team := fs.String("team", "", "team of a team-admin or viewer")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a user name")
+	}
+	name := fs.Arg(0)
+
+	fmt.Fprintf(os.Stderr, "password for %s: ", name)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading password: %w", err)
+	}
+	fmt.Fprintln(os.Stderr)
+
+	return withDB(cfg, func(db *sql.DB) error {
+		if err := auth.CreateUser(ctx, db, name, strings.TrimRight(password, "\r\n"), *role, *team); err != nil {
+			return err
+		}
+
+		fmt.Printf("created %s %s\n", *role, name)
+		return nil
+	})
+}
+
+func runUsersDelete(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a user name")
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		if err := auth.DeleteUser(ctx, db, args[0]); err != nil {
+			return err
+		}
+
+		fmt.Printf("deleted user %s\n", args[0])
+		return nil
+	})
+}
+
+func runUsersList(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %v", args)
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		users, err := auth.ListUsers(ctx, db)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tROLE\tTEAM\tCREATED")
+		for _, user := range users {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", user.Name, user.Role, orDash(user.Team), utils.FormatDatetime(user.CreatedAt))
+		}
+
+		return tw.Flush()
+	})
+}
+
+func runTeamsCreate(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a team name")
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		if err := teams.Create(ctx, db, args[0]); err != nil {
+			return err
+		}
+
+		fmt.Printf("created team %s\n", args[0])
+		return nil
+	})
+}
+
+func runTeamsDelete(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a team name")
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		if err := teams.Delete(ctx, db, args[0]); err != nil {
+			return err
+		}
+
+		fmt.Printf("deleted team %s\n", args[0])
+		return nil
+	})
+}
+
+func runTeamsList(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %v", args)
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		teamList, err := teams.List(ctx, db)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tCREATED")
+		for _, team := range teamList {
+			fmt.Fprintf(tw, "%s\t%s\n", team.Name, utils.FormatDatetime(team.CreatedAt))
+		}
+
+		return tw.Flush()
+	})
+}
+
+func runProjectsList(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %v", args)
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		projectList, err := projects.List(ctx, db)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tMODELS")
+		for _, project := range projectList {
+			models := "all"
+			if len(project.Models) > 0 {
+				models = strings.Join(project.Models, ", ")
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", project.Name, models)
+		}
+
+		return tw.Flush()
+	})
+}
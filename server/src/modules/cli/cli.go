@@ -0,0 +1,204 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/config"
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
+)
+
+const USAGE = `usage: inspectro [flags] <command> [args]
+
+commands:
+  serve                          run the proxy and dashboard (default)
+  migrate                        create or upgrade the database schema
+  validate-config                check llm.yaml without applying it
+  usage report [flags]           print spending per model for a range
+  export [flags]                 dump usage rows as csv or json
+  keys create [flags] <name>     create a virtual key
+  keys revoke <name>             revoke a virtual key
+  keys list [--team]             list virtual keys
+  teams create <name>            create a team
+  teams delete <name>            delete a team without members
+  teams list                     list teams
+  projects list                  list projects from llm.yaml
+  users create [flags] <name>    create a dashboard user, password read from stdin
+  users delete <name>            delete a dashboard user
+  users list                     list dashboard users
+  db vacuum                      reclaim unused space in the database
+  db backup [path]               write a consistent copy of the database (default into --backup-dir)
+  db restore <path>              replace the database with a backup, with the server stopped
+  catalog import                 fill missing prices from the bundled catalog
+
+run "inspectro -h" for the server flags shared by all commands
+`
+
+type command struct {
+	name string
+	run  func(ctx context.Context, cfg *config.ServerConfig, args []string) error
+}
+
+var commands = []command{
+	{"migrate", runMigrate},
+	{"validate-config", runValidateConfig},
+	{"usage report", runUsageReport},
+	{"export", runExport},
+	{"keys create", runKeysCreate},
+	{"keys revoke", runKeysRevoke},
+	{"keys list", runKeysList},
+	{"teams create", runTeamsCreate},
+	{"teams delete", runTeamsDelete},
+	{"teams list", runTeamsList},
+	{"projects list", runProjectsList},
+	{"users create", runUsersCreate},
+	{"users delete", runUsersDelete},
+	{"users list", runUsersList},
+	{"db vacuum", runDBVacuum},
+	{"db backup", runDBBackup},
+	{"db restore", runDBRestore},
+	{"catalog import", runCatalogImport},
+}
+
+// Run executes the subcommand in args, which are the arguments left after
+// the server flags. The serve command is left to the caller.
+func Run(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	watcher.UseConfigPath(cfg.ConfigPath)
+	database.UseRemote(cfg.Remote())
+
+	if len(args) > 0 && args[0] == "help" {
+		fmt.Print(USAGE)
+		return nil
+	}
+
+	for _, cmd := range commands {
+		name, rest, ok := matchCommand(cmd.name, args)
+		if ok {
+			if err := cmd.run(ctx, cfg, rest); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			return nil
+		}
+	}
+
+	fmt.Fprint(os.Stderr, USAGE)
+	return fmt.Errorf("unknown command: %v", args)
+}
+
+// matchCommand reports whether args start with the words of name and
+// returns the arguments after them.
+func matchCommand(name string, args []string) (string, []string, bool) {
+	words := strings.Fields(name)
+	if len(args) < len(words) {
+		return name, nil, false
+	}
+
+	for i, word := range words {
+		if args[i] != word {
+			return name, nil, false
+		}
+	}
+
+	return name, args[len(words):], true
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("inspectro "+name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+func withDB(cfg *config.ServerConfig, run func(db *sql.DB) error) error {
+	db, err := database.OpenDB(cfg.DBDSN)
+	if err != nil {
+		return err
+	}
+	defer database.CloseDB(db)
+
+	return run(db)
+}
+
+// parseTime accepts a date, an RFC 3339 timestamp or unix seconds.
+func parseTime(value string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(ts, 0).UTC(), nil
+	}
+
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q, use YYYY-MM-DD, RFC 3339 or unix seconds", value)
+	}
+
+	return t, nil
+}
+
+// parseRange resolves --start and --end, falling back to defaultStart and
+// now. A bare end date covers that whole day.
+func parseRange(start string, end string, defaultStart time.Time) (uint64, uint64, error) {
+	startTime := defaultStart
+	if start != "" {
+		t, err := parseTime(start)
+		if err != nil {
+			return 0, 0, err
+		}
+		startTime = t
+	}
+
+	endTime := time.Now().UTC()
+	if end != "" {
+		t, err := parseTime(end)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if _, err := time.Parse(time.DateOnly, end); err == nil {
+			t = t.Add(24*time.Hour - time.Second)
+		}
+		endTime = t
+	}
+
+	if endTime.Before(startTime) {
+		return 0, 0, fmt.Errorf("end %s is before start %s", endTime, startTime)
+	}
+
+	return uint64(startTime.Unix()), uint64(endTime.Unix()), nil
+}
+
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "" || path == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s: %w", path, err)
+	}
+
+	return file, nil
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
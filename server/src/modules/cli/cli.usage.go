@@ -0,0 +1,156 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/config"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/usageAPI"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
+)
+
+func runUsageReport(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	fs := newFlagSet("usage report")
+	start := fs.String("start", "", "start of the range (default start of this month)")
+	end := fs.String("end", "", "end of the range (default now)")
+	target := fs.String("currency", "", "currency to report in (default the reporting currency)")
+	team := fs.String("team", "", "only report usage of this team")
+	project := fs.String("project", "", "only report usage of this project")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	startTS, endTS, err := parseRange(*start, *end, time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		return err
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		report, reportCurrency, err := usageAPI.GetUsageReport(ctx, db, startTS, endTS, usageAPI.Scope{Team: *team, Project: *project}, *target)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("usage from %s to %s in %s\n\n",
+			utils.FormatDatetime(time.Unix(int64(startTS), 0)),
+			utils.FormatDatetime(time.Unix(int64(endTS), 0)),
+			reportCurrency,
+		)
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "PROVIDER\tMODEL\tREQUESTS\tINPUT\tOUTPUT\tTOTAL\tCOST\t")
+
+		var total usageAPI.ReportRow
+		for _, row := range report {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%.4f\t\n",
+				row.Provider, row.ModelName, row.Requests, row.InputToken, row.OutputToken, row.TotalToken, row.Cost)
+
+			total.Requests += row.Requests
+			total.InputToken += row.InputToken
+			total.OutputToken += row.OutputToken
+			total.TotalToken += row.TotalToken
+			total.Cost += row.Cost
+		}
+
+		fmt.Fprintf(tw, "total\t\t%d\t%d\t%d\t%d\t%.4f\t\n",
+			total.Requests, total.InputToken, total.OutputToken, total.TotalToken, total.Cost)
+
+		return tw.Flush()
+	})
+}
+
+var exportHeader = []string{
+	"ts", "provider", "model_name", "key_name", "team_name", "project_name",
+	"input_token", "output_token", "total_token",
+	"cached_input_token", "cache_write_token", "reasoning_token",
+	"image_count", "audio_seconds",
+	"input_token_cost", "output_token_cost", "image_cost", "audio_cost", "total_token_cost",
+	"billing_currency", "cancelled", "estimated",
+}
+
+func runExport(ctx context.Context, cfg *config.ServerConfig, args []string) error {
+	fs := newFlagSet("export")
+	format := fs.String("format", "csv", "output format: csv or json")
+	output := fs.String("output", "", "file to write to (default stdout)")
+	start := fs.String("start", "", "start of the range (default all time)")
+	end := fs.String("end", "", "end of the range (default now)")
+	team := fs.String("team", "", "only export usage of this team")
+	project := fs.String("project", "", "only export usage of this project")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	startTS, endTS, err := parseRange(*start, *end, time.Unix(0, 0).UTC())
+	if err != nil {
+		return err
+	}
+
+	return withDB(cfg, func(db *sql.DB) error {
+		usages, err := usageAPI.GetLLMUsage(ctx, db, startTS, endTS, usageAPI.Scope{Team: *team, Project: *project})
+		if err != nil {
+			return err
+		}
+
+		out, err := openOutput(*output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		if *format == "json" {
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			return enc.Encode(usages)
+		}
+
+		w := csv.NewWriter(out)
+		if err := w.Write(exportHeader); err != nil {
+			return err
+		}
+
+		for _, usage := range usages {
+			record := []string{
+				utils.FormatDatetime(usage.TS),
+				usage.Provider,
+				usage.ModelName,
+				usage.KeyName,
+				usage.TeamName,
+				usage.ProjectName,
+				strconv.Itoa(usage.InputToken),
+				strconv.Itoa(usage.OutputToken),
+				strconv.Itoa(usage.TotalToken),
+				strconv.Itoa(usage.CachedInputToken),
+				strconv.Itoa(usage.CacheWriteToken),
+				strconv.Itoa(usage.ReasoningToken),
+				strconv.Itoa(usage.ImageCount),
+				strconv.FormatFloat(usage.AudioSeconds, 'f', -1, 64),
+				strconv.FormatFloat(usage.InputTokenCost, 'f', -1, 64),
+				strconv.FormatFloat(usage.OutputTokenCost, 'f', -1, 64),
+				strconv.FormatFloat(usage.ImageCost, 'f', -1, 64),
+				strconv.FormatFloat(usage.AudioCost, 'f', -1, 64),
+				strconv.FormatFloat(usage.TotalTokenCost, 'f', -1, 64),
+				usage.BillingCurrency,
+				strconv.FormatBool(usage.Cancelled),
+				strconv.FormatBool(usage.Estimated),
+			}
+			if err := w.Write(record); err != nil {
+				return err
+			}
+		}
+
+		w.Flush()
+		return w.Error()
+	})
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/spf13/viper"
+)
+
+const ENV_PREFIX = "INSPECTRO"
+
+// ServerConfig is resolved from, in order of precedence, command line flags,
+// INSPECTRO_* environment variables, an optional config file and defaults.
+type ServerConfig struct {
+	Addr              string        `mapstructure:"addr"`
+	DataDir           string        `mapstructure:"dataDir"`
+	ConfigPath        string        `mapstructure:"configPath"` // llm.yaml
+	DBDSN             string        `mapstructure:"dbDSN"`
+	DBPrimaryURL      string        `mapstructure:"dbPrimaryURL"`
+	DBAuthToken       string        `mapstructure:"dbAuthToken"`
+	DBSyncInterval    time.Duration `mapstructure:"dbSyncInterval"`
+	LogLevel          string        `mapstructure:"logLevel"`
+	ReadHeaderTimeout time.Duration `mapstructure:"readHeaderTimeout"`
+	ReadTimeout       time.Duration `mapstructure:"readTimeout"`
+	WriteTimeout      time.Duration `mapstructure:"writeTimeout"`
+	IdleTimeout       time.Duration `mapstructure:"idleTimeout"`
+	ShutdownTimeout   time.Duration `mapstructure:"shutdownTimeout"`
+	ShutdownDelay     time.Duration `mapstructure:"shutdownDelay"`
+	AdminToken        string        `mapstructure:"adminToken"`
+	SessionTTL        time.Duration `mapstructure:"sessionTTL"`
+	TracesExporter    string        `mapstructure:"tracesExporter"`
+	TracesFile        string        `mapstructure:"tracesFile"`
+	UsageBufferSize   int           `mapstructure:"usageBufferSize"`
+	UsageBatchSize    int           `mapstructure:"usageBatchSize"`
+	UsageFlushEvery   time.Duration `mapstructure:"usageFlushEvery"`
+	UsageSpoolDir     string        `mapstructure:"usageSpoolDir"`
+	UsageRetention    time.Duration `mapstructure:"usageRetention"`
+	HourlyRetention   time.Duration `mapstructure:"hourlyRetention"`
+	BackupDir         string        `mapstructure:"backupDir"`
+	BackupEvery       time.Duration `mapstructure:"backupEvery"`
+	BackupKeep        int           `mapstructure:"backupKeep"`
+}
+
+type option struct {
+	key   string // viper key, also used for the config file
+	flag  string
+	env   string
+	value any
+	usage string
+}
+
+var options = []option{
+	{"addr", "addr", "ADDR", ":7865", "address to listen on"},
+	{"dataDir", "data-dir", "DATA_DIR", "./data", "directory for the database and config"},
+	{"configPath", "config-path", "CONFIG_PATH", "", "path of llm.yaml (default <data-dir>/config/llm.yaml)"},
+	{"dbDSN", "db-dsn", "DB_DSN", "", "libsql dsn or postgres:// url (default file:<data-dir>/db/inspectro.db)"},
+	{"dbPrimaryURL", "db-primary-url", "DB_PRIMARY_URL", "", "libsql server a file: database is kept as an embedded replica of"},
+	{"dbAuthToken", "db-auth-token", "DB_AUTH_TOKEN", "", "auth token for the libsql server of --db-primary-url or a remote --db-dsn"},
+	{"dbSyncInterval", "db-sync-interval", "DB_SYNC_INTERVAL", time.Minute, "how often an embedded replica pulls changes from its primary, 0 only at start"},
+	{"logLevel", "log-level", "LOG_LEVEL", "info", "log level: debug, info, warn or error"},
+	{"readHeaderTimeout", "read-header-timeout", "READ_HEADER_TIMEOUT", 10 * time.Second, "time allowed to read request headers"},
+	{"readTimeout", "read-timeout", "READ_TIMEOUT", time.Duration(0), "time allowed to read a whole request, 0 for no limit"},
+	{"writeTimeout", "write-timeout", "WRITE_TIMEOUT", time.Duration(0), "time allowed to write a response, 0 for no limit as streams can be long"},
+	{"idleTimeout", "idle-timeout", "IDLE_TIMEOUT", 120 * time.Second, "time to keep idle connections open"},
+	{"shutdownTimeout", "shutdown-timeout", "SHUTDOWN_TIMEOUT", 30 * time.Second, "time allowed for in-flight requests and usage writes to finish on shutdown"},
+	{"shutdownDelay", "shutdown-delay", "SHUTDOWN_DELAY", time.Duration(0), "time /readyz fails on shutdown before the server stops taking requests, for load balancers to notice"},
+	{"adminToken", "admin-token", "ADMIN_TOKEN", "", "bearer token granting full access to the dashboard api"},
+	{"sessionTTL", "session-ttl", "SESSION_TTL", 7 * 24 * time.Hour, "how long a dashboard login lasts"},
+	{"tracesExporter", "traces-exporter", "TRACES_EXPORTER", "none", "where to send spans: none, otlp (see OTEL_EXPORTER_OTLP_*), stdout or file"},
+	{"tracesFile", "traces-file", "TRACES_FILE", "", "file the file traces exporter appends spans to"},
+	{"usageBufferSize", "usage-buffer-size", "USAGE_BUFFER_SIZE", 10000, "usage records to queue before requests wait on the database"},
+	{"usageBatchSize", "usage-batch-size", "USAGE_BATCH_SIZE", 100, "usage records written per insert"},
+	{"usageFlushEvery", "usage-flush-every", "USAGE_FLUSH_EVERY", time.Second, "longest time usage records are queued before being written"},
+	{"usageSpoolDir", "usage-spool-dir", "USAGE_SPOOL_DIR", "", "directory keeping usage the database refused until it is replayed (default <data-dir>/spool/usage)"},
+	{"usageRetention", "usage-retention", "USAGE_RETENTION", time.Duration(0), "how long single usage rows are kept once rolled up, 0 keeps them forever"},
+	{"hourlyRetention", "hourly-retention", "HOURLY_RETENTION", time.Duration(0), "how long hourly usage rollups are kept, 0 keeps them forever; daily rollups are always kept"},
+	{"backupDir", "backup-dir", "BACKUP_DIR", "", "directory for scheduled backups, empty disables them"},
+	{"backupEvery", "backup-every", "BACKUP_EVERY", 24 * time.Hour, "time between scheduled backups"},
+	{"backupKeep", "backup-keep", "BACKUP_KEEP", 7, "scheduled backups to keep before deleting the oldest"},
+}
+
+// Load resolves the server config from args, usually os.Args[1:], and the
+// environment. Parsing stops at the first non flag argument, the remaining
+// arguments are returned for subcommands.
+func Load(args []string) (*ServerConfig, []string, error) {
+	fs := flag.NewFlagSet("inspectro", flag.ContinueOnError)
+	configFile := fs.String("config-file", "", "optional server config file, env "+ENV_PREFIX+"_CONFIG_FILE")
+
+	v := viper.New()
+	for _, opt := range options {
+		v.SetDefault(opt.key, opt.value)
+		if err := v.BindEnv(opt.key, ENV_PREFIX+"_"+opt.env); err != nil {
+			return nil, nil, err
+		}
+
+		usage := fmt.Sprintf("%s, env %s_%s", opt.usage, ENV_PREFIX, opt.env)
+		switch value := opt.value.(type) {
+		case time.Duration:
+			fs.Duration(opt.flag, value, usage)
+		case int:
+			fs.Int(opt.flag, value, usage)
+		default:
+			fs.String(opt.flag, fmt.Sprint(value), usage)
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configFile == "" {
+		if err := v.BindEnv("configFile", ENV_PREFIX+"_CONFIG_FILE"); err != nil {
+			return nil, nil, err
+		}
+		*configFile = v.GetString("configFile")
+	}
+
+	if *configFile != "" {
+		v.SetConfigFile(*configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, nil, fmt.Errorf("error loading %s: %w", *configFile, err)
+		}
+	}
+
+	// only flags given explicitly take precedence over env and file
+	fs.Visit(func(f *flag.Flag) {
+		for _, opt := range options {
+			if opt.flag == f.Name {
+				v.Set(opt.key, f.Value.(flag.Getter).Get())
+			}
+		}
+	})
+
+	config := &ServerConfig{}
+	if err := v.Unmarshal(config); err != nil {
+		return nil, nil, fmt.Errorf("error reading server config: %w", err)
+	}
+
+	if config.ConfigPath == "" {
+		config.ConfigPath = filepath.Join(config.DataDir, "config", "llm.yaml")
+	}
+
+	if config.DBDSN == "" {
+		config.DBDSN = "file:" + filepath.Join(config.DataDir, "db", "inspectro.db")
+	}
+
+	if config.UsageSpoolDir == "" {
+		config.UsageSpoolDir = filepath.Join(config.DataDir, "spool", "usage")
+	}
+
+	if _, err := config.SlogLevel(); err != nil {
+		return nil, nil, err
+	}
+
+	return config, fs.Args(), nil
+}
+
+// Remote returns the libsql server databases are shared through.
+func (c *ServerConfig) Remote() database.Remote {
+	return database.Remote{
+		PrimaryURL:   c.DBPrimaryURL,
+		AuthToken:    c.DBAuthToken,
+		SyncInterval: c.DBSyncInterval,
+	}
+}
+
+func (c *ServerConfig) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(c.LogLevel))); err != nil {
+		return level, fmt.Errorf("invalid log level %q", c.LogLevel)
+	}
+
+	return level, nil
+}
@@ -0,0 +1,152 @@
+package currency
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/leporo/sqlf"
+)
+
+const DEFAULT_CURRENCY = "USD"
+
+// Rates holds units of each currency per one Base.
+type Rates struct {
+	Base      string
+	Reporting string
+	Rates     map[string]float64
+}
+
+type ratesFile struct {
+	Base  string             `json:"base"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+func Normalize(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return DEFAULT_CURRENCY
+	}
+
+	return code
+}
+
+// ReadRatesFile reads exchange rates from a json file shaped like
+// {"base": "USD", "rates": {"EUR": 0.92}}, or from a csv file of
+// currency,rate rows whose first row is the base currency with rate 1.
+func ReadRatesFile(path string) (string, map[string]float64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("error loading rates file %s: %w", path, err)
+	}
+
+	rates := make(map[string]float64)
+
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		records, err := csv.NewReader(strings.NewReader(string(content))).ReadAll()
+		if err != nil {
+			return "", nil, fmt.Errorf("error reading rates file %s: %w", path, err)
+		}
+
+		base := ""
+		for _, record := range records {
+			if len(record) != 2 {
+				return "", nil, fmt.Errorf("error reading rates file %s: expected currency,rate rows", path)
+			}
+
+			rate, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+			if err != nil {
+				return "", nil, fmt.Errorf("error reading rates file %s: %w", path, err)
+			}
+
+			code := Normalize(record[0])
+			if base == "" {
+				base = code
+			}
+			rates[code] = rate
+		}
+
+		return base, rates, nil
+	}
+
+	var file ratesFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return "", nil, fmt.Errorf("error reading rates file %s: %w", path, err)
+	}
+
+	for code, rate := range file.Rates {
+		rates[Normalize(code)] = rate
+	}
+
+	return Normalize(file.Base), rates, nil
+}
+
+func LoadRates(ctx context.Context, db *sql.DB) (Rates, error) {
+	rates := Rates{
+		Base:      DEFAULT_CURRENCY,
+		Reporting: DEFAULT_CURRENCY,
+		Rates:     make(map[string]float64),
+	}
+
+	query := sqlf.From("currencies as c").
+		Select("c.code").
+		Select("c.rate").
+		Select("c.is_base").
+		Select("c.is_reporting")
+
+	rows, err := db.QueryContext(ctx, query.String(), query.Args()...)
+	if err != nil {
+		return rates, fmt.Errorf("error querying currency: %v", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var code string
+		var rate float64
+		var isBase, isReporting bool
+		if err := rows.Scan(&code, &rate, &isBase, &isReporting); err != nil {
+			return rates, fmt.Errorf("error querying currency: %v", err)
+		}
+
+		if isBase {
+			rates.Base = code
+		}
+		if isReporting {
+			rates.Reporting = code
+		}
+		rates.Rates[code] = rate
+	}
+	if err := rows.Err(); err != nil {
+		return rates, fmt.Errorf("error querying currency: %v", err)
+	}
+
+	rates.Rates[rates.Base] = 1
+
+	return rates, nil
+}
+
+func (r Rates) Convert(amount float64, from string, to string) (float64, error) {
+	from, to = Normalize(from), Normalize(to)
+	if from == to || amount == 0 {
+		return amount, nil
+	}
+
+	fromRate, ok := r.Rates[from]
+	if !ok || fromRate == 0 {
+		return 0, fmt.Errorf("no exchange rate for %s", from)
+	}
+
+	toRate, ok := r.Rates[to]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for %s", to)
+	}
+
+	return amount / fromRate * toRate, nil
+}
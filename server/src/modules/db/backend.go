@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/leporo/sqlf"
+)
+
+// Backend is a database inspectro can keep its data in. Queries are shared
+// between backends and built with sqlf, a Backend covers what differs.
+type Backend interface {
+	Name() string
+	Open(dsn string) (*sql.DB, error)
+
+	// Dialect formats the placeholders of sqlf statements.
+	Dialect() *sqlf.Dialect
+
+	// DDL adapts a table or column definition written for SQLite.
+	DDL(definition string) string
+	HasColumn(ctx context.Context, conn *sql.Conn, table string, column string) (bool, error)
+
+	// Lock keeps replicas sharing the database from running what key
+	// guards at once, until Unlock on the same conn.
+	Lock(ctx context.Context, conn *sql.Conn, key int64) error
+	Unlock(ctx context.Context, conn *sql.Conn, key int64) error
+
+	// Renew extends a lock taken by Lock while its holder runs, failing
+	// with ErrLockLost once another holder took it.
+	Renew(ctx context.Context, db *sql.DB, key int64) error
+
+	// UnixTime is an expression turning a unix timestamp argument into a
+	// datetime comparable with stored ones.
+	UnixTime() string
+
+	// RowID returns the column addressing a single usage row, and its
+	// definition when the backend has no such column built in.
+	RowID() (string, string)
+
+	// SupportsBackup tells whether Backup and Restore work, backends
+	// without are left to their own tools.
+	SupportsBackup() bool
+
+	// Backup writes a consistent copy of db to path.
+	Backup(ctx context.Context, db *sql.DB, path string) error
+
+	// Restore replaces the database of dsn with the backup at path, after
+	// checking the backup is one this build can open.
+	Restore(ctx context.Context, dsn string, path string) error
+}
+
+// keys of the locks replicas take turns on
+const (
+	MIGRATION_LOCK = 7486657
+	ROLLUP_LOCK    = 7486658
+)
+
+var current Backend = libsqlBackend{}
+
+// Current returns the backend of the database opened by OpenDB.
+func Current() Backend {
+	return current
+}
+
+func backendFor(dsn string) Backend {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgresBackend{}
+	}
+
+	return libsqlBackend{}
+}
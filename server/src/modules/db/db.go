@@ -1,47 +1,80 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"os"
+	"strings"
+	"time"
 
 	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
-	_ "github.com/tursodatabase/go-libsql"
+	"github.com/leporo/sqlf"
 )
 
-const DB_DIR = "./data/db"
+// SCHEMA_VERSION is bumped whenever migrate changes the schema, so a database
+// or backup written by a newer build is not opened by an older one.
+const SCHEMA_VERSION = 8
 
-func migrate(db *sql.DB) error {
-	_, err := db.Exec(`DROP TABLE IF EXISTS llm_providers`)
-	if err != nil {
-		return fmt.Errorf("error migrating db %s: %w", DB_DIR, err)
-	}
-
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS llm_providers (
+// tables are written for SQLite, Backend.DDL adapts them to other backends
+var tables = []string{
+	`CREATE TABLE IF NOT EXISTS llm_providers (
 		name TEXT UNIQUE,
 		apiBase TEXT,
-		apiKey TEXT
-	)`)
-	if err != nil {
-		return fmt.Errorf("error migrating db %s: %w", DB_DIR, err)
-	}
-
-	_, err = db.Exec(`DROP TABLE IF EXISTS llms`)
-	if err != nil {
-		return fmt.Errorf("error migrating db %s: %w", DB_DIR, err)
-	}
-
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS llms (
+		apiKey TEXT,
+		currency TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS llms (
 		name TEXT UNIQUE,
 		provider TEXT,
 		costPerMillionInputToken FLOAT,
 		costPerMillionOutputToken FLOAT
-	)`)
-	if err != nil {
-		return fmt.Errorf("error migrating db %s: %w", DB_DIR, err)
-	}
-
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS llm_usages (
+	)`,
+	`CREATE TABLE IF NOT EXISTS llm_prices (
+		model_name TEXT,
+		validFrom DATETIME,
+		costPerMillionInputToken FLOAT,
+		costPerMillionOutputToken FLOAT,
+		cost TEXT,
+		UNIQUE (model_name, validFrom)
+	)`,
+	`CREATE TABLE IF NOT EXISTS currencies (
+		code TEXT UNIQUE,
+		rate FLOAT,
+		is_base BOOLEAN,
+		is_reporting BOOLEAN
+	)`,
+	`CREATE TABLE IF NOT EXISTS virtual_keys (
+		name TEXT UNIQUE,
+		key_hash TEXT UNIQUE,
+		key_prefix TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		revoked_at DATETIME
+	)`,
+	`CREATE TABLE IF NOT EXISTS users (
+		name TEXT UNIQUE,
+		password_hash TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS teams (
+		name TEXT UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS projects (
+		name TEXT UNIQUE
+	)`,
+	`CREATE TABLE IF NOT EXISTS project_models (
+		project_name TEXT,
+		model_name TEXT,
+		UNIQUE (project_name, model_name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT UNIQUE,
+		user_name TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME
+	)`,
+	`CREATE TABLE IF NOT EXISTS llm_usages (
 		provider TEXT,
 		model_name TEXT,
 		input_token INT,
@@ -51,34 +84,320 @@ func migrate(db *sql.DB) error {
 		output_token_cost FLOAT,
 		total_token_cost FLOAT,
 		ts DATETIME DEFAULT CURRENT_TIMESTAMP
-	)`)
+	)`,
+	// llm_usages summed per hour and per day, ts is the start of the bucket
+	`CREATE TABLE IF NOT EXISTS llm_usage_hourly (
+		ts DATETIME,
+		provider TEXT,
+		model_name TEXT,
+		currency TEXT,
+		key_name TEXT,
+		team_name TEXT,
+		project_name TEXT,
+		requests BIGINT,
+		input_token BIGINT,
+		output_token BIGINT,
+		total_token BIGINT,
+		cached_input_token BIGINT,
+		cache_write_token BIGINT,
+		reasoning_token BIGINT,
+		image_count BIGINT,
+		audio_seconds FLOAT,
+		input_token_cost FLOAT,
+		output_token_cost FLOAT,
+		image_cost FLOAT,
+		audio_cost FLOAT,
+		total_token_cost FLOAT,
+		UNIQUE (ts, provider, model_name, currency, key_name, team_name, project_name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS llm_usage_daily (
+		ts DATETIME,
+		provider TEXT,
+		model_name TEXT,
+		currency TEXT,
+		key_name TEXT,
+		team_name TEXT,
+		project_name TEXT,
+		requests BIGINT,
+		input_token BIGINT,
+		output_token BIGINT,
+		total_token BIGINT,
+		cached_input_token BIGINT,
+		cache_write_token BIGINT,
+		reasoning_token BIGINT,
+		image_count BIGINT,
+		audio_seconds FLOAT,
+		input_token_cost FLOAT,
+		output_token_cost FLOAT,
+		image_cost FLOAT,
+		audio_cost FLOAT,
+		total_token_cost FLOAT,
+		UNIQUE (ts, provider, model_name, currency, key_name, team_name, project_name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS schema_version (
+		version INT
+	)`,
+	// only read when migrating to version 4, which replaced it with the
+	// rolled column of llm_usages
+	`CREATE TABLE IF NOT EXISTS usage_rollup_state (
+		name TEXT UNIQUE,
+		last_row_id BIGINT
+	)`,
+}
+
+func addColumn(ctx context.Context, conn *sql.Conn, backend Backend, table string, column string, definition string) error {
+	exists, err := backend.HasColumn(ctx, conn, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, backend.DDL(definition)))
+	return err
+}
+
+func migrate(ctx context.Context, db *sql.DB, backend Backend, name string) error {
+	return locked(ctx, db, backend, MIGRATION_LOCK, func(ctx context.Context, conn *sql.Conn) error {
+		return migrateLocked(ctx, conn, backend, name)
+	})
+}
+
+func migrateLocked(ctx context.Context, conn *sql.Conn, backend Backend, name string) error {
+	for _, table := range tables {
+		if _, err := conn.ExecContext(ctx, backend.DDL(table)); err != nil {
+			return fmt.Errorf("error migrating db %s: %w", name, err)
+		}
+	}
+
+	version, err := SchemaVersion(ctx, conn)
 	if err != nil {
-		return fmt.Errorf("error migrating db %s: %w", DB_DIR, err)
+		return fmt.Errorf("error migrating db %s: %w", name, err)
+	}
+
+	if version > SCHEMA_VERSION {
+		return fmt.Errorf("db %s has schema version %d, newer than %d of this build", name, version, SCHEMA_VERSION)
+	}
+
+	// tables are kept across restarts, so columns added after their first
+	// release are added here for new and existing databases alike
+	columns := [][3]string{
+		{"llm_providers", "currency", "TEXT"},
+		{"llm_providers", "disableStreamUsage", "BOOLEAN DEFAULT FALSE"},
+		{"llm_prices", "cost", "TEXT"},
+		{"llm_prices", "is_base", "BOOLEAN DEFAULT FALSE"},
+		{"virtual_keys", "team_name", "TEXT"},
+		{"virtual_keys", "project_name", "TEXT"},
+		// users from before roles keep full access
+		{"users", "role", "TEXT DEFAULT 'admin'"},
+		{"users", "team_name", "TEXT"},
+		{"teams", "budget", "FLOAT"},
+		{"projects", "budget", "FLOAT"},
+		{"projects", "is_default", "BOOLEAN DEFAULT FALSE"},
+		{"llm_usages", "cost_per_million_input_token", "FLOAT"},
+		{"llm_usages", "cost_per_million_output_token", "FLOAT"},
+		{"llm_usages", "cached_input_token", "INT DEFAULT 0"},
+		{"llm_usages", "cache_write_token", "INT DEFAULT 0"},
+		{"llm_usages", "reasoning_token", "INT DEFAULT 0"},
+		{"llm_usages", "image_count", "INT DEFAULT 0"},
+		{"llm_usages", "audio_seconds", "FLOAT DEFAULT 0"},
+		{"llm_usages", "image_cost", "FLOAT DEFAULT 0"},
+		{"llm_usages", "audio_cost", "FLOAT DEFAULT 0"},
+		{"llm_usages", "price_snapshot", "TEXT"},
+		{"llm_usages", "currency", "TEXT DEFAULT 'USD'"},
+		{"llm_usages", "key_name", "TEXT"},
+		{"llm_usages", "team_name", "TEXT"},
+		{"llm_usages", "project_name", "TEXT"},
+		{"llm_usages", "cancelled", "BOOLEAN DEFAULT FALSE"},
+		{"llm_usages", "estimated", "BOOLEAN DEFAULT FALSE"},
+		{"llm_usages", "rolled", "BOOLEAN DEFAULT FALSE"},
+		{"llm_usages", "request_id", "TEXT"},
+	}
+	if column, definition := backend.RowID(); definition != "" {
+		columns = append(columns, [3]string{"llm_usages", column, definition})
+	}
+
+	for _, column := range columns {
+		if err := addColumn(ctx, conn, backend, column[0], column[1], column[2]); err != nil {
+			return fmt.Errorf("error migrating db %s: %w", name, err)
+		}
+	}
+
+	// version 4 flags rolled up rows rather than keeping the last row id
+	// rolled up, row ids are reused once retention empties the table
+	if version < 4 {
+		rowID, _ := backend.RowID()
+		query := sqlf.Update("llm_usages").
+			Set("rolled", true).
+			Where(rowID + " <= (SELECT COALESCE(MAX(last_row_id), 0) FROM usage_rollup_state)")
+		if _, err := query.Exec(ctx, conn); err != nil {
+			return fmt.Errorf("error migrating db %s: %w", name, err)
+		}
+	}
+
+	// version 5 keeps the history of base prices, the only one before it
+	// was written at the epoch
+	if version < 5 {
+		query := sqlf.Update("llm_prices").
+			Set("is_base", true).
+			Where("validFrom = ?", utils.FormatDatetime(time.Unix(0, 0)))
+		if _, err := query.Exec(ctx, conn); err != nil {
+			return fmt.Errorf("error migrating db %s: %w", name, err)
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS llm_usages_unrolled ON llm_usages (ts) WHERE rolled = FALSE`); err != nil {
+		return fmt.Errorf("error migrating db %s: %w", name, err)
+	}
+
+	if _, err := conn.ExecContext(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS llm_usages_request_id ON llm_usages (request_id)`); err != nil {
+		return fmt.Errorf("error migrating db %s: %w", name, err)
+	}
+
+	if version < SCHEMA_VERSION {
+		if _, err := conn.ExecContext(ctx, `DELETE FROM schema_version`); err != nil {
+			return fmt.Errorf("error migrating db %s: %w", name, err)
+		}
+
+		query := sqlf.InsertInto("schema_version").Set("version", SCHEMA_VERSION)
+		if _, err := query.Exec(ctx, conn); err != nil {
+			return fmt.Errorf("error migrating db %s: %w", name, err)
+		}
 	}
 
 	return nil
 }
 
-func OpenDB() (*sql.DB, error) {
-	if !utils.FolderExists(DB_DIR) {
-		err := os.Mkdir(DB_DIR, 0777)
-		if err != nil {
-			return nil, fmt.Errorf("error creating dir %s: %w", DB_DIR, err)
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// SchemaVersion returns the schema version recorded in a database, 0 for
+// databases migrated before versions were recorded.
+func SchemaVersion(ctx context.Context, q queryer) (int, error) {
+	var version int
+	if err := q.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("error reading schema version: %w", err)
+	}
+
+	return version, nil
+}
+
+var ErrLockLost = errors.New("db lock lost")
+
+// lockRenewInterval is how often a held lock is renewed, well within
+// LOCK_LEASE.
+var lockRenewInterval = LOCK_LEASE / 5
+
+// Locked runs fn on a connection of db holding the lock key of the current
+// backend, so replicas sharing the database take turns running it. The lock
+// is renewed while fn runs, once that fails the ctx of fn is cancelled and
+// Locked fails with ErrLockLost.
+func Locked(ctx context.Context, db *sql.DB, key int64, fn func(ctx context.Context, conn *sql.Conn) error) error {
+	return locked(ctx, db, current, key, fn)
+}
+
+func locked(ctx context.Context, db *sql.DB, backend Backend, key int64, fn func(ctx context.Context, conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error taking db lock: %w", err)
+	}
+	defer conn.Close()
+
+	if err := backend.Lock(ctx, conn, key); err != nil {
+		return fmt.Errorf("error taking db lock: %w", err)
+	}
+	// released even when ctx is done, or the lock outlives fn
+	defer backend.Unlock(context.WithoutCancel(ctx), conn, key)
+
+	holding, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	renewing := make(chan struct{})
+	go func() {
+		defer close(renewing)
+		renewLock(holding, db, backend, key, cancel)
+	}()
+
+	err = fn(holding, conn)
+	cancel(nil)
+	<-renewing
+
+	if cause := context.Cause(holding); errors.Is(cause, ErrLockLost) {
+		return fmt.Errorf("error holding db lock: %w", cause)
+	}
+
+	return err
+}
+
+// renewLock renews the lock key every lockRenewInterval until ctx is done.
+// A failed renewal is tried again while the lease lasts, ctx is cancelled
+// with ErrLockLost once another holder took the lock or the lease is about
+// to run out.
+func renewLock(ctx context.Context, db *sql.DB, backend Backend, key int64, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(lockRenewInterval)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := backend.Renew(ctx, db, key)
+		if errors.Is(err, ErrLockLost) {
+			cancel(err)
+			return
+		} else if err != nil && ctx.Err() == nil && time.Since(renewed) >= LOCK_LEASE-lockRenewInterval {
+			cancel(fmt.Errorf("%w: %w", ErrLockLost, err))
+			return
+		} else if err == nil {
+			renewed = time.Now()
+		}
+	}
+}
+
+// dsnName strips query parameters and user info, which may hold
+// credentials, from dsn so it can go into error messages.
+func dsnName(dsn string) string {
+	name, _, _ := strings.Cut(dsn, "?")
+	if scheme, rest, ok := strings.Cut(name, "://"); ok {
+		if _, host, ok := strings.Cut(rest, "@"); ok {
+			name = scheme + "://" + host
 		}
 	}
 
-	db, err := sql.Open("libsql", "file:"+DB_DIR+"/inspectro.db")
+	return name
+}
+
+// OpenDB opens and migrates the database of dsn, a postgres:// URL or a
+// libsql dsn, and makes its backend the current one.
+func OpenDB(dsn string) (*sql.DB, error) {
+	name := dsnName(dsn)
+	backend := backendFor(dsn)
+
+	db, err := backend.Open(dsn)
 	if err != nil {
-		return nil, fmt.Errorf("error creating db %s: %w", DB_DIR, err)
+		return nil, fmt.Errorf("error creating db %s: %w", name, err)
 	}
 
-	if err = migrate(db); err != nil {
+	current = backend
+	sqlf.SetDialect(backend.Dialect())
+
+	if err = migrate(context.Background(), db, backend, name); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
 
+// RestoreDB replaces the database of dsn with the backup at path. It must
+// not be open, OpenDB migrates the restored database afterwards.
+func RestoreDB(ctx context.Context, dsn string, path string) error {
+	return backendFor(dsn).Restore(ctx, dsn, path)
+}
+
 func CloseDB(db *sql.DB) error {
 	if closeError := db.Close(); closeError != nil {
 		fmt.Println("error closing database", closeError)
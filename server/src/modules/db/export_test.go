@@ -0,0 +1,12 @@
+package database
+
+import "time"
+
+// UseLockRenewInterval renews held locks every interval until the returned
+// func restores the default, so tests need not wait minutes.
+func UseLockRenewInterval(interval time.Duration) func() {
+	previous := lockRenewInterval
+	lockRenewInterval = interval
+
+	return func() { lockRenewInterval = previous }
+}
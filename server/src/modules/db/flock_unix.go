@@ -0,0 +1,23 @@
+//go:build unix
+
+package database
+
+import (
+	"errors"
+	"syscall"
+)
+
+// flock locks f without waiting, exclusively or shared with other processes.
+func flock(f interface{ Fd() uintptr }, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errInUse
+	}
+
+	return err
+}
@@ -0,0 +1,452 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
+	"github.com/leporo/sqlf"
+	"github.com/tursodatabase/go-libsql"
+)
+
+// libsqlBackend keeps data in a local SQLite file or a remote libsql server.
+// With a primary set by UseRemote, a local file is an embedded replica of
+// the primary, so several instances share one database while reading
+// locally.
+type libsqlBackend struct{}
+
+// Remote is a libsql server, like sqld or Turso, databases are shared
+// through.
+type Remote struct {
+	PrimaryURL   string // libsql://, https:// or http:// url, empty for none
+	AuthToken    string
+	SyncInterval time.Duration // how often a replica pulls from the primary, 0 only at start
+}
+
+var remote Remote
+
+const (
+	// LOCK_LEASE is how long a lock outlives an instance that died holding
+	// it, holders renew it while they run
+	LOCK_LEASE = 5 * time.Minute
+	LOCK_POLL  = 250 * time.Millisecond
+
+	// BUSY_TIMEOUT is how long a locking connection waits for the file
+	BUSY_TIMEOUT = 5 * time.Second
+
+	// LOCK_FILE_SUFFIX names the file next to a file: database that every
+	// process with it open holds a shared lock on
+	LOCK_FILE_SUFFIX = ".lock"
+)
+
+var errInUse = errors.New("in use by another process")
+
+var (
+	// replicas are the embedded replicas opened, synced on Lock
+	replicasMu sync.Mutex
+	replicas   []*libsql.Connector
+
+	// lockOwner tells the locks of this process from those of others
+	lockOwner = newLockOwner()
+
+	// inUse holds the lock files of the file: databases opened, until the
+	// process exits
+	inUseMu sync.Mutex
+	inUse   = make(map[string]*os.File)
+)
+
+func newLockOwner() string {
+	host, _ := os.Hostname()
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(nonce))
+}
+
+// UseRemote makes file: databases opened afterwards embedded replicas of
+// r.PrimaryURL, and gives remote databases r.AuthToken unless their dsn
+// carries one.
+func UseRemote(r Remote) {
+	remote = r
+}
+
+func (libsqlBackend) Name() string {
+	return "libsql"
+}
+
+func (libsqlBackend) Open(dsn string) (*sql.DB, error) {
+	path, local := strings.CutPrefix(dsnName(dsn), "file:")
+	if !local {
+		return sql.Open("libsql", withAuthToken(dsn, remote.AuthToken))
+	}
+
+	dir := filepath.Dir(path)
+	if !utils.FolderExists(dir) {
+		err := os.MkdirAll(dir, 0777)
+		if err != nil {
+			return nil, fmt.Errorf("error creating dir %s: %w", dir, err)
+		}
+	}
+
+	if err := markInUse(path); err != nil {
+		return nil, err
+	}
+
+	if remote.PrimaryURL == "" {
+		return sql.Open("libsql", dsn)
+	}
+
+	if remote.AuthToken == "" {
+		return nil, fmt.Errorf("an embedded replica needs an auth token, any value does for a sqld without auth")
+	}
+
+	// writes go through to the primary, reads stay on the local file
+	connector, err := libsql.NewEmbeddedReplicaConnector(path, remote.PrimaryURL,
+		libsql.WithAuthToken(remote.AuthToken),
+		libsql.WithSyncInterval(remote.SyncInterval),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error syncing replica with %s: %w", dsnName(remote.PrimaryURL), err)
+	}
+
+	replicasMu.Lock()
+	replicas = append(replicas, connector)
+	replicasMu.Unlock()
+
+	return sql.OpenDB(replicaConnector{connector}), nil
+}
+
+// markInUse takes a shared lock on the lock file of the database at path,
+// so Restore refuses to swap it while this process runs.
+func markInUse(path string) error {
+	inUseMu.Lock()
+	defer inUseMu.Unlock()
+
+	if _, ok := inUse[path]; ok {
+		return nil
+	}
+
+	lockFile, err := os.OpenFile(path+LOCK_FILE_SUFFIX, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return fmt.Errorf("error opening db %s: %w", path, err)
+	}
+
+	if err := flock(lockFile, false); err != nil {
+		lockFile.Close()
+		return fmt.Errorf("error opening db %s, a restore may be running: %w", path, err)
+	}
+	inUse[path] = lockFile
+
+	return nil
+}
+
+// replicaConnector stops syncing a replica once its database is closed.
+type replicaConnector struct {
+	*libsql.Connector
+}
+
+func (r replicaConnector) Close() error {
+	replicasMu.Lock()
+	replicas = slices.DeleteFunc(replicas, func(c *libsql.Connector) bool {
+		return c == r.Connector
+	})
+	replicasMu.Unlock()
+
+	return r.Connector.Close()
+}
+
+// withAuthToken adds authToken to a remote dsn without one.
+func withAuthToken(dsn string, authToken string) string {
+	if authToken == "" || strings.Contains(dsn, "authToken=") {
+		return dsn
+	}
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+
+	return dsn + separator + "authToken=" + url.QueryEscape(authToken)
+}
+
+func (libsqlBackend) Dialect() *sqlf.Dialect {
+	return sqlf.NoDialect
+}
+
+func (libsqlBackend) DDL(definition string) string {
+	return definition
+}
+
+func (libsqlBackend) HasColumn(ctx context.Context, conn *sql.Conn, table string, column string) (bool, error) {
+	var count int
+	row := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column)
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// Lock takes the row of key in db_locks, on the primary when the database
+// is a replica, waiting while another instance holds it. A holder that died
+// loses the row after LOCK_LEASE. Once taken, a replica syncs so what the
+// previous holder wrote is read.
+func (libsqlBackend) Lock(ctx context.Context, conn *sql.Conn, key int64) error {
+	// other connections may be writing the same file, wait for them rather
+	// than fail, remote databases have no such pragma
+	conn.ExecContext(ctx, fmt.Sprintf(`PRAGMA busy_timeout = %d`, BUSY_TIMEOUT.Milliseconds()))
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS db_locks (
+		id INTEGER PRIMARY KEY,
+		owner TEXT,
+		expires_at INTEGER
+	)`); err != nil {
+		return err
+	}
+
+	for {
+		now := time.Now()
+		result, err := conn.ExecContext(ctx, `INSERT INTO db_locks (id, owner, expires_at) VALUES (?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET owner = excluded.owner, expires_at = excluded.expires_at
+			WHERE db_locks.expires_at < ?`,
+			key, lockOwner, now.Add(LOCK_LEASE).Unix(), now.Unix(),
+		)
+		if err != nil {
+			return err
+		}
+
+		if taken, _ := result.RowsAffected(); taken > 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(LOCK_POLL):
+		}
+	}
+
+	replicasMu.Lock()
+	defer replicasMu.Unlock()
+
+	for _, replica := range replicas {
+		if _, err := replica.Sync(); err != nil {
+			return fmt.Errorf("error syncing replica: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (libsqlBackend) Unlock(ctx context.Context, conn *sql.Conn, key int64) error {
+	_, err := conn.ExecContext(ctx, `DELETE FROM db_locks WHERE id = ? AND owner = ?`, key, lockOwner)
+	return err
+}
+
+// Renew moves the lease of the row of key forward, through a connection of
+// its own as the holder may be inside a transaction.
+func (libsqlBackend) Renew(ctx context.Context, db *sql.DB, key int64) error {
+	result, err := db.ExecContext(ctx, `UPDATE db_locks SET expires_at = ? WHERE id = ? AND owner = ?`,
+		time.Now().Add(LOCK_LEASE).Unix(), key, lockOwner,
+	)
+	if err != nil {
+		return err
+	}
+
+	if renewed, _ := result.RowsAffected(); renewed == 0 {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+func (libsqlBackend) UnixTime() string {
+	return "datetime(?, 'unixepoch')"
+}
+
+func (libsqlBackend) RowID() (string, string) {
+	return "rowid", ""
+}
+
+func (libsqlBackend) SupportsBackup() bool {
+	return true
+}
+
+// Backup copies the database with VACUUM INTO, which is safe while the
+// server keeps writing to it.
+func (libsqlBackend) Backup(ctx context.Context, db *sql.DB, path string) error {
+	if _, err := db.ExecContext(ctx, `VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("error backing up db: %w", err)
+	}
+
+	return nil
+}
+
+// Restore swaps the database file of dsn for a copy of the backup at path.
+// It refuses while any process has the database open. The replaced file and
+// its write-ahead log are kept next to it with a .before-restore suffix.
+func (libsqlBackend) Restore(ctx context.Context, dsn string, path string) error {
+	target, ok := strings.CutPrefix(dsnName(dsn), "file:")
+	if !ok {
+		return fmt.Errorf("restoring is only supported for file: databases")
+	}
+
+	if remote.PrimaryURL != "" {
+		return fmt.Errorf("a replica is overwritten by its primary on sync, restore the primary instead")
+	}
+
+	if err := checkBackup(ctx, path); err != nil {
+		return err
+	}
+
+	lockFile, err := os.OpenFile(target+LOCK_FILE_SUFFIX, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return fmt.Errorf("error restoring db: %w", err)
+	}
+	defer lockFile.Close()
+
+	if err := flock(lockFile, true); err != nil {
+		return fmt.Errorf("error restoring db, stop the server first: %s is %w", target, err)
+	}
+
+	if _, err := os.Stat(target); err == nil {
+		if err := checkpoint(ctx, target); err != nil {
+			return err
+		}
+	}
+
+	staged := target + ".restoring"
+	if err := copyFile(path, staged); err != nil {
+		return fmt.Errorf("error restoring db: %w", err)
+	}
+
+	replaced := target + ".before-restore"
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		// a log left from an earlier restore would pair with the new file
+		if err := os.Remove(replaced + suffix); err != nil && !os.IsNotExist(err) {
+			os.Remove(staged)
+			return fmt.Errorf("error restoring db: %w", err)
+		}
+
+		if err := os.Rename(target+suffix, replaced+suffix); err != nil && !os.IsNotExist(err) {
+			os.Remove(staged)
+			return fmt.Errorf("error restoring db: %w", err)
+		}
+	}
+
+	if err := os.Rename(staged, target); err != nil {
+		return fmt.Errorf("error restoring db: %w", err)
+	}
+
+	return nil
+}
+
+// checkpoint moves what the write-ahead log of the database at path holds
+// into the database file.
+func checkpoint(ctx context.Context, path string) error {
+	db, err := sql.Open("libsql", "file:"+path)
+	if err != nil {
+		return fmt.Errorf("error checkpointing db %s: %w", path, err)
+	}
+	defer db.Close()
+
+	var busy, logPages, checkpointed int
+	row := db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`)
+	if err := row.Scan(&busy, &logPages, &checkpointed); err != nil {
+		return fmt.Errorf("error checkpointing db %s: %w", path, err)
+	}
+	if busy != 0 {
+		return fmt.Errorf("error checkpointing db %s: %w", path, errInUse)
+	}
+
+	return nil
+}
+
+// checkBackup makes sure path holds an intact inspectro database with a
+// schema this build can migrate.
+func checkBackup(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("error reading backup: %w", err)
+	}
+
+	backup, err := sql.Open("libsql", "file:"+path)
+	if err != nil {
+		return fmt.Errorf("error opening backup %s: %w", path, err)
+	}
+	defer backup.Close()
+
+	var integrity string
+	if err := backup.QueryRowContext(ctx, `PRAGMA integrity_check`).Scan(&integrity); err != nil {
+		return fmt.Errorf("error checking backup %s: %w", path, err)
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("backup %s is corrupt: %s", path, integrity)
+	}
+
+	var tables int
+	row := backup.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, "llm_usages")
+	if err := row.Scan(&tables); err != nil {
+		return fmt.Errorf("error checking backup %s: %w", path, err)
+	}
+	if tables == 0 {
+		return fmt.Errorf("%s is not an inspectro database", path)
+	}
+
+	row = backup.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, "schema_version")
+	if err := row.Scan(&tables); err != nil {
+		return fmt.Errorf("error checking backup %s: %w", path, err)
+	}
+	if tables == 0 {
+		return nil // written before schema versions, migrating upgrades it
+	}
+
+	version, err := SchemaVersion(ctx, backup)
+	if err != nil {
+		return err
+	}
+
+	if version > SCHEMA_VERSION {
+		return fmt.Errorf("backup %s has schema version %d, newer than %d of this build", path, version, SCHEMA_VERSION)
+	}
+
+	return nil
+}
+
+func copyFile(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(to)
+		return err
+	}
+
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(to)
+		return err
+	}
+
+	return dst.Close()
+}
@@ -0,0 +1,339 @@
+package database_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/backup"
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/rollup"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
+)
+
+// checkExclusive takes the lock from every db at once and fails when two
+// hold it together.
+func checkExclusive(t *testing.T, dbs ...*sql.DB) {
+	t.Helper()
+
+	var holders, overlaps atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		db := dbs[i%len(dbs)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := database.Locked(context.Background(), db, database.ROLLUP_LOCK, func(ctx context.Context, conn *sql.Conn) error {
+				if holders.Add(1) > 1 {
+					overlaps.Add(1)
+				}
+				time.Sleep(20 * time.Millisecond)
+				holders.Add(-1)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if overlaps.Load() > 0 {
+		t.Fatalf("lock held by %d holders at once", overlaps.Load()+1)
+	}
+}
+
+func TestLockIsExclusiveAcrossConnections(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "inspectro.db")
+
+	first, err := database.OpenDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, err := database.OpenDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	checkExclusive(t, first, second)
+}
+
+func TestLockIsTakenOverAfterLease(t *testing.T) {
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// a holder that died long ago
+	if _, err := db.Exec(`INSERT INTO db_locks (id, owner, expires_at) VALUES (?, ?, ?)`,
+		database.ROLLUP_LOCK, "gone:1:0", time.Now().Add(-time.Minute).Unix(),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := database.Locked(ctx, db, database.ROLLUP_LOCK, func(ctx context.Context, conn *sql.Conn) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockIsRenewed(t *testing.T) {
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer database.UseLockRenewInterval(20 * time.Millisecond)()
+
+	err = database.Locked(context.Background(), db, database.ROLLUP_LOCK, func(ctx context.Context, conn *sql.Conn) error {
+		// as if the holder ran past its lease
+		if _, err := db.Exec(`UPDATE db_locks SET expires_at = ? WHERE id = ?`, time.Now().Add(-time.Minute).Unix(), database.ROLLUP_LOCK); err != nil {
+			return err
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		var expiresAt int64
+		if err := db.QueryRow(`SELECT expires_at FROM db_locks WHERE id = ?`, database.ROLLUP_LOCK).Scan(&expiresAt); err != nil {
+			return err
+		}
+		if expiresAt <= time.Now().Unix() {
+			t.Errorf("lease ends %s, not renewed", time.Unix(expiresAt, 0))
+		}
+
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLostLockFailsHolder(t *testing.T) {
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer database.UseLockRenewInterval(20 * time.Millisecond)()
+
+	err = database.Locked(context.Background(), db, database.ROLLUP_LOCK, func(ctx context.Context, conn *sql.Conn) error {
+		// another instance took over a lease that ran out
+		if _, err := db.Exec(`UPDATE db_locks SET owner = ? WHERE id = ?`, "other:1:0", database.ROLLUP_LOCK); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	})
+	if !errors.Is(err, database.ErrLockLost) {
+		t.Fatalf("holding a lost lock: %v, want %v", err, database.ErrLockLost)
+	}
+
+	// the lock of the other instance is left alone
+	var owner string
+	if err := db.QueryRow(`SELECT owner FROM db_locks WHERE id = ?`, database.ROLLUP_LOCK).Scan(&owner); err != nil {
+		t.Fatal(err)
+	}
+	if owner != "other:1:0" {
+		t.Fatalf("lock owned by %s after losing it", owner)
+	}
+}
+
+// TestReplicasShareOnePrimary needs a sqld, started with e.g.
+//
+//	sqld --http-listen-addr 127.0.0.1:8080
+//	INSPECTRO_TEST_SQLD_URL=http://127.0.0.1:8080 go test ./src/modules/db/
+func TestReplicasShareOnePrimary(t *testing.T) {
+	primaryURL := os.Getenv("INSPECTRO_TEST_SQLD_URL")
+	if primaryURL == "" {
+		t.Skip("INSPECTRO_TEST_SQLD_URL is not set")
+	}
+
+	authToken := os.Getenv("INSPECTRO_TEST_SQLD_AUTH_TOKEN")
+	if authToken == "" {
+		authToken = "test" // any value does for a sqld without auth
+	}
+
+	database.UseRemote(database.Remote{PrimaryURL: primaryURL, AuthToken: authToken})
+	defer database.UseRemote(database.Remote{})
+
+	// both replicas migrate the primary at once
+	dir := t.TempDir()
+	dbs := make([]*sql.DB, 2)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range dbs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dbs[i], errs[i] = database.OpenDB("file:" + filepath.Join(dir, "replica-"+string(rune('a'+i))+".db"))
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("replica %d: %v", i, err)
+		}
+		defer dbs[i].Close()
+	}
+
+	checkExclusive(t, dbs...)
+
+	ctx := context.Background()
+	const rows = 20
+	model := "replica-test-" + time.Now().Format("150405.000000")
+	for i := 0; i < rows; i++ {
+		if _, err := dbs[i%2].ExecContext(ctx, `INSERT INTO llm_usages (provider, model_name, currency, ts) VALUES (?, ?, ?, ?)`,
+			"test", model, "USD", utils.FormatDatetime(time.Now().Add(-time.Hour)),
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// both replicas roll up at once, each row is still summed once
+	for _, db := range dbs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := rollup.Run(ctx, db); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// taking the lock syncs the replica with what the other one rolled up
+	var requests int
+	if err := database.Locked(ctx, dbs[0], database.ROLLUP_LOCK, func(ctx context.Context, conn *sql.Conn) error {
+		return conn.QueryRowContext(ctx, `SELECT COALESCE(SUM(requests), 0) FROM llm_usage_daily WHERE model_name = ?`, model).Scan(&requests)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if requests != rows {
+		t.Fatalf("rolled up %d requests, want %d", requests, rows)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := database.OpenDB("file:" + filepath.Join(dir, "open.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// backups taken back to back keep apart
+	first, err := backup.Write(ctx, db, filepath.Join(dir, "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := backup.Write(ctx, db, filepath.Join(dir, "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("both backups written to %s", first)
+	}
+
+	// an open database is not swapped underneath
+	if err := database.RestoreDB(ctx, "file:"+filepath.Join(dir, "open.db"), first); err == nil {
+		t.Fatal("restored a database in use")
+	}
+
+	// a server that died left committed rows in the write-ahead log only
+	crashed := filepath.Join(dir, "crashed.db")
+	writeUncheckpointed(t, crashed)
+
+	if err := database.RestoreDB(ctx, "file:"+crashed, first); err != nil {
+		t.Fatal(err)
+	}
+
+	replaced, err := sql.Open("libsql", "file:"+crashed+".before-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replaced.Close()
+
+	var rows int
+	if err := replaced.QueryRow(`SELECT COUNT(*) FROM kept`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Fatalf("replaced database kept %d rows, want 1", rows)
+	}
+}
+
+// writeUncheckpointed leaves at path a database with a row committed to its
+// write-ahead log alone, as a process killed while writing would.
+func writeUncheckpointed(t *testing.T, path string) {
+	t.Helper()
+
+	live := filepath.Join(t.TempDir(), "live.db")
+	db, err := sql.Open("libsql", "file:"+live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, query := range []string{
+		`PRAGMA journal_mode = WAL`,
+		`PRAGMA wal_autocheckpoint = 0`,
+		`CREATE TABLE kept (id INTEGER)`,
+		`INSERT INTO kept (id) VALUES (1)`,
+	} {
+		rows, err := conn.QueryContext(context.Background(), query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		rows.Close()
+	}
+
+	// copied while still open, the log is not folded in on close
+	for _, suffix := range []string{"", "-wal"} {
+		if err := copyFile(live+suffix, path+suffix); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func copyFile(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/leporo/sqlf"
+)
+
+// postgresBackend keeps data in PostgreSQL, for replicas sharing one
+// database.
+type postgresBackend struct{}
+
+var postgresTypes = strings.NewReplacer(
+	"DATETIME", "TIMESTAMP",
+	"FLOAT", "DOUBLE PRECISION",
+)
+
+func (postgresBackend) Name() string {
+	return "postgres"
+}
+
+// Open runs sessions in UTC, so CURRENT_TIMESTAMP matches what
+// utils.FormatDatetime writes.
+func (postgresBackend) Open(dsn string) (*sql.DB, error) {
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	config.RuntimeParams["timezone"] = "UTC"
+
+	return stdlib.OpenDB(*config), nil
+}
+
+func (postgresBackend) Dialect() *sqlf.Dialect {
+	return sqlf.PostgreSQL
+}
+
+func (postgresBackend) DDL(definition string) string {
+	return postgresTypes.Replace(definition)
+}
+
+func (postgresBackend) HasColumn(ctx context.Context, conn *sql.Conn, table string, column string) (bool, error) {
+	var count int
+	row := conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`,
+		strings.ToLower(table), strings.ToLower(column),
+	)
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (postgresBackend) Lock(ctx context.Context, conn *sql.Conn, key int64) error {
+	_, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, key)
+	return err
+}
+
+func (postgresBackend) Unlock(ctx context.Context, conn *sql.Conn, key int64) error {
+	_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, key)
+	return err
+}
+
+// Renew has nothing to do, advisory locks last as long as their session.
+func (postgresBackend) Renew(ctx context.Context, db *sql.DB, key int64) error {
+	return nil
+}
+
+func (postgresBackend) UnixTime() string {
+	return "(to_timestamp(CAST(? AS BIGINT)) AT TIME ZONE 'UTC')"
+}
+
+func (postgresBackend) RowID() (string, string) {
+	return "id", "BIGSERIAL"
+}
+
+func (postgresBackend) SupportsBackup() bool {
+	return false
+}
+
+func (postgresBackend) Backup(ctx context.Context, db *sql.DB, path string) error {
+	return fmt.Errorf("backing up postgres is left to pg_dump")
+}
+
+func (postgresBackend) Restore(ctx context.Context, dsn string, path string) error {
+	return fmt.Errorf("restoring postgres is left to pg_restore")
+}
@@ -1,13 +1,22 @@
 package entities
 
 type GenericLLMPayload struct {
-	Model string `json:"model"`
+	Model       string   `json:"model"`
+	MaxTokens   *int     `json:"max_tokens"`
+	Temperature *float64 `json:"temperature"`
+	TopP        *float64 `json:"top_p"`
 }
 
 type ProxyContext struct {
-	Provider                  string
-	APIBase                   string
-	APIKey                    string
-	CostPerMillionInputToken  float64
-	CostPerMillionOutputToken float64
+	Provider string
+	APIBase  string
+	APIKey   string
+	Currency string
+	Cost     LLMCost
+	KeyName  string // virtual key the request came with, if any
+	TeamName string // team of that virtual key
+	Project  string // project picked by the proxy path or the virtual key
+
+	DisableStreamUsage bool // the provider is not asked for stream usage
+	Cancelled          bool // the client went away before the response ended
 }
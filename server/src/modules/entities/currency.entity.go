@@ -0,0 +1,11 @@
+package entities
+
+// CurrencyConfig sets the currency usage is reported in. Rates are units of
+// each currency per one BaseCurrency, RatesFile is read on every sync and
+// takes precedence over Rates.
+type CurrencyConfig struct {
+	ReportingCurrency string             `mapstructure:"reportingCurrency" yaml:"reportingCurrency,omitempty" json:"reportingCurrency"`
+	BaseCurrency      string             `mapstructure:"baseCurrency" yaml:"baseCurrency,omitempty" json:"baseCurrency"`
+	Rates             map[string]float64 `mapstructure:"rates" yaml:"rates,omitempty" json:"rates"`
+	RatesFile         string             `mapstructure:"ratesFile" yaml:"ratesFile,omitempty" json:"ratesFile,omitempty"`
+}
@@ -3,16 +3,70 @@ package entities
 import "time"
 
 type LLMProvider struct {
-	Name    string `yaml:"name" json:"name" db:"name"`
-	APIBase string `yaml:"apiBase" json:"apiBase" db:"apiBase"`
-	APIKey  string `yaml:"apiKey" json:"apiKey" db:"apiKey"`
+	Name     string        `yaml:"name" json:"name" db:"name"`
+	APIBase  string        `yaml:"apiBase" json:"apiBase" db:"apiBase"`
+	APIKey   string        `yaml:"apiKey" json:"apiKey" db:"apiKey"`
+	Currency string        `yaml:"currency,omitempty" json:"currency,omitempty" db:"currency"` // billing currency, USD when empty
+	HTTP     *ProviderHTTP `yaml:"http,omitempty" json:"http,omitempty"`
+
+	// DisableStreamUsage keeps requests as they are for providers rejecting
+	// stream_options, their streams are billed from estimated usage instead
+	DisableStreamUsage bool `yaml:"disableStreamUsage,omitempty" json:"disableStreamUsage,omitempty" db:"disableStreamUsage"`
+}
+
+// ProviderHTTP tunes the client requests to a provider go through, zero
+// values keep the defaults.
+type ProviderHTTP struct {
+	DialTimeout           time.Duration `yaml:"dialTimeout,omitempty" json:"dialTimeout,omitempty"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tlsHandshakeTimeout,omitempty" json:"tlsHandshakeTimeout,omitempty"`
+	ResponseHeaderTimeout time.Duration `yaml:"responseHeaderTimeout,omitempty" json:"responseHeaderTimeout,omitempty"` // time to the first byte, generous as models think before answering
+	ReadIdleTimeout       time.Duration `yaml:"readIdleTimeout,omitempty" json:"readIdleTimeout,omitempty"`             // longest wait for the next chunk of a response body
+	IdleConnTimeout       time.Duration `yaml:"idleConnTimeout,omitempty" json:"idleConnTimeout,omitempty"`
+	MaxIdleConns          int           `yaml:"maxIdleConns,omitempty" json:"maxIdleConns,omitempty"`
+	DisableHTTP2          bool          `yaml:"disableHTTP2,omitempty" json:"disableHTTP2,omitempty"`
+	CABundle              string        `yaml:"caBundle,omitempty" json:"caBundle,omitempty"` // PEM file trusted on top of the system roots, relative to llm.yaml
+	Proxy                 string        `yaml:"proxy,omitempty" json:"proxy,omitempty"`       // outbound proxy url, HTTP(S)_PROXY from the environment when empty
 }
 
 type LLM struct {
-	Name                       string  `mapstructure:"name" json:"name" db:"name"`
-	Provider                   string  `mapstructure:"provider" json:"provider,omitempty" db:"provider"`
-	CostPerMillionInputTokens  float64 `mapstructure:"costPerMillionInputToken" json:"costPerMillionInputToken" db:"costPerMillionInputToken"`
-	CostPerMillionOutputTokens float64 `mapstructure:"costPerMillionOutputToken" json:"costPerMillionOutputToken" db:"costPerMillionOutputToken"`
+	Name     string `mapstructure:"name" yaml:"name" json:"name" db:"name"`
+	Provider string `mapstructure:"provider" yaml:"provider" json:"provider,omitempty" db:"provider"`
+	LLMCost  `mapstructure:",squash" yaml:",inline"`
+	Prices   []LLMPrice `mapstructure:"prices" yaml:"prices,omitempty" json:"prices,omitempty"`
+}
+
+// LLMPrice is a price that applies to requests made from ValidFrom onwards,
+// until the next price of the same model takes over. Costs set directly on
+// LLM apply before the earliest LLMPrice, a change to them applies from when
+// it is synced.
+type LLMPrice struct {
+	ValidFrom time.Time `mapstructure:"validFrom" yaml:"validFrom" json:"validFrom" db:"validFrom"`
+	LLMCost   `mapstructure:",squash" yaml:",inline"`
+}
+
+// LLMTokenCost prices tokens per million. Cached input, cache write and
+// reasoning tokens are billed at input or output price when their own price
+// is not set.
+type LLMTokenCost struct {
+	CostPerMillionInputTokens       float64  `mapstructure:"costPerMillionInputToken" yaml:"costPerMillionInputToken" json:"costPerMillionInputToken" db:"costPerMillionInputToken"`
+	CostPerMillionOutputTokens      float64  `mapstructure:"costPerMillionOutputToken" yaml:"costPerMillionOutputToken" json:"costPerMillionOutputToken" db:"costPerMillionOutputToken"`
+	CostPerMillionCachedInputTokens *float64 `mapstructure:"costPerMillionCachedInputToken" yaml:"costPerMillionCachedInputToken,omitempty" json:"costPerMillionCachedInputToken,omitempty"`
+	CostPerMillionCacheWriteTokens  *float64 `mapstructure:"costPerMillionCacheWriteToken" yaml:"costPerMillionCacheWriteToken,omitempty" json:"costPerMillionCacheWriteToken,omitempty"`
+	CostPerMillionReasoningTokens   *float64 `mapstructure:"costPerMillionReasoningToken" yaml:"costPerMillionReasoningToken,omitempty" json:"costPerMillionReasoningToken,omitempty"`
+}
+
+type LLMCost struct {
+	LLMTokenCost       `mapstructure:",squash" yaml:",inline"`
+	CostPerImage       float64       `mapstructure:"costPerImage" yaml:"costPerImage,omitempty" json:"costPerImage,omitempty"`
+	CostPerAudioSecond float64       `mapstructure:"costPerAudioSecond" yaml:"costPerAudioSecond,omitempty" json:"costPerAudioSecond,omitempty"`
+	Tiers              []LLMCostTier `mapstructure:"tiers" yaml:"tiers,omitempty" json:"tiers,omitempty"`
+}
+
+// LLMCostTier replaces the token prices of a request whose input is larger
+// than AboveInputTokens, for models that charge more for long contexts.
+type LLMCostTier struct {
+	AboveInputTokens int `mapstructure:"aboveInputToken" yaml:"aboveInputToken" json:"aboveInputToken"`
+	LLMTokenCost     `mapstructure:",squash" yaml:",inline"`
 }
 
 type LLMUsage struct {
@@ -25,4 +79,22 @@ type LLMUsage struct {
 	OutputTokenCost float64   `json:"output_token_cost"`
 	TotalTokenCost  float64   `json:"total_token_cost"`
 	TS              time.Time `json:"ts"`
+	Requests        int       `json:"requests"` // more than 1 when read from a rollup
+
+	CachedInputToken int     `json:"cached_input_token"`
+	CacheWriteToken  int     `json:"cache_write_token"`
+	ReasoningToken   int     `json:"reasoning_token"`
+	ImageCount       int     `json:"image_count"`
+	AudioSeconds     float64 `json:"audio_seconds"`
+	ImageCost        float64 `json:"image_cost"`
+	AudioCost        float64 `json:"audio_cost"`
+
+	CostPerMillionInputToken  float64 `json:"cost_per_million_input_token"`
+	CostPerMillionOutputToken float64 `json:"cost_per_million_output_token"`
+	BillingCurrency           string  `json:"billing_currency"`
+	KeyName                   string  `json:"key_name,omitempty"`
+	TeamName                  string  `json:"team_name,omitempty"`
+	ProjectName               string  `json:"project_name,omitempty"`
+	Cancelled                 bool    `json:"cancelled,omitempty"` // usage partly estimated, the client went away
+	Estimated                 bool    `json:"estimated,omitempty"` // tokens counted locally, the provider reported none
 }
@@ -0,0 +1,12 @@
+package entities
+
+// Project keeps the keys and usage of one deployment, like staging or
+// production, apart from the others. Requests name it through a virtual key
+// bound to it or a /proxy/p/<name>/ path, requests naming none go to the
+// default project. An empty Models allows every model. Budget caps what it
+// spends per month in the reporting currency, 0 leaves it uncapped.
+type Project struct {
+	Name   string   `mapstructure:"name" yaml:"name" json:"name"`
+	Models []string `mapstructure:"models" yaml:"models,omitempty" json:"models"`
+	Budget float64  `mapstructure:"budget" yaml:"budget,omitempty" json:"budget"`
+}
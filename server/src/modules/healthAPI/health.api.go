@@ -0,0 +1,79 @@
+package healthAPI
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
+)
+
+type ReadyResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// DoHealthz only tells the process is serving.
+func DoHealthz() func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// shuttingDown fails readiness once the server starts shutting down, so load
+// balancers stop sending it requests while it drains.
+var shuttingDown atomic.Bool
+
+// StartShutdown makes DoReadyz report the server unavailable from now on.
+func StartShutdown() {
+	shuttingDown.Store(true)
+}
+
+// DoReadyz checks the db is reachable, the last sync of llm.yaml succeeded
+// and the server is not shutting down.
+func DoReadyz(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := ReadyResponse{Status: "ok", Checks: map[string]string{"db": "ok", "config": "ok", "server": "ok"}}
+		statusCode := http.StatusOK
+
+		var one int
+		if err := db.QueryRowContext(r.Context(), `SELECT 1`).Scan(&one); err != nil {
+			response.Checks["db"] = err.Error()
+			response.Status = "unavailable"
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		if err := watcher.SyncError(); err != nil {
+			response.Checks["config"] = err.Error()
+			response.Status = "unavailable"
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		if shuttingDown.Load() {
+			response.Checks["server"] = "shutting down"
+			response.Status = "unavailable"
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func DoGetProviderStatus(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := probeProviders(r.Context(), db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(statuses)
+	}
+}
@@ -0,0 +1,76 @@
+package healthAPI_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/healthAPI"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
+)
+
+func checkReady(t *testing.T, handler http.HandlerFunc, status int, check string) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != status {
+		t.Fatalf("status %d, want %d: %s", rec.Code, status, rec.Body.String())
+	}
+
+	var response healthAPI.ReadyResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if check != "" && response.Checks[check] == "ok" {
+		t.Fatalf("check %s passed: %s", check, rec.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer watcher.Wait()
+	defer cancel()
+
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	configPath := filepath.Join(t.TempDir(), "llm.yaml")
+	if err := os.WriteFile(configPath, []byte("providers:\n  - name: ollama\n    apiBase: http://127.0.0.1:11434\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := watcher.SyncLLM(ctx, db, configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	readyz := healthAPI.DoReadyz(db)
+	checkReady(t, readyz, http.StatusOK, "")
+
+	// a config the db refuses leaves the instance serving an older one
+	if err := watcher.UpdateLLM(ctx, db, func(llms *watcher.LLMModels) error {
+		llms.Providers[0].Currency = "EUR"
+		return nil
+	}); err == nil {
+		t.Fatal("synced a provider currency without a rate")
+	}
+	checkReady(t, readyz, http.StatusServiceUnavailable, "config")
+
+	if err := watcher.UpdateLLM(ctx, db, func(llms *watcher.LLMModels) error {
+		llms.Providers[0].Currency = ""
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkReady(t, readyz, http.StatusOK, "")
+
+	healthAPI.StartShutdown()
+	checkReady(t, readyz, http.StatusServiceUnavailable, "server")
+}
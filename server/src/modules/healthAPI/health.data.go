@@ -0,0 +1,124 @@
+package healthAPI
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/upstream"
+	"github.com/leporo/sqlf"
+)
+
+const (
+	PROBE_TIMEOUT      = 5 * time.Second
+	DEFAULT_PROBE_PATH = "/v1/models"
+)
+
+// probePaths lists a cheap endpoint per provider, the rest are expected to
+// speak the OpenAI API.
+var probePaths = map[string]string{
+	"ollama": "/api/tags",
+}
+
+type ProviderStatus struct {
+	Name       string `json:"name"`
+	APIBase    string `json:"apiBase"`
+	Reachable  bool   `json:"reachable"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	LatencyMS  int64  `json:"latencyMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+func getProviders(ctx context.Context, db *sql.DB) ([]entities.LLMProvider, error) {
+	query := sqlf.From("llm_providers").
+		OrderBy("name ASC").
+		Select("name").
+		Select("apiBase").
+		Select("apiKey")
+
+	providers := make([]entities.LLMProvider, 0)
+
+	rows, err := db.QueryContext(ctx, query.String(), query.Args()...)
+	if err != nil {
+		return providers, fmt.Errorf("error querying llm provider: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var provider entities.LLMProvider
+		if err := rows.Scan(&provider.Name, &provider.APIBase, &provider.APIKey); err != nil {
+			return providers, fmt.Errorf("error querying llm provider: %w", err)
+		}
+		providers = append(providers, provider)
+	}
+	if err := rows.Err(); err != nil {
+		return providers, fmt.Errorf("error querying llm provider: %w", err)
+	}
+
+	return providers, nil
+}
+
+// probeProvider calls the probe endpoint of provider. Any response counts as
+// reachable, a 401 still shows the provider is up.
+func probeProvider(ctx context.Context, client *http.Client, provider entities.LLMProvider) ProviderStatus {
+	status := ProviderStatus{Name: provider.Name, APIBase: provider.APIBase}
+
+	path, ok := probePaths[provider.Name]
+	if !ok {
+		path = DEFAULT_PROBE_PATH
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(provider.APIBase, "/")+path, nil)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	if provider.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+provider.APIKey)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	status.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	resp.Body.Close()
+
+	status.Reachable = true
+	status.StatusCode = resp.StatusCode
+
+	return status
+}
+
+func probeProviders(ctx context.Context, db *sql.DB) ([]ProviderStatus, error) {
+	providers, err := getProviders(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, PROBE_TIMEOUT)
+	defer cancel()
+
+	statuses := make([]ProviderStatus, len(providers))
+	var wg sync.WaitGroup
+	for i, provider := range providers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// probes go the way proxied requests do, through the provider's client
+			statuses[i] = probeProvider(ctx, upstream.For(provider.Name), provider)
+		}()
+	}
+	wg.Wait()
+
+	return statuses, nil
+}
@@ -0,0 +1,216 @@
+package keys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/projects"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/teams"
+	"github.com/leporo/sqlf"
+)
+
+// KEY_PREFIX marks virtual keys, bearer tokens without it are passed to the
+// provider untouched.
+const KEY_PREFIX = "sk-inspectro-"
+
+var (
+	ErrKeyNotFound = errors.New("virtual key not found")
+	ErrKeyRevoked  = errors.New("virtual key revoked")
+	ErrKeyExists   = errors.New("virtual key already exists")
+)
+
+type VirtualKey struct {
+	Name      string     `json:"name"`
+	Team      string     `json:"team,omitempty"`
+	Project   string     `json:"project,omitempty"`
+	Prefix    string     `json:"prefix"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// BearerToken returns the token of an "Authorization: Bearer" header.
+func BearerToken(req *http.Request) (string, bool) {
+	return strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
+// Create stores a new virtual key called name for team and project, both may
+// be empty, and returns it. Only its hash is kept, so the key can't be shown
+// again.
+func Create(ctx context.Context, db *sql.DB, name string, team string, project string) (string, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", fmt.Errorf("virtual key name is required")
+	}
+
+	if team != "" {
+		exists, err := teams.Exists(ctx, db, team)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", fmt.Errorf("%w: %s", teams.ErrTeamNotFound, team)
+		}
+	}
+
+	if project != "" {
+		exists, err := projects.Exists(ctx, db, project)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", fmt.Errorf("%w: %s", projects.ErrProjectNotFound, project)
+		}
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("error generating virtual key: %w", err)
+	}
+	key := KEY_PREFIX + hex.EncodeToString(secret)
+
+	var count int
+	countQuery := sqlf.From("virtual_keys").Select("COUNT(*)").To(&count).Where("name = ?", name)
+	if err := countQuery.QueryRowAndClose(ctx, db); err != nil {
+		return "", fmt.Errorf("error creating virtual key: %w", err)
+	}
+	if count > 0 {
+		return "", fmt.Errorf("%w: %s", ErrKeyExists, name)
+	}
+
+	query := sqlf.InsertInto("virtual_keys").
+		NewRow().
+		Set("name", name).
+		Set("key_hash", hashKey(key)).
+		Set("key_prefix", key[:len(KEY_PREFIX)+6]).
+		Set("team_name", team).
+		Set("project_name", project)
+
+	if _, err := query.Exec(ctx, db); err != nil {
+		return "", fmt.Errorf("error creating virtual key: %w", err)
+	}
+
+	return key, nil
+}
+
+// Revoke revokes the key called name. A non empty team limits it to keys of
+// that team.
+func Revoke(ctx context.Context, db *sql.DB, name string, team string) error {
+	query := sqlf.Update("virtual_keys").
+		SetExpr("revoked_at", "CURRENT_TIMESTAMP").
+		Where("name = ?", name).
+		Where("revoked_at IS NULL")
+	if team != "" {
+		query.Where("team_name = ?", team)
+	}
+
+	result, err := query.Exec(ctx, db)
+	if err != nil {
+		return fmt.Errorf("error revoking virtual key: %w", err)
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, name)
+	}
+
+	return nil
+}
+
+// List returns the keys of team, or all keys when team is empty.
+func List(ctx context.Context, db *sql.DB, team string) ([]VirtualKey, error) {
+	query := sqlf.From("virtual_keys as vk").
+		OrderBy("vk.name ASC").
+		Select("vk.name").
+		Select("COALESCE(vk.team_name, '')").
+		Select("COALESCE(vk.project_name, '')").
+		Select("vk.key_prefix").
+		Select("vk.created_at").
+		Select("vk.revoked_at")
+	if team != "" {
+		query.Where("vk.team_name = ?", team)
+	}
+
+	virtualKeys := make([]VirtualKey, 0)
+
+	rows, err := db.QueryContext(ctx, query.String(), query.Args()...)
+	if err != nil {
+		return virtualKeys, fmt.Errorf("error querying virtual key: %v", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var virtualKey VirtualKey
+		var revokedAt sql.NullTime
+		if err := rows.Scan(
+			&virtualKey.Name,
+			&virtualKey.Team,
+			&virtualKey.Project,
+			&virtualKey.Prefix,
+			&virtualKey.CreatedAt,
+			&revokedAt,
+		); err != nil {
+			return virtualKeys, fmt.Errorf("error querying virtual key: %v", err)
+		}
+
+		if revokedAt.Valid {
+			virtualKey.RevokedAt = &revokedAt.Time
+		}
+		virtualKeys = append(virtualKeys, virtualKey)
+	}
+	if err := rows.Err(); err != nil {
+		return virtualKeys, fmt.Errorf("error querying virtual key: %v", err)
+	}
+
+	return virtualKeys, nil
+}
+
+// Lookup finds the virtual key matching key, failing with ErrKeyNotFound or
+// ErrKeyRevoked when it can't be used.
+func Lookup(ctx context.Context, db *sql.DB, key string) (VirtualKey, error) {
+	var virtualKey VirtualKey
+	var revokedAt sql.NullTime
+
+	query := sqlf.From("virtual_keys as vk").
+		Where("vk.key_hash = ?", hashKey(key)).
+		Select("vk.name").
+		Select("COALESCE(vk.team_name, '')").
+		Select("COALESCE(vk.project_name, '')").
+		Select("vk.key_prefix").
+		Select("vk.created_at").
+		Select("vk.revoked_at").
+		Limit(1)
+
+	row := db.QueryRowContext(ctx, query.String(), query.Args()...)
+	err := row.Scan(
+		&virtualKey.Name,
+		&virtualKey.Team,
+		&virtualKey.Project,
+		&virtualKey.Prefix,
+		&virtualKey.CreatedAt,
+		&revokedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return virtualKey, ErrKeyNotFound
+	} else if err != nil {
+		return virtualKey, fmt.Errorf("error querying virtual key: %w", err)
+	}
+
+	if revokedAt.Valid {
+		virtualKey.RevokedAt = &revokedAt.Time
+		return virtualKey, ErrKeyRevoked
+	}
+
+	return virtualKey, nil
+}
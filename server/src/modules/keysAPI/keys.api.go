@@ -0,0 +1,113 @@
+package keysAPI
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/auth"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/keys"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/projects"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/teams"
+)
+
+type CreateKeyRequest struct {
+	Name    string `json:"name"`
+	Team    string `json:"team"`
+	Project string `json:"project"`
+}
+
+type CreateKeyResponse struct {
+	Name    string `json:"name"`
+	Team    string `json:"team,omitempty"`
+	Project string `json:"project,omitempty"`
+	Key     string `json:"key"`
+}
+
+func writeKeyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, keys.ErrKeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, keys.ErrKeyExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, teams.ErrTeamNotFound), errors.Is(err, projects.ErrProjectNotFound):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// DoListKeys lists the keys of the team of the user, admins see all keys.
+func DoListKeys(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		team, ok := auth.TeamScope(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		virtualKeys, err := keys.List(r.Context(), db, team)
+		if err != nil {
+			writeKeyError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(virtualKeys)
+	}
+}
+
+// DoCreateKey creates a key, team admins always create it for their own
+// team. The key is only part of this response.
+func DoCreateKey(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request CreateKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		team, ok := auth.TeamScope(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if team != "" {
+			request.Team = team
+		}
+
+		key, err := keys.Create(r.Context(), db, request.Name, request.Team, request.Project)
+		if err != nil {
+			writeKeyError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(CreateKeyResponse{
+			Name:    request.Name,
+			Team:    request.Team,
+			Project: request.Project,
+			Key:     key,
+		})
+	}
+}
+
+func DoRevokeKey(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		team, ok := auth.TeamScope(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		if err := keys.Revoke(r.Context(), db, r.PathValue("name"), team); err != nil {
+			writeKeyError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -3,10 +3,14 @@ package llmAPI
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 
 	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/projects"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
 )
 
 type LLMResponse struct {
@@ -28,18 +32,16 @@ func groupLLMData(data []LLMData) ([]LLMResponse, error) {
 				Models:  make([]entities.LLM, 0),
 			}
 			curr.Models = append(curr.Models, entities.LLM{
-				Name:                       item.LLMName,
-				CostPerMillionInputTokens:  item.CostPerMillionInputToken,
-				CostPerMillionOutputTokens: item.CostPerMillionOutputToken,
+				Name:    item.LLMName,
+				LLMCost: item.Cost,
 			})
 
 			groupedData[key] = &curr
 
 		} else {
 			appendedModels := append(existing.Models, entities.LLM{
-				Name:                       item.LLMName,
-				CostPerMillionInputTokens:  item.CostPerMillionInputToken,
-				CostPerMillionOutputTokens: item.CostPerMillionOutputToken,
+				Name:    item.LLMName,
+				LLMCost: item.Cost,
 			})
 
 			existing.Models = appendedModels
@@ -62,6 +64,22 @@ func DoGetLLM(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		// a project only lists the models it may use
+		if name := r.URL.Query().Get("project"); name != "" {
+			project, err := projects.Get(r.Context(), db, name)
+			if errors.Is(err, projects.ErrProjectNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			llmData = slices.DeleteFunc(llmData, func(llm LLMData) bool {
+				return !projects.Allows(project, llm.LLMName)
+			})
+		}
+
 		llmResponse, err := groupLLMData(llmData)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -73,3 +91,171 @@ func DoGetLLM(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
 		json.NewEncoder(w).Encode(llmResponse)
 	}
 }
+
+func writeLLMError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidLLM):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrLLMNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrLLMConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func providerResponse(llms *watcher.LLMModels, name string) LLMResponse {
+	response := LLMResponse{Models: make([]entities.LLM, 0)}
+
+	if idx := findProvider(llms, name); idx >= 0 {
+		response.Name = llms.Providers[idx].Name
+		response.APIBase = llms.Providers[idx].APIBase
+	}
+
+	for _, llm := range llms.Models {
+		if llm.Provider == name {
+			response.Models = append(response.Models, entities.LLM{
+				Name:    llm.Name,
+				LLMCost: llm.LLMCost,
+			})
+		}
+	}
+
+	return response
+}
+
+func DoCreateLLMProvider(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var provider entities.LLMProvider
+		if err := json.NewDecoder(r.Body).Decode(&provider); err != nil {
+			http.Error(w, fmt.Sprintf("failed parsing provider: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var response LLMResponse
+		err := watcher.UpdateLLM(r.Context(), db, func(llms *watcher.LLMModels) error {
+			if err := createProvider(provider)(llms); err != nil {
+				return err
+			}
+
+			response = providerResponse(llms, provider.Name)
+			return nil
+		})
+		if err != nil {
+			writeLLMError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, response)
+	}
+}
+
+func DoUpdateLLMProvider(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var provider entities.LLMProvider
+		if err := json.NewDecoder(r.Body).Decode(&provider); err != nil {
+			http.Error(w, fmt.Sprintf("failed parsing provider: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		name := r.PathValue("name")
+
+		var response LLMResponse
+		err := watcher.UpdateLLM(r.Context(), db, func(llms *watcher.LLMModels) error {
+			if err := updateProvider(name, provider)(llms); err != nil {
+				return err
+			}
+
+			if provider.Name != "" {
+				name = provider.Name
+			}
+			response = providerResponse(llms, name)
+			return nil
+		})
+		if err != nil {
+			writeLLMError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+func DoDeleteLLMProvider(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := watcher.UpdateLLM(r.Context(), db, deleteProvider(r.PathValue("name")))
+		if err != nil {
+			writeLLMError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func DoCreateLLMModel(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var llm entities.LLM
+		if err := json.NewDecoder(r.Body).Decode(&llm); err != nil {
+			http.Error(w, fmt.Sprintf("failed parsing model: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		err := watcher.UpdateLLM(r.Context(), db, createModel(llm))
+		if err != nil {
+			writeLLMError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, llm)
+	}
+}
+
+func DoUpdateLLMModel(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var llm entities.LLM
+		if err := json.NewDecoder(r.Body).Decode(&llm); err != nil {
+			http.Error(w, fmt.Sprintf("failed parsing model: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		name := r.PathValue("name")
+
+		err := watcher.UpdateLLM(r.Context(), db, func(llms *watcher.LLMModels) error {
+			if err := updateModel(name, llm)(llms); err != nil {
+				return err
+			}
+
+			if llm.Name != "" {
+				name = llm.Name
+			}
+			llm = llms.Models[findModel(llms, name)]
+			return nil
+		})
+		if err != nil {
+			writeLLMError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, llm)
+	}
+}
+
+func DoDeleteLLMModel(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := watcher.UpdateLLM(r.Context(), db, deleteModel(r.PathValue("name")))
+		if err != nil {
+			writeLLMError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
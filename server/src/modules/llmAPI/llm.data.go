@@ -3,20 +3,25 @@ package llmAPI
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
 
 	"github.com/leporo/sqlf"
 )
 
 type LLMData struct {
-	ProviderName              string
-	APIBase                   string
-	LLMName                   string
-	CostPerMillionInputToken  float64
-	CostPerMillionOutputToken float64
+	ProviderName string
+	APIBase      string
+	LLMName      string
+	Cost         entities.LLMCost
 }
 
 func getLLM(ctx context.Context, db *sql.DB) ([]LLMData, error) {
+	now := utils.FormatDatetime(time.Now())
 	query := sqlf.
 		From("llm_providers as lp").
 		OrderBy("lp.name ASC").
@@ -25,12 +30,14 @@ func getLLM(ctx context.Context, db *sql.DB) ([]LLMData, error) {
 		Select("lp.name as provider_name").
 		Select("lp.apiBase").
 		Select("l.name as llm_name").
-		Select("l.costPerMillionInputToken").
-		Select("l.costPerMillionOutputToken")
+		// cost currently in effect, see llm_prices
+		Select(`(SELECT p.cost FROM llm_prices as p
+			WHERE p.model_name = l.name AND p.validFrom <= ?
+			ORDER BY p.validFrom DESC LIMIT 1)`, now)
 
 	llms := make([]LLMData, 0)
 
-	rows, err := db.QueryContext(ctx, query.String())
+	rows, err := db.QueryContext(ctx, query.String(), query.Args()...)
 	if err != nil {
 		return llms, fmt.Errorf("error querying llm: %v", err)
 	}
@@ -39,15 +46,19 @@ func getLLM(ctx context.Context, db *sql.DB) ([]LLMData, error) {
 
 	for rows.Next() {
 		var llm LLMData
+		var cost string
 		if err := rows.Scan(
 			&llm.ProviderName,
 			&llm.APIBase,
 			&llm.LLMName,
-			&llm.CostPerMillionInputToken,
-			&llm.CostPerMillionOutputToken,
+			&cost,
 		); err != nil {
 			panic(err)
 		}
+
+		if err := json.Unmarshal([]byte(cost), &llm.Cost); err != nil {
+			return llms, fmt.Errorf("error decoding llm price of %s: %v", llm.LLMName, err)
+		}
 		llms = append(llms, llm)
 	}
 	if err := rows.Err(); err != nil {
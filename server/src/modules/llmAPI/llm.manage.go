@@ -0,0 +1,362 @@
+package llmAPI
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/currency"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/upstream"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
+)
+
+var (
+	ErrInvalidLLM  = errors.New("invalid llm config")
+	ErrLLMNotFound = errors.New("llm config not found")
+	ErrLLMConflict = errors.New("llm config conflict")
+)
+
+func validateProvider(llms *watcher.LLMModels, provider entities.LLMProvider) error {
+	if strings.TrimSpace(provider.Name) == "" {
+		return fmt.Errorf("%w: provider name is required", ErrInvalidLLM)
+	}
+
+	apiBase, err := url.Parse(provider.APIBase)
+	if err != nil || (apiBase.Scheme != "http" && apiBase.Scheme != "https") || apiBase.Host == "" {
+		return fmt.Errorf("%w: apiBase %q must be an absolute http(s) url", ErrInvalidLLM, provider.APIBase)
+	}
+
+	if provider.Currency != "" && len(provider.Currency) != 3 {
+		return fmt.Errorf("%w: currency %q must be a 3 letter code", ErrInvalidLLM, provider.Currency)
+	}
+
+	// an invalid currency config is reported on its own by ValidateCurrency
+	if rates, err := watcher.CurrencyRates(llms.Currency); err == nil {
+		if _, ok := rates[currency.Normalize(provider.Currency)]; !ok {
+			return fmt.Errorf("%w: no rate for currency %s, add it to currency.rates", ErrInvalidLLM, currency.Normalize(provider.Currency))
+		}
+	}
+
+	if _, err := upstream.NewClient(provider.HTTP, watcher.ConfigRoot()); err != nil {
+		return fmt.Errorf("%w: http: %v", ErrInvalidLLM, err)
+	}
+
+	return nil
+}
+
+func validateModel(llms *watcher.LLMModels, llm entities.LLM) error {
+	if strings.TrimSpace(llm.Name) == "" {
+		return fmt.Errorf("%w: model name is required", ErrInvalidLLM)
+	}
+
+	if findProvider(llms, llm.Provider) < 0 {
+		return fmt.Errorf("%w: provider %q does not exist", ErrInvalidLLM, llm.Provider)
+	}
+
+	if err := validateCost(llm.LLMCost); err != nil {
+		return err
+	}
+
+	validFroms := make(map[int64]bool)
+	for _, price := range llm.Prices {
+		if price.ValidFrom.IsZero() {
+			return fmt.Errorf("%w: price validFrom is required", ErrInvalidLLM)
+		}
+
+		if validFroms[price.ValidFrom.Unix()] {
+			return fmt.Errorf("%w: duplicate price validFrom %s", ErrInvalidLLM, price.ValidFrom)
+		}
+		validFroms[price.ValidFrom.Unix()] = true
+
+		if err := validateCost(price.LLMCost); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateTokenCost(tokenCost entities.LLMTokenCost) error {
+	prices := []float64{tokenCost.CostPerMillionInputTokens, tokenCost.CostPerMillionOutputTokens}
+	for _, price := range []*float64{
+		tokenCost.CostPerMillionCachedInputTokens,
+		tokenCost.CostPerMillionCacheWriteTokens,
+		tokenCost.CostPerMillionReasoningTokens,
+	} {
+		if price != nil {
+			prices = append(prices, *price)
+		}
+	}
+
+	for _, price := range prices {
+		if price < 0 {
+			return fmt.Errorf("%w: cost must not be negative", ErrInvalidLLM)
+		}
+	}
+
+	return nil
+}
+
+func validateCost(cost entities.LLMCost) error {
+	if err := validateTokenCost(cost.LLMTokenCost); err != nil {
+		return err
+	}
+
+	if cost.CostPerImage < 0 || cost.CostPerAudioSecond < 0 {
+		return fmt.Errorf("%w: cost must not be negative", ErrInvalidLLM)
+	}
+
+	aboves := make(map[int]bool)
+	for _, tier := range cost.Tiers {
+		if tier.AboveInputTokens <= 0 {
+			return fmt.Errorf("%w: tier aboveInputToken must be positive", ErrInvalidLLM)
+		}
+
+		if aboves[tier.AboveInputTokens] {
+			return fmt.Errorf("%w: duplicate tier aboveInputToken %d", ErrInvalidLLM, tier.AboveInputTokens)
+		}
+		aboves[tier.AboveInputTokens] = true
+
+		if err := validateTokenCost(tier.LLMTokenCost); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateLLMModels checks a whole llm.yaml the way the management endpoints
+// check single changes.
+func ValidateLLMModels(llms *watcher.LLMModels) error {
+	errs := make([]error, 0)
+
+	providers := make(map[string]bool)
+	for _, provider := range llms.Providers {
+		if providers[provider.Name] {
+			errs = append(errs, fmt.Errorf("%w: provider %q already exists", ErrLLMConflict, provider.Name))
+		}
+		providers[provider.Name] = true
+
+		if err := validateProvider(llms, provider); err != nil {
+			errs = append(errs, fmt.Errorf("provider %q: %w", provider.Name, err))
+		}
+	}
+
+	models := make(map[string]bool)
+	for _, llm := range llms.Models {
+		if models[llm.Name] {
+			errs = append(errs, fmt.Errorf("%w: model %q already exists", ErrLLMConflict, llm.Name))
+		}
+		models[llm.Name] = true
+
+		if err := validateModel(llms, llm); err != nil {
+			errs = append(errs, fmt.Errorf("model %q: %w", llm.Name, err))
+		}
+	}
+
+	projects := make(map[string]bool)
+	for _, project := range llms.Projects {
+		if projects[project.Name] {
+			errs = append(errs, fmt.Errorf("%w: project %q already exists", ErrLLMConflict, project.Name))
+		}
+		projects[project.Name] = true
+
+		if strings.TrimSpace(project.Name) == "" || strings.Contains(project.Name, "/") {
+			errs = append(errs, fmt.Errorf("%w: project name %q must be non empty and without /", ErrInvalidLLM, project.Name))
+		}
+
+		for _, model := range project.Models {
+			if !models[model] {
+				errs = append(errs, fmt.Errorf("project %q: %w: model %q", project.Name, ErrLLMNotFound, model))
+			}
+		}
+
+		if project.Budget < 0 {
+			errs = append(errs, fmt.Errorf("%w: budget of project %q must not be negative", ErrInvalidLLM, project.Name))
+		}
+	}
+
+	if err := watcher.ValidateDefaultProject(llms.Projects, llms.DefaultProject); err != nil {
+		errs = append(errs, fmt.Errorf("%w: %w", ErrInvalidLLM, err))
+	}
+
+	return errors.Join(errs...)
+}
+
+func findProvider(llms *watcher.LLMModels, name string) int {
+	for i, provider := range llms.Providers {
+		if provider.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func findModel(llms *watcher.LLMModels, name string) int {
+	for i, llm := range llms.Models {
+		if llm.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func createProvider(provider entities.LLMProvider) func(llms *watcher.LLMModels) error {
+	return func(llms *watcher.LLMModels) error {
+		if err := validateProvider(llms, provider); err != nil {
+			return err
+		}
+
+		if findProvider(llms, provider.Name) >= 0 {
+			return fmt.Errorf("%w: provider %q already exists", ErrLLMConflict, provider.Name)
+		}
+
+		provider.Currency = strings.ToUpper(provider.Currency)
+		llms.Providers = append(llms.Providers, provider)
+		return nil
+	}
+}
+
+// updateProvider replaces the provider called name. An empty name, currency
+// or http in the payload keeps the current one and an empty apiKey keeps
+// the stored key, so clients never need to read the key back.
+func updateProvider(name string, provider entities.LLMProvider) func(llms *watcher.LLMModels) error {
+	return func(llms *watcher.LLMModels) error {
+		idx := findProvider(llms, name)
+		if idx < 0 {
+			return fmt.Errorf("%w: provider %q", ErrLLMNotFound, name)
+		}
+
+		if provider.Name == "" {
+			provider.Name = name
+		}
+		if provider.APIKey == "" {
+			provider.APIKey = llms.Providers[idx].APIKey
+		}
+		if provider.Currency == "" {
+			provider.Currency = llms.Providers[idx].Currency
+		}
+		if provider.HTTP == nil {
+			provider.HTTP = llms.Providers[idx].HTTP
+		}
+
+		if err := validateProvider(llms, provider); err != nil {
+			return err
+		}
+
+		if provider.Name != name {
+			if findProvider(llms, provider.Name) >= 0 {
+				return fmt.Errorf("%w: provider %q already exists", ErrLLMConflict, provider.Name)
+			}
+
+			for i := range llms.Models {
+				if llms.Models[i].Provider == name {
+					llms.Models[i].Provider = provider.Name
+				}
+			}
+		}
+
+		provider.Currency = strings.ToUpper(provider.Currency)
+		llms.Providers[idx] = provider
+		return nil
+	}
+}
+
+func deleteProvider(name string) func(llms *watcher.LLMModels) error {
+	return func(llms *watcher.LLMModels) error {
+		idx := findProvider(llms, name)
+		if idx < 0 {
+			return fmt.Errorf("%w: provider %q", ErrLLMNotFound, name)
+		}
+
+		for _, llm := range llms.Models {
+			if llm.Provider == name {
+				return fmt.Errorf("%w: provider %q still has model %q", ErrLLMConflict, name, llm.Name)
+			}
+		}
+
+		llms.Providers = append(llms.Providers[:idx], llms.Providers[idx+1:]...)
+		return nil
+	}
+}
+
+func createModel(llm entities.LLM) func(llms *watcher.LLMModels) error {
+	return func(llms *watcher.LLMModels) error {
+		if err := validateModel(llms, llm); err != nil {
+			return err
+		}
+
+		if findModel(llms, llm.Name) >= 0 {
+			return fmt.Errorf("%w: model %q already exists", ErrLLMConflict, llm.Name)
+		}
+
+		llms.Models = append(llms.Models, llm)
+		return nil
+	}
+}
+
+// updateModel replaces the model called name. Empty name, provider and
+// prices in the payload keep the current values.
+func updateModel(name string, llm entities.LLM) func(llms *watcher.LLMModels) error {
+	return func(llms *watcher.LLMModels) error {
+		idx := findModel(llms, name)
+		if idx < 0 {
+			return fmt.Errorf("%w: model %q", ErrLLMNotFound, name)
+		}
+
+		if llm.Name == "" {
+			llm.Name = name
+		}
+		if llm.Provider == "" {
+			llm.Provider = llms.Models[idx].Provider
+		}
+		if llm.Prices == nil {
+			llm.Prices = llms.Models[idx].Prices
+		}
+
+		if err := validateModel(llms, llm); err != nil {
+			return err
+		}
+
+		if llm.Name != name && findModel(llms, llm.Name) >= 0 {
+			return fmt.Errorf("%w: model %q already exists", ErrLLMConflict, llm.Name)
+		}
+
+		llms.Models[idx] = llm
+		renameProjectModel(llms, name, llm.Name)
+		return nil
+	}
+}
+
+func deleteModel(name string) func(llms *watcher.LLMModels) error {
+	return func(llms *watcher.LLMModels) error {
+		idx := findModel(llms, name)
+		if idx < 0 {
+			return fmt.Errorf("%w: model %q", ErrLLMNotFound, name)
+		}
+
+		llms.Models = append(llms.Models[:idx], llms.Models[idx+1:]...)
+		renameProjectModel(llms, name, "")
+		return nil
+	}
+}
+
+// renameProjectModel follows a renamed model in the projects allowing it,
+// renaming it to "" removes it from them.
+func renameProjectModel(llms *watcher.LLMModels, from string, to string) {
+	for i := range llms.Projects {
+		project := &llms.Projects[i]
+		if idx := slices.Index(project.Models, from); idx >= 0 {
+			if to == "" {
+				project.Models = slices.Delete(project.Models, idx, idx+1)
+			} else {
+				project.Models[idx] = to
+			}
+		}
+	}
+}
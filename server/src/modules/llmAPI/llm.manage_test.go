@@ -0,0 +1,206 @@
+package llmAPI_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/llmAPI"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
+)
+
+const LLM_CONFIG = `# providers reachable from the office network
+providers:
+  - name: ollama
+    apiBase: http://127.0.0.1:11434
+    apiKey: secret
+    region: office # unknown to inspectro
+models:
+  - name: llama
+    provider: ollama
+    costPerMillionInputToken: 1
+    costPerMillionOutputToken: 2
+projects:
+  - name: staging
+    models: [llama]
+defaultProject: staging
+owner: platform-team
+`
+
+// startLLMAPI serves the llm endpoints over an llm.yaml holding LLM_CONFIG,
+// returning them and the path of llm.yaml.
+func startLLMAPI(t *testing.T) (http.Handler, string) {
+	t.Helper()
+
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	configPath := filepath.Join(t.TempDir(), "llm.yaml")
+	if err := os.WriteFile(configPath, []byte(LLM_CONFIG), 0666); err != nil {
+		t.Fatal(err)
+	}
+	watcher.UseConfigPath(configPath)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/llm", llmAPI.DoGetLLM(db))
+	mux.HandleFunc("POST /api/llm/providers", llmAPI.DoCreateLLMProvider(db))
+	mux.HandleFunc("PUT /api/llm/providers/{name}", llmAPI.DoUpdateLLMProvider(db))
+	mux.HandleFunc("DELETE /api/llm/providers/{name}", llmAPI.DoDeleteLLMProvider(db))
+	mux.HandleFunc("POST /api/llm/models", llmAPI.DoCreateLLMModel(db))
+	mux.HandleFunc("PUT /api/llm/models/{name...}", llmAPI.DoUpdateLLMModel(db))
+	mux.HandleFunc("DELETE /api/llm/models/{name...}", llmAPI.DoDeleteLLMModel(db))
+
+	return mux, configPath
+}
+
+func call(t *testing.T, api http.Handler, method string, path string, body string, want int) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if rec.Code != want {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, path, rec.Code, want, rec.Body.String())
+	}
+
+	return rec
+}
+
+func loadConfig(t *testing.T) *watcher.LLMModels {
+	t.Helper()
+
+	llms, err := watcher.LoadLLMConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return llms
+}
+
+func listed(t *testing.T, api http.Handler) map[string][]string {
+	t.Helper()
+
+	var providers []llmAPI.LLMResponse
+	rec := call(t, api, http.MethodGet, "/api/llm", "", http.StatusOK)
+	if err := json.NewDecoder(rec.Body).Decode(&providers); err != nil {
+		t.Fatal(err)
+	}
+
+	models := make(map[string][]string)
+	for _, provider := range providers {
+		for _, llm := range provider.Models {
+			models[provider.Name] = append(models[provider.Name], llm.Name)
+		}
+	}
+
+	return models
+}
+
+func TestProviderCRUD(t *testing.T) {
+	api, _ := startLLMAPI(t)
+
+	call(t, api, http.MethodPost, "/api/llm/providers", `{"name":"openai","apiBase":"https://api.openai.com/v1","apiKey":"sk"}`, http.StatusCreated)
+	call(t, api, http.MethodPost, "/api/llm/providers", `{"name":"openai","apiBase":"https://api.openai.com/v1"}`, http.StatusConflict)
+	call(t, api, http.MethodPost, "/api/llm/providers", `{"name":"broken","apiBase":"api.openai.com"}`, http.StatusBadRequest)
+	call(t, api, http.MethodPut, "/api/llm/providers/missing", `{"apiBase":"http://127.0.0.1"}`, http.StatusNotFound)
+
+	// renaming keeps the key left empty and moves the models along
+	call(t, api, http.MethodPut, "/api/llm/providers/ollama", `{"name":"local","apiBase":"http://127.0.0.1:11434"}`, http.StatusOK)
+
+	llms := loadConfig(t)
+	if len(llms.Providers) != 2 || llms.Providers[0].Name != "local" || llms.Providers[0].APIKey != "secret" {
+		t.Fatalf("providers after rename: %+v", llms.Providers)
+	}
+	if models := listed(t, api); !slices.Equal(models["local"], []string{"llama"}) {
+		t.Fatalf("models listed after rename: %v", models)
+	}
+
+	// a provider goes only once its models are gone
+	call(t, api, http.MethodDelete, "/api/llm/providers/local", "", http.StatusConflict)
+	call(t, api, http.MethodDelete, "/api/llm/providers/openai", "", http.StatusNoContent)
+	call(t, api, http.MethodDelete, "/api/llm/providers/openai", "", http.StatusNotFound)
+
+	if llms := loadConfig(t); len(llms.Providers) != 1 {
+		t.Fatalf("providers after delete: %+v", llms.Providers)
+	}
+}
+
+func TestModelCRUD(t *testing.T) {
+	api, _ := startLLMAPI(t)
+
+	call(t, api, http.MethodPost, "/api/llm/models", `{"name":"qwen","provider":"missing"}`, http.StatusBadRequest)
+	call(t, api, http.MethodPost, "/api/llm/models", `{"name":"qwen","provider":"ollama","costPerMillionInputToken":-1}`, http.StatusBadRequest)
+	call(t, api, http.MethodPost, "/api/llm/models", `{"name":"llama","provider":"ollama"}`, http.StatusConflict)
+	call(t, api, http.MethodPost, "/api/llm/models", `{"name":"qwen/2.5","provider":"ollama","costPerMillionInputToken":3,"costPerMillionOutputToken":4}`, http.StatusCreated)
+
+	if models := listed(t, api); !slices.Equal(models["ollama"], []string{"llama", "qwen/2.5"}) {
+		t.Fatalf("models listed after create: %v", models)
+	}
+
+	// renaming follows the model in the projects allowing it
+	rec := call(t, api, http.MethodPut, "/api/llm/models/llama", `{"name":"llama3","costPerMillionInputToken":5,"costPerMillionOutputToken":6}`, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), `"provider":"ollama"`) {
+		t.Fatalf("updated model %s, want the provider kept", rec.Body.String())
+	}
+	if llms := loadConfig(t); !slices.Equal(llms.Projects[0].Models, []string{"llama3"}) {
+		t.Fatalf("project models after rename: %v", llms.Projects[0].Models)
+	}
+	call(t, api, http.MethodPut, "/api/llm/models/llama", `{"provider":"ollama"}`, http.StatusNotFound)
+
+	call(t, api, http.MethodDelete, "/api/llm/models/qwen/2.5", "", http.StatusNoContent)
+	call(t, api, http.MethodDelete, "/api/llm/models/llama3", "", http.StatusNoContent)
+	call(t, api, http.MethodDelete, "/api/llm/models/llama3", "", http.StatusNotFound)
+
+	if llms := loadConfig(t); len(llms.Models) != 0 || len(llms.Projects[0].Models) != 0 {
+		t.Fatalf("models after delete: %+v, project models %v", llms.Models, llms.Projects[0].Models)
+	}
+	if models := listed(t, api); len(models) != 0 {
+		t.Fatalf("models listed after delete: %v", models)
+	}
+}
+
+func TestUpdateKeepsComments(t *testing.T) {
+	api, configPath := startLLMAPI(t)
+
+	call(t, api, http.MethodPut, "/api/llm/providers/ollama", `{"apiBase":"http://10.0.0.2:11434"}`, http.StatusOK)
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kept := range []string{
+		"# providers reachable from the office network",
+		"region: office # unknown to inspectro",
+		"owner: platform-team",
+		"apiBase: http://10.0.0.2:11434",
+	} {
+		if !strings.Contains(string(content), kept) {
+			t.Fatalf("llm.yaml lost %q:\n%s", kept, content)
+		}
+	}
+}
+
+func TestUpdateRemovesClearedKeys(t *testing.T) {
+	api, configPath := startLLMAPI(t)
+
+	// omitempty leaves the cleared image price out of what is written
+	call(t, api, http.MethodPut, "/api/llm/models/llama", `{"costPerMillionInputToken":1,"costPerMillionOutputToken":2,"costPerImage":0.5}`, http.StatusOK)
+	call(t, api, http.MethodPut, "/api/llm/models/llama", `{"costPerMillionInputToken":1,"costPerMillionOutputToken":2}`, http.StatusOK)
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "costPerImage") {
+		t.Fatalf("llm.yaml kept a cleared price:\n%s", content)
+	}
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/usage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const NAMESPACE = "inspectro"
+
+// UNKNOWN labels requests that failed before their model was resolved, so
+// arbitrary model names from clients never become label values.
+const UNKNOWN = "unknown"
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "proxy_requests_total",
+		Help:      "Proxied requests by provider, model and response status.",
+	}, []string{"provider", "model", "status"})
+
+	requestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "proxy_request_errors_total",
+		Help:      "Proxied requests answered with a 4xx or 5xx status.",
+	}, []string{"provider", "model", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "proxy_request_duration_seconds",
+		Help:      "Time to serve a proxied request, including the whole stream.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"provider", "model", "status"})
+
+	tokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "tokens_total",
+		Help:      "Tokens consumed by type: input, output, cached_input, cache_write or reasoning.",
+	}, []string{"provider", "model", "type"})
+
+	cost = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "cost_total",
+		Help:      "Cost of proxied requests in the billing currency of the provider.",
+	}, []string{"provider", "model", "currency"})
+
+	spooledRecords = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "usage_records_spooled_total",
+		Help:      "Usage records spooled to disk, refused by the database or left waiting on a full writer buffer.",
+	}, func() float64 { return float64(usage.SpooledRecords()) })
+
+	droppedRecords = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "usage_records_dropped_total",
+		Help:      "Usage records lost, refused by the database and the spool alike.",
+	}, func() float64 { return float64(usage.DroppedRecords()) })
+)
+
+func init() {
+	prometheus.MustRegister(requests, requestErrors, requestDuration, tokens, cost, spooledRecords, droppedRecords)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+func ObserveRequest(provider string, model string, status int, elapsed time.Duration) {
+	statusLabel := strconv.Itoa(status)
+
+	requests.WithLabelValues(provider, model, statusLabel).Inc()
+	requestDuration.WithLabelValues(provider, model, statusLabel).Observe(elapsed.Seconds())
+	if status >= 400 {
+		requestErrors.WithLabelValues(provider, model, statusLabel).Inc()
+	}
+}
+
+func ObserveUsage(provider string, model string, currency string, metric usage.UsageMetric, usageCost usage.UsageCost) {
+	tokens.WithLabelValues(provider, model, "input").Add(float64(metric.InputToken))
+	tokens.WithLabelValues(provider, model, "output").Add(float64(metric.OutputToken))
+	tokens.WithLabelValues(provider, model, "cached_input").Add(float64(metric.CachedInputToken))
+	tokens.WithLabelValues(provider, model, "cache_write").Add(float64(metric.CacheWriteToken))
+	tokens.WithLabelValues(provider, model, "reasoning").Add(float64(metric.ReasoningToken))
+
+	cost.WithLabelValues(provider, model, currency).Add(usageCost.TotalCost)
+}
@@ -0,0 +1,134 @@
+package projects
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/leporo/sqlf"
+)
+
+var (
+	ErrProjectNotFound = errors.New("project not found")
+	ErrModelNotAllowed = errors.New("model not allowed in project")
+	ErrNoProject       = errors.New("request names no project and no default project is set")
+)
+
+// List returns the projects synced from llm.yaml with their allowed models.
+func List(ctx context.Context, db *sql.DB) ([]entities.Project, error) {
+	query := sqlf.From("projects as p").
+		LeftJoin("project_models as pm", "pm.project_name = p.name").
+		OrderBy("p.name ASC").
+		OrderBy("pm.model_name ASC").
+		Select("p.name").
+		Select("COALESCE(p.budget, 0)").
+		Select("pm.model_name")
+
+	projects := make([]entities.Project, 0)
+
+	rows, err := db.QueryContext(ctx, query.String(), query.Args()...)
+	if err != nil {
+		return projects, fmt.Errorf("error querying project: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var budget float64
+		var model sql.NullString
+		if err := rows.Scan(&name, &budget, &model); err != nil {
+			return projects, fmt.Errorf("error querying project: %w", err)
+		}
+
+		if len(projects) == 0 || projects[len(projects)-1].Name != name {
+			projects = append(projects, entities.Project{Name: name, Models: make([]string, 0), Budget: budget})
+		}
+		if model.Valid {
+			project := &projects[len(projects)-1]
+			project.Models = append(project.Models, model.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return projects, fmt.Errorf("error querying project: %w", err)
+	}
+
+	return projects, nil
+}
+
+// Get returns the project called name, failing with ErrProjectNotFound.
+func Get(ctx context.Context, db *sql.DB, name string) (entities.Project, error) {
+	project := entities.Project{Name: name, Models: make([]string, 0)}
+
+	var budget sql.NullFloat64
+	query := sqlf.From("projects").Select("budget").To(&budget).Where("name = ?", name)
+	if err := query.QueryRowAndClose(ctx, db); errors.Is(err, sql.ErrNoRows) {
+		return project, fmt.Errorf("%w: %s", ErrProjectNotFound, name)
+	} else if err != nil {
+		return project, fmt.Errorf("error querying project: %w", err)
+	}
+	project.Budget = budget.Float64
+
+	query = sqlf.From("project_models").
+		Where("project_name = ?", name).
+		OrderBy("model_name ASC").
+		Select("model_name")
+
+	rows, err := db.QueryContext(ctx, query.String(), query.Args()...)
+	if err != nil {
+		return project, fmt.Errorf("error querying project: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var model string
+		if err := rows.Scan(&model); err != nil {
+			return project, fmt.Errorf("error querying project: %w", err)
+		}
+		project.Models = append(project.Models, model)
+	}
+	if err := rows.Err(); err != nil {
+		return project, fmt.Errorf("error querying project: %w", err)
+	}
+
+	return project, nil
+}
+
+func Exists(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	var count int
+	query := sqlf.From("projects").Select("COUNT(*)").To(&count).Where("name = ?", name)
+	if err := query.QueryRowAndClose(ctx, db); err != nil {
+		return false, fmt.Errorf("error querying project: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// Default returns the project of requests naming none. It fails with
+// ErrNoProject when projects are configured without a default, and returns
+// "" when there are no projects at all, leaving requests unrestricted.
+func Default(ctx context.Context, db *sql.DB) (string, error) {
+	var configured int
+	var name sql.NullString
+	query := sqlf.From("projects").
+		Select("COUNT(*)").To(&configured).
+		Select("MAX(CASE WHEN is_default THEN name END)").To(&name)
+	if err := query.QueryRowAndClose(ctx, db); err != nil {
+		return "", fmt.Errorf("error querying project: %w", err)
+	}
+
+	if configured > 0 && !name.Valid {
+		return "", ErrNoProject
+	}
+
+	return name.String, nil
+}
+
+// Allows reports whether project may use model.
+func Allows(project entities.Project, model string) bool {
+	return len(project.Models) == 0 || slices.Contains(project.Models, model)
+}
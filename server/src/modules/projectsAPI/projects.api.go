@@ -0,0 +1,44 @@
+package projectsAPI
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/budgets"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/projects"
+)
+
+// DoListProjects lists the projects of llm.yaml, they are changed there.
+func DoListProjects(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		projectList, err := projects.List(r.Context(), db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(projectList)
+	}
+}
+
+// DoGetProjectBudget answers what a project spent of its budget this month.
+func DoGetProjectBudget(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := budgets.ProjectStatus(r.Context(), db, r.PathValue("name"))
+		if errors.Is(err, projects.ErrProjectNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(status)
+	}
+}
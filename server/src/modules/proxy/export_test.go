@@ -0,0 +1,4 @@
+package proxy
+
+// DecodedBody exposes decodedBody for bodies the transport left compressed.
+var DecodedBody = decodedBody
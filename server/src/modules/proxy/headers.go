@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders apply to a single connection and are not forwarded, see
+// RFC 9110 section 7.6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders drops hop-by-hop headers from header, including those
+// listed by its Connection header.
+func removeHopHeaders(header http.Header) {
+	for _, connection := range header.Values("Connection") {
+		for _, name := range strings.Split(connection, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// requestHeaders returns the headers of req to send upstream. Lengths are
+// set again for the forwarded body, and Accept-Encoding is left to the
+// transport so responses are decompressed before usage is parsed.
+func requestHeaders(req *http.Request) http.Header {
+	header := req.Header.Clone()
+	removeHopHeaders(header)
+	header.Del("Content-Length")
+	header.Del("Accept-Encoding")
+
+	setForwardedHeaders(header, req)
+
+	return header
+}
+
+// setForwardedHeaders tells upstream who the client is, appending to the
+// X-Forwarded-For chain of proxies in front of inspectro.
+func setForwardedHeaders(header http.Header, req *http.Request) {
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		header.Set("X-Forwarded-For", clientIP)
+	}
+
+	header.Set("X-Forwarded-Host", req.Host)
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	header.Set("X-Forwarded-Proto", proto)
+}
+
+// copyResponseHeaders copies the end-to-end headers of resp to w.
+func copyResponseHeaders(w http.ResponseWriter, resp *http.Response) {
+	header := resp.Header.Clone()
+	removeHopHeaders(header)
+
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+}
+
+// decodedBody returns the body of resp as plain text. The transport only
+// decompresses what it asked for, some providers compress regardless.
+func decodedBody(resp *http.Response) (io.Reader, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp.Body, nil
+	}
+
+	reader, err := gzip.NewReader(resp.Body)
+	if err == io.EOF {
+		return resp.Body, nil // nothing to decompress
+	} else if err != nil {
+		return nil, err
+	}
+
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+
+	return reader, nil
+}
+
+// flushWriter flushes every write, so streamed events reach the client as
+// they arrive rather than when the response buffer fills.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return n, err
+}
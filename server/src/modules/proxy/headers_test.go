@@ -0,0 +1,164 @@
+package proxy_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/proxy"
+)
+
+const COMPLETION = `{"choices":[{"message":{"content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`
+
+func gzipped(t *testing.T, body string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(zw, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestGzipResponse(t *testing.T) {
+	compressed := gzipped(t, COMPLETION)
+
+	// compressed whatever the request accepts, with the compressed length
+	handler, db := startProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+		w.Write(compressed)
+	}, "", "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, completion("/proxy/v1/chat/completions", "test-model"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec.Body.String() != COMPLETION {
+		t.Fatalf("client got %q, want the decoded completion", rec.Body.String())
+	}
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "" {
+		t.Fatalf("client told the decoded body is %s", encoding)
+	}
+	if length := rec.Header().Get("Content-Length"); length != "" && length != strconv.Itoa(len(COMPLETION)) {
+		t.Fatalf("client got Content-Length %s for a %d byte body", length, len(COMPLETION))
+	}
+
+	var total int
+	if err := db.QueryRow(`SELECT total_token FROM llm_usages ORDER BY rowid DESC LIMIT 1`).Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	if total != 15 {
+		t.Fatalf("logged %d tokens, want 15", total)
+	}
+}
+
+func TestDecodedBody(t *testing.T) {
+	compressed := gzipped(t, COMPLETION)
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		length   string
+	}{
+		{"gzip", "gzip", compressed, ""},
+		{"gzip uppercase", "GZIP", compressed, ""},
+		{"plain", "", []byte(COMPLETION), strconv.Itoa(len(COMPLETION))},
+		// nothing to decompress is passed on as it is
+		{"empty gzip", "gzip", nil, "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(tt.body))}
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+			resp.Header.Set("Content-Length", strconv.Itoa(len(tt.body)))
+
+			reader, err := proxy.DecodedBody(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.body != nil && string(body) != COMPLETION {
+				t.Fatalf("decoded %q, want %q", body, COMPLETION)
+			}
+			if length := resp.Header.Get("Content-Length"); length != tt.length {
+				t.Fatalf("Content-Length %q left, want %q", length, tt.length)
+			}
+		})
+	}
+
+	resp := &http.Response{Header: http.Header{"Content-Encoding": {"gzip"}}, Body: io.NopCloser(bytes.NewReader([]byte(COMPLETION)))}
+	if _, err := proxy.DecodedBody(resp); err == nil {
+		t.Fatal("decoded a body that is not gzip")
+	}
+}
+
+func TestHopHeaders(t *testing.T) {
+	var forwarded http.Header
+	handler, _ := startProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "1")
+		w.Header().Set("X-Upstream-End", "1")
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, COMPLETION)
+	}, "", "")
+
+	req := completion("/proxy/v1/chat/completions", "test-model")
+	req.Header.Set("Connection", "keep-alive, X-Client-Hop")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("X-Client-End", "1")
+	req.Header.Set("Accept-Encoding", "br")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for _, name := range []string{"X-Client-Hop", "Keep-Alive", "Proxy-Authorization"} {
+		if value := forwarded.Get(name); value != "" {
+			t.Fatalf("forwarded hop-by-hop %s: %s", name, value)
+		}
+	}
+	if forwarded.Get("X-Client-End") != "1" {
+		t.Fatal("end-to-end X-Client-End not forwarded")
+	}
+	// the transport asks for what it can decode, not what the client can
+	if encoding := forwarded.Get("Accept-Encoding"); encoding == "br" {
+		t.Fatalf("forwarded the client Accept-Encoding %s", encoding)
+	}
+
+	if value := rec.Header().Get("X-Upstream-Hop"); value != "" {
+		t.Fatalf("returned hop-by-hop X-Upstream-Hop: %s", value)
+	}
+	if rec.Header().Get("Connection") != "" {
+		t.Fatalf("returned Connection: %s", rec.Header().Get("Connection"))
+	}
+	if rec.Header().Get("X-Upstream-End") != "1" {
+		t.Fatal("end-to-end X-Upstream-End not returned")
+	}
+}
@@ -0,0 +1,81 @@
+package proxy_test
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/metrics"
+)
+
+// scrape returns the value of every series metrics.Handler serves, keyed by
+// the series name and labels.
+func scrape(t *testing.T) map[string]float64 {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	series := make(map[string]float64)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, _ := strings.Cut(line, " ")
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("scraped %q: %v", line, err)
+		}
+		series[name] = parsed
+	}
+
+	return series
+}
+
+func TestMetricLabels(t *testing.T) {
+	paths := &upstreamPaths{}
+	handler, _ := startProxy(t, okUpstream(paths), "", "")
+
+	before := scrape(t)
+
+	for _, model := range []string{"test-model", "made-up-model"} {
+		handler.ServeHTTP(httptest.NewRecorder(), completion("/proxy/v1/chat/completions", model))
+	}
+
+	after := scrape(t)
+
+	tests := []struct {
+		series string
+		want   float64
+	}{
+		{`inspectro_proxy_requests_total{model="test-model",provider="ollama",status="200"}`, 1},
+		{`inspectro_proxy_request_duration_seconds_count{model="test-model",provider="ollama",status="200"}`, 1},
+		{`inspectro_proxy_request_errors_total{model="test-model",provider="ollama",status="200"}`, 0},
+		{`inspectro_tokens_total{model="test-model",provider="ollama",type="input"}`, 10},
+		{`inspectro_tokens_total{model="test-model",provider="ollama",type="output"}`, 5},
+		{`inspectro_tokens_total{model="test-model",provider="ollama",type="cached_input"}`, 0},
+		{`inspectro_cost_total{currency="USD",model="test-model",provider="ollama"}`, 10*1e-6 + 5*2e-6},
+		// a model nobody configured is not a label value
+		{`inspectro_proxy_requests_total{model="unknown",provider="unknown",status="404"}`, 1},
+		{`inspectro_proxy_request_errors_total{model="unknown",provider="unknown",status="404"}`, 1},
+	}
+
+	for _, tt := range tests {
+		if got := after[tt.series] - before[tt.series]; math.Abs(got-tt.want) > 1e-12 {
+			t.Fatalf("%s grew by %v, want %v", tt.series, got, tt.want)
+		}
+	}
+
+	for series := range after {
+		if strings.Contains(series, "made-up-model") {
+			t.Fatalf("client model name in %s", series)
+		}
+	}
+}
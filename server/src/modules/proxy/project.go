@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/projects"
+)
+
+var ErrProjectMismatch = errors.New("virtual key belongs to another project")
+
+// resolveProject picks the project of a request from its path, falling back
+// to the project of its virtual key and then the default project, and checks
+// that it may use model. Only without any project configured does a request
+// belong to none.
+func resolveProject(ctx context.Context, db *sql.DB, pathProject string, keyProject string, model string) (string, error) {
+	if pathProject != "" && keyProject != "" && pathProject != keyProject {
+		return "", fmt.Errorf("%w: %s", ErrProjectMismatch, keyProject)
+	}
+
+	name := pathProject
+	if name == "" {
+		name = keyProject
+	}
+	if name == "" {
+		var err error
+		if name, err = projects.Default(ctx, db); err != nil || name == "" {
+			return "", err
+		}
+	}
+
+	project, err := projects.Get(ctx, db, name)
+	if err != nil {
+		return "", err
+	}
+
+	if !projects.Allows(project, model) {
+		return "", fmt.Errorf("%w %s: %s", projects.ErrModelNotAllowed, name, model)
+	}
+
+	return name, nil
+}
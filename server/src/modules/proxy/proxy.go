@@ -5,47 +5,115 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/budgets"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/currency"
 	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/keys"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/metrics"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/projects"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/upstream"
 	"github.com/IqbalLx/inspectro-llm/server/src/modules/usage"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
 	"github.com/leporo/sqlf"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func getProxyMetadata(ctx context.Context, db *sql.DB, model string) (entities.ProxyContext, error) {
 	var proxyContext entities.ProxyContext
 	query := sqlf.From("llms as l").
 		Join("llm_providers as lp", "lp.name = l.provider").
+		Join("llm_prices as p", "p.model_name = l.name").
 		Where("l.name = ?", model).
+		Where("p.validFrom <= ?", utils.FormatDatetime(time.Now())).
+		OrderBy("p.validFrom DESC").
 		Select("lp.name").
 		Select("lp.apiBase").
 		Select("lp.apiKey").
-		Select("l.costPerMillionInputToken").
-		Select("l.costPerMillionOutputToken").
+		Select("lp.currency").
+		Select("COALESCE(lp.disableStreamUsage, FALSE)").
+		Select("p.cost").
 		Limit(1)
 
 	sql, args := query.String(), query.Args()
 
+	var cost string
 	row := db.QueryRowContext(ctx, sql, args...)
 	err := row.Scan(
 		&proxyContext.Provider,
 		&proxyContext.APIBase,
 		&proxyContext.APIKey,
-		&proxyContext.CostPerMillionInputToken,
-		&proxyContext.CostPerMillionOutputToken,
+		&proxyContext.Currency,
+		&proxyContext.DisableStreamUsage,
+		&cost,
 	)
 	if err != nil {
 		return proxyContext, err
 	}
 
+	if err := json.Unmarshal([]byte(cost), &proxyContext.Cost); err != nil {
+		return proxyContext, fmt.Errorf("error decoding llm price of %s: %w", model, err)
+	}
+
 	return proxyContext, nil
 }
 
+// doUpstream sends req on to url at the provider with body, the upstream
+// call ends with the client's request.
+func doUpstream(ctx context.Context, req *http.Request, url string, body []byte, proxyContext entities.ProxyContext) (*http.Response, error) {
+	proxyReq, err := http.NewRequestWithContext(ctx, req.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	proxyReq.Header = requestHeaders(req)
+
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(proxyReq.Header))
+
+	// virtual keys stay with inspectro, the provider gets its own key
+	if proxyContext.KeyName != "" {
+		proxyReq.Header.Del("Authorization")
+		if proxyContext.APIKey != "" {
+			proxyReq.Header.Set("Authorization", "Bearer "+proxyContext.APIKey)
+		}
+	}
+
+	return upstream.For(proxyContext.Provider).Do(proxyReq)
+}
+
 func ProxyRequest(db *sql.DB, isRoot bool, inspectroProxyEndpoint string) func(w http.ResponseWriter, req *http.Request) {
-	return func(w http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		w := newStatusRecorder(rw)
+		provider, model := metrics.UNKNOWN, metrics.UNKNOWN
+
+		ctx, span := startSpan(req)
+		defer func() {
+			metrics.ObserveRequest(provider, model, w.status, time.Since(start))
+			endSpan(span, w.status)
+		}()
+
+		// an invalid key learns nothing, not even which models exist
+		var virtualKey keys.VirtualKey
+		token, hasToken := keys.BearerToken(req)
+		if hasToken && strings.HasPrefix(token, keys.KEY_PREFIX) {
+			var err error
+			virtualKey, err = keys.Lookup(req.Context(), db, token)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
 		body := &bytes.Buffer{}
 
 		teeReqReader := io.TeeReader(req.Body, body)
@@ -67,35 +135,93 @@ func ProxyRequest(db *sql.DB, isRoot bool, inspectroProxyEndpoint string) func(w
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
+		provider, model = proxyContext.Provider, payload.Model
+		setRequestAttributes(span, req, proxyContext, payload)
+
+		proxyContext.KeyName = virtualKey.Name
+		proxyContext.TeamName = virtualKey.Team
 
 		proxyEndpoint := strings.TrimPrefix(req.RequestURI, inspectroProxyEndpoint)
+		pathProject := req.PathValue("project")
+		if pathProject != "" {
+			// routed as /proxy/p/{project}/..., the rest is the provider path
+			_, proxyEndpoint, _ = strings.Cut(proxyEndpoint, "/")
+		}
+
+		proxyContext.Project, err = resolveProject(req.Context(), db, pathProject, virtualKey.Project, payload.Model)
+		if errors.Is(err, ErrProjectMismatch) || errors.Is(err, projects.ErrProjectNotFound) ||
+			errors.Is(err, projects.ErrModelNotAllowed) || errors.Is(err, projects.ErrNoProject) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = budgets.CheckTeam(req.Context(), db, proxyContext.TeamName)
+		if err == nil {
+			err = budgets.CheckProject(req.Context(), db, proxyContext.Project)
+		}
+		if errors.Is(err, budgets.ErrBudgetExceeded) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		url := fmt.Sprintf("%s%s", proxyContext.APIBase, proxyEndpoint)
 		if !isRoot {
 			url = fmt.Sprintf("%s/%s", proxyContext.APIBase, proxyEndpoint)
 		}
 
-		proxyReq, err := http.NewRequest(req.Method, url, bytes.NewReader(body.Bytes()))
+		// exact usage comes in a chunk streams only send when asked for
+		requestBody, injectedUsage := body.Bytes(), false
+		if asksStreamUsage(req.URL.Path) && !proxyContext.DisableStreamUsage {
+			requestBody, injectedUsage = includeStreamUsage(requestBody)
+		}
+
+		resp, err := doUpstream(ctx, req, url, requestBody, proxyContext)
+		if err == nil && injectedUsage && rejectsStreamUsage(resp) {
+			// the provider may reject stream_options, the request goes once
+			// more as the client sent it
+			resp.Body.Close()
+			injectedUsage = false
+			resp, err = doUpstream(ctx, req, url, body.Bytes(), proxyContext)
+		}
 		if err != nil {
+			// the provider may have started on the prompt of a client that
+			// went away before it answered
+			if req.Context().Err() != nil {
+				proxyContext.Cancelled = true
+				logUnanswered(req, db, span, proxyContext, payload, body.Bytes())
+			}
+
 			http.Error(w, err.Error(), http.StatusBadGateway)
 			return
 		}
+		defer resp.Body.Close()
 
-		proxyReq.Header = make(http.Header)
-		for h, val := range req.Header {
-			proxyReq.Header[h] = val
-		}
-
-		httpClient := http.Client{}
-		resp, err := httpClient.Do(proxyReq)
+		respBody, err := decodedBody(resp)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadGateway)
 			return
 		}
-		defer resp.Body.Close()
+
+		copyResponseHeaders(w, resp)
+
+		var clientWriter io.Writer = flushWriter{w}
+		var usageFilter *usageChunkFilter
+		if injectedUsage {
+			// the client did not ask for the usage chunk, it never sees it
+			usageFilter = &usageChunkFilter{w: clientWriter}
+			clientWriter = usageFilter
+			w.Header().Del("Content-Length")
+		}
 
 		w.WriteHeader(resp.StatusCode)
 
-		teeRespReader := io.TeeReader(resp.Body, w)
+		teeRespReader := io.TeeReader(respBody, clientWriter)
 
 		pr, pw := io.Pipe()
 		streamReader := NewStreamReader(teeRespReader, pw)
@@ -108,6 +234,44 @@ func ProxyRequest(db *sql.DB, isRoot bool, inspectroProxyEndpoint string) func(w
 		}
 
 		usageParser.Parse()
-		usageParser.Log(req.Context(), db, proxyContext, payload)
+		if usageFilter != nil {
+			usageFilter.Flush()
+		}
+
+		// the tokens generated until the client went away are still billed
+		if req.Context().Err() != nil {
+			proxyContext.Cancelled = true
+		}
+
+		// count tokens locally when the provider did not report them, error
+		// responses generated nothing to bill
+		if proxyContext.Cancelled || resp.StatusCode < http.StatusBadRequest {
+			usageParser.Estimate(body.Bytes())
+		}
+
+		logUsage(req, db, span, usageParser, proxyContext, payload)
+	}
+}
+
+func logUsage(req *http.Request, db *sql.DB, span trace.Span, usageParser usage.UsageParser, proxyContext entities.ProxyContext, payload entities.GenericLLMPayload) {
+	usageMetric := usageParser.Get()
+	setUsageAttributes(span, usageMetric)
+	metrics.ObserveUsage(proxyContext.Provider, payload.Model, currency.Normalize(proxyContext.Currency), usageMetric, usageMetric.Cost(proxyContext.Cost))
+	usage.LogAsync(req.Context(), db, usageParser, proxyContext, payload)
+}
+
+// logUnanswered logs a request the provider sent no response to, with the
+// tokens of its prompt estimated.
+func logUnanswered(req *http.Request, db *sql.DB, span trace.Span, proxyContext entities.ProxyContext, payload entities.GenericLLMPayload, requestBody []byte) {
+	pr, pw := io.Pipe()
+	pw.Close()
+
+	usageParser, err := usage.UsageParserFactory(proxyContext.Provider, pr)
+	if err != nil {
+		slog.Error("failed logging usage", "model", payload.Model, "err", err)
+		return
 	}
+
+	usageParser.Estimate(requestBody)
+	logUsage(req, db, span, usageParser, proxyContext, payload)
 }
@@ -0,0 +1,358 @@
+package proxy_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/keys"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/proxy"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/teams"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
+)
+
+// upstreamPaths records the paths an upstream was called at.
+type upstreamPaths struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (u *upstreamPaths) add(path string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.paths = append(u.paths, path)
+}
+
+func (u *upstreamPaths) last() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.paths) == 0 {
+		return ""
+	}
+	return u.paths[len(u.paths)-1]
+}
+
+// startProxy syncs an llm.yaml with models test-model and other-model of an
+// ollama provider served by upstream, set up further by provider, plus yaml
+// appended to it, and returns the proxy routes as main.go registers them.
+func startProxy(t *testing.T, upstream http.HandlerFunc, provider string, yaml string) (http.Handler, *sql.DB) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(watcher.Wait)
+	t.Cleanup(cancel)
+
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	upstreamServer := httptest.NewServer(upstream)
+	t.Cleanup(upstreamServer.Close)
+
+	configPath := filepath.Join(t.TempDir(), "llm.yaml")
+	config := fmt.Sprintf(`providers:
+  - name: ollama
+    apiBase: %s
+%smodels:
+  - name: test-model
+    provider: ollama
+    costPerMillionInputToken: 1
+    costPerMillionOutputToken: 2
+  - name: other-model
+    provider: ollama
+    costPerMillionInputToken: 1
+    costPerMillionOutputToken: 2
+%s`, upstreamServer.URL, provider, yaml)
+	if err := os.WriteFile(configPath, []byte(config), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := watcher.SyncLLM(ctx, db, configPath); err != nil {
+		t.Fatalf("syncing llm.yaml: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy/", proxy.ProxyRequest(db, false, "/proxy/"))
+	mux.HandleFunc("/proxy/p/{project}/", proxy.ProxyRequest(db, false, "/proxy/p/"))
+	mux.HandleFunc("/proxy", proxy.ProxyRequest(db, true, "/proxy"))
+
+	return mux, db
+}
+
+func completion(path string, model string) *http.Request {
+	body := fmt.Sprintf(`{"model":%q,"messages":[{"role":"user","content":"hello"}]}`, model)
+	return httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+}
+
+func okUpstream(paths *upstreamPaths) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		paths.add(r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}
+}
+
+func TestProjectRoute(t *testing.T) {
+	paths := &upstreamPaths{}
+	handler, db := startProxy(t, okUpstream(paths), "", `projects:
+  - name: v1
+    models: [test-model]
+  - name: shared
+    models: [other-model]
+defaultProject: shared
+`)
+
+	tests := []struct {
+		name     string
+		path     string
+		model    string
+		status   int
+		upstream string
+		project  string
+	}{
+		// a project named like a path segment does not take over the path,
+		// the request goes to the default project
+		{"provider path", "/proxy/v1/chat/completions", "other-model", http.StatusOK, "/v1/chat/completions", "shared"},
+		{"default project", "/proxy/v1/chat/completions", "test-model", http.StatusForbidden, "", ""},
+		{"project path", "/proxy/p/v1/v1/chat/completions", "test-model", http.StatusOK, "/v1/chat/completions", "v1"},
+		{"model not allowed", "/proxy/p/v1/v1/chat/completions", "other-model", http.StatusForbidden, "", ""},
+		{"unknown project", "/proxy/p/v2/v1/chat/completions", "test-model", http.StatusForbidden, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := paths.last()
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, completion(tt.path, tt.model))
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+
+			if tt.status != http.StatusOK {
+				if paths.last() != before {
+					t.Fatalf("upstream called at %s", paths.last())
+				}
+				return
+			}
+
+			if paths.last() != tt.upstream {
+				t.Fatalf("upstream called at %s, want %s", paths.last(), tt.upstream)
+			}
+
+			var project sql.NullString
+			if err := db.QueryRow(`SELECT project_name FROM llm_usages ORDER BY rowid DESC LIMIT 1`).Scan(&project); err != nil {
+				t.Fatal(err)
+			}
+			if project.String != tt.project {
+				t.Fatalf("usage logged for project %q, want %q", project.String, tt.project)
+			}
+		})
+	}
+}
+
+// streamUpstream streams a completion and its usage when asked for it, and
+// refuses requests carrying stream_options with reject when it is set, like
+// some providers do. Bodies it got are sent to bodies.
+func streamUpstream(reject string, bodies chan<- string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+
+		hasOptions := strings.Contains(string(body), "stream_options")
+		if reject != "" && hasOptions {
+			http.Error(w, reject, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n")
+		if hasOptions {
+			fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":5,\"total_tokens\":15}}\n\n")
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}
+}
+
+func TestStreamUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		reject   string
+		status   int
+		bodies   []bool // whether each upstream request asked for usage
+	}{
+		{"asked for", "", "", http.StatusOK, []bool{true}},
+		{"disabled", "    disableStreamUsage: true\n", "", http.StatusOK, []bool{false}},
+		{"rejected", "", `{"error":"unknown field stream_options"}`, http.StatusOK, []bool{true, false}},
+		{"rejected include_usage", "", `{"error":"include_usage is not supported"}`, http.StatusOK, []bool{true, false}},
+		// a bad request for another reason fails the same without the option
+		{"bad request", "", `{"error":"messages must not be empty"}`, http.StatusBadRequest, []bool{true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bodies := make(chan string, 4)
+			handler, _ := startProxy(t, streamUpstream(tt.reject, bodies), tt.provider, "")
+
+			req := httptest.NewRequest(http.MethodPost, "/proxy/v1/chat/completions",
+				strings.NewReader(`{"model":"test-model","stream":true,"messages":[{"role":"user","content":"hello"}]}`))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status != http.StatusOK && !strings.Contains(rec.Body.String(), tt.reject) {
+				t.Fatalf("client got %q, want the upstream error %q", rec.Body.String(), tt.reject)
+			}
+			close(bodies)
+
+			var asked []bool
+			for body := range bodies {
+				asked = append(asked, strings.Contains(body, "stream_options"))
+			}
+			if !slices.Equal(asked, tt.bodies) {
+				t.Fatalf("upstream asked for usage %v, want %v", asked, tt.bodies)
+			}
+
+			if strings.Contains(rec.Body.String(), `"usage"`) {
+				t.Fatalf("client got the usage chunk it did not ask for: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestInvalidKeyLearnsNoModels(t *testing.T) {
+	paths := &upstreamPaths{}
+	handler, _ := startProxy(t, okUpstream(paths), "", "")
+
+	for _, model := range []string{"test-model", "missing-model"} {
+		req := completion("/proxy/v1/chat/completions", model)
+		req.Header.Set("Authorization", "Bearer "+keys.KEY_PREFIX+"invalid")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: status %d, want %d", model, rec.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestClientGoneBeforeResponse(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+	handler, db := startProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release // still thinking when the client leaves
+	}, "", "")
+	t.Cleanup(func() { close(release) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	req := completion("/proxy/v1/chat/completions", "test-model").WithContext(ctx)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var inputToken int
+	var cancelled, estimated bool
+	if err := db.QueryRow(`SELECT input_token, cancelled, estimated FROM llm_usages`).Scan(&inputToken, &cancelled, &estimated); err != nil {
+		t.Fatalf("no usage logged: %v", err)
+	}
+	if inputToken == 0 || !cancelled || !estimated {
+		t.Fatalf("logged %d input tokens, cancelled %t, estimated %t, want estimated prompt of a cancelled request", inputToken, cancelled, estimated)
+	}
+}
+
+func TestTeamBudget(t *testing.T) {
+	ctx := context.Background()
+	paths := &upstreamPaths{}
+	handler, db := startProxy(t, okUpstream(paths), "", "")
+
+	// a request costs 10 input tokens at 1 and 5 output tokens at 2 per
+	// million, more than the whole budget
+	if err := teams.Create(ctx, db, "red"); err != nil {
+		t.Fatal(err)
+	}
+	if err := teams.SetBudget(ctx, db, "red", 0.00001); err != nil {
+		t.Fatal(err)
+	}
+	if err := teams.Create(ctx, db, "blue"); err != nil {
+		t.Fatal(err)
+	}
+
+	redKey, err := keys.Create(ctx, db, "red-key", "red", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blueKey, err := keys.Create(ctx, db, "blue-key", "blue", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(key string) int {
+		req := completion("/proxy/v1/chat/completions", "test-model")
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if status := send(redKey); status != http.StatusOK {
+		t.Fatalf("first request of red: status %d, want %d", status, http.StatusOK)
+	}
+	if status := send(redKey); status != http.StatusTooManyRequests {
+		t.Fatalf("red over budget: status %d, want %d", status, http.StatusTooManyRequests)
+	}
+
+	// without a budget blue is not capped
+	for i := 0; i < 2; i++ {
+		if status := send(blueKey); status != http.StatusOK {
+			t.Fatalf("blue: status %d, want %d", status, http.StatusOK)
+		}
+	}
+}
+
+func TestProjectBudget(t *testing.T) {
+	paths := &upstreamPaths{}
+
+	// a request costs 10 input tokens at 1 and 5 output tokens at 2 per
+	// million, more than the whole budget of staging
+	handler, _ := startProxy(t, okUpstream(paths), "", `projects:
+  - name: staging
+    budget: 0.00001
+  - name: production
+defaultProject: production
+`)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"within budget", "/proxy/p/staging/v1/chat/completions", http.StatusOK},
+		{"over budget", "/proxy/p/staging/v1/chat/completions", http.StatusTooManyRequests},
+		{"other project", "/proxy/p/production/v1/chat/completions", http.StatusOK},
+		{"default project", "/proxy/v1/chat/completions", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, completion(tt.path, "test-model"))
+		if rec.Code != tt.status {
+			t.Fatalf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body.String())
+		}
+	}
+}
@@ -19,12 +19,10 @@ func (s *streamReader) Process() {
 	for {
 		rawLine, err := s.reader.ReadBytes('\n')
 		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				// ignore error, as this processor task is consume any response from proxied request
-				continue
-			}
+			// non streaming responses usually end without a newline, and a
+			// stream cut short, e.g. on shutdown, keeps what was read so far
+			s.pipeWriter.Write(bytes.TrimPrefix(bytes.TrimSpace(rawLine), dataHeader))
+			break
 		}
 
 		noSpaceLine := bytes.TrimSpace(rawLine)
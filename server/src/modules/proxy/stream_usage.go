@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// REJECTION_PEEK_SIZE is how much of a 400 response is searched for a
+// complaint about stream_options.
+const REJECTION_PEEK_SIZE = 64 << 10
+
+// asksStreamUsage tells whether a request to path can carry stream_options,
+// only chat and legacy completions accept it.
+func asksStreamUsage(path string) bool {
+	return strings.HasSuffix(path, "/completions")
+}
+
+// includeStreamUsage rewrites a streaming request body to ask for the usage
+// chunk, reporting whether it did. Bodies that ask already, do not stream or
+// are not JSON objects are returned as is.
+func includeStreamUsage(body []byte) ([]byte, bool) {
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(body, &request); err != nil {
+		return body, false
+	}
+
+	var stream bool
+	if err := json.Unmarshal(request["stream"], &stream); err != nil || !stream {
+		return body, false
+	}
+
+	var options map[string]json.RawMessage
+	if raw, ok := request["stream_options"]; ok {
+		if err := json.Unmarshal(raw, &options); err != nil {
+			return body, false
+		}
+	}
+
+	var includeUsage bool
+	if raw, ok := options["include_usage"]; ok {
+		if err := json.Unmarshal(raw, &includeUsage); err != nil || includeUsage {
+			return body, false
+		}
+	}
+
+	if options == nil {
+		options = make(map[string]json.RawMessage)
+	}
+	options["include_usage"] = json.RawMessage("true")
+
+	rawOptions, err := json.Marshal(options)
+	if err != nil {
+		return body, false
+	}
+	request["stream_options"] = rawOptions
+
+	rewritten, err := json.Marshal(request)
+	if err != nil {
+		return body, false
+	}
+
+	return rewritten, true
+}
+
+// rejectsStreamUsage tells whether resp refuses the stream_options added to
+// the request rather than something the client sent, only those are worth
+// sending again without. What is read of the body is put back for the
+// client.
+func rejectsStreamUsage(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	reader, err := decodedBody(resp)
+	if err != nil {
+		return false
+	}
+
+	peeked, _ := io.ReadAll(io.LimitReader(reader, REJECTION_PEEK_SIZE))
+	resp.Body = peekedBody{Reader: io.MultiReader(bytes.NewReader(peeked), reader), Closer: resp.Body}
+
+	return bytes.Contains(peeked, []byte("stream_options")) || bytes.Contains(peeked, []byte("include_usage"))
+}
+
+// peekedBody is a response body partly read already.
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// usageChunkFilter drops the usage chunk from a stream on its way to a
+// client that never asked for it. Events are written a line at a time, so
+// Flush must be called once the stream ends.
+type usageChunkFilter struct {
+	w         io.Writer
+	line      []byte
+	dropBlank bool // the blank line ending a dropped event
+}
+
+func (f *usageChunkFilter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, '\n')
+		if end < 0 {
+			f.line = append(f.line, p...)
+			break
+		}
+
+		f.line = append(f.line, p[:end+1]...)
+		p = p[end+1:]
+
+		if err := f.writeLine(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Flush writes what is left of a stream not ending with a newline.
+func (f *usageChunkFilter) Flush() error {
+	if len(f.line) == 0 {
+		return nil
+	}
+
+	return f.writeLine()
+}
+
+func (f *usageChunkFilter) writeLine() error {
+	line := f.line
+	f.line = f.line[:0]
+
+	trimmed := bytes.TrimSpace(line)
+	if f.dropBlank {
+		f.dropBlank = false
+		if len(trimmed) == 0 {
+			return nil
+		}
+	}
+
+	if isUsageChunk(trimmed) {
+		f.dropBlank = true
+		return nil
+	}
+
+	_, err := f.w.Write(line)
+	return err
+}
+
+// isUsageChunk tells whether line is the event carrying usage alone, the
+// last one of a stream asked to include usage.
+func isUsageChunk(line []byte) bool {
+	data, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok || !bytes.Contains(data, []byte(`"usage"`)) {
+		return false
+	}
+
+	var chunk struct {
+		Choices []json.RawMessage `json:"choices"`
+		Usage   json.RawMessage   `json:"usage"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(data), &chunk); err != nil {
+		return false
+	}
+
+	return len(chunk.Choices) == 0 && len(chunk.Usage) > 0 && string(chunk.Usage) != "null"
+}
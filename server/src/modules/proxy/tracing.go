@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/tracing"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/usage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.27.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// operationName maps the proxied path to gen_ai.operation.name.
+func operationName(path string) string {
+	switch {
+	case strings.HasSuffix(path, "chat/completions"), strings.HasSuffix(path, "api/chat"):
+		return "chat"
+	case strings.HasSuffix(path, "embeddings"), strings.HasSuffix(path, "api/embed"):
+		return "embeddings"
+	case strings.HasSuffix(path, "completions"), strings.HasSuffix(path, "api/generate"):
+		return "text_completion"
+	default:
+		return path[strings.LastIndex(path, "/")+1:]
+	}
+}
+
+// startSpan starts the client span of a proxied call as a child of the
+// traceparent sent by the client, if any.
+func startSpan(req *http.Request) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	operation := operationName(req.URL.Path)
+	return tracing.Tracer().Start(ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.GenAIOperationNameKey.String(operation)),
+	)
+}
+
+func setRequestAttributes(span trace.Span, req *http.Request, proxyContext entities.ProxyContext, payload entities.GenericLLMPayload) {
+	span.SetName(operationName(req.URL.Path) + " " + payload.Model)
+	span.SetAttributes(
+		semconv.GenAISystemKey.String(proxyContext.Provider),
+		semconv.GenAIRequestModel(payload.Model),
+	)
+
+	if payload.MaxTokens != nil {
+		span.SetAttributes(semconv.GenAIRequestMaxTokens(*payload.MaxTokens))
+	}
+	if payload.Temperature != nil {
+		span.SetAttributes(semconv.GenAIRequestTemperature(*payload.Temperature))
+	}
+	if payload.TopP != nil {
+		span.SetAttributes(semconv.GenAIRequestTopP(*payload.TopP))
+	}
+
+	if apiBase, err := url.Parse(proxyContext.APIBase); err == nil {
+		host, port, err := net.SplitHostPort(apiBase.Host)
+		if err != nil {
+			host = apiBase.Host
+			port = map[string]string{"http": "80", "https": "443"}[apiBase.Scheme]
+		}
+
+		span.SetAttributes(semconv.ServerAddress(host))
+		if port, err := strconv.Atoi(port); err == nil {
+			span.SetAttributes(semconv.ServerPort(port))
+		}
+	}
+}
+
+func setUsageAttributes(span trace.Span, metric usage.UsageMetric) {
+	span.SetAttributes(
+		semconv.GenAIUsageInputTokens(metric.InputToken),
+		semconv.GenAIUsageOutputTokens(metric.OutputToken),
+	)
+}
+
+func endSpan(span trace.Span, status int) {
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= 400 {
+		span.SetAttributes(semconv.ErrorTypeKey.String(strconv.Itoa(status)))
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+
+	span.End()
+}
@@ -0,0 +1,94 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	CLIENT_TRACE_ID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	CLIENT_SPAN_ID  = "00f067aa0ba902b7"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	tracerProvider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetTextMapPropagator(propagator)
+	})
+
+	traceparents := make(chan string, 1)
+	handler, _ := startProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`)
+	}, "", "")
+
+	req := httptest.NewRequest(http.MethodPost, "/proxy/v1/chat/completions",
+		strings.NewReader(`{"model":"test-model","max_tokens":64,"messages":[{"role":"user","content":"hello"}]}`))
+	req.Header.Set("traceparent", "00-"+CLIENT_TRACE_ID+"-"+CLIENT_SPAN_ID+"-01")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+
+	if span.Name != "chat test-model" || span.SpanKind != trace.SpanKindClient {
+		t.Fatalf("span %q of kind %s, want client span chat test-model", span.Name, span.SpanKind)
+	}
+
+	// the span continues the client's trace
+	if span.SpanContext.TraceID().String() != CLIENT_TRACE_ID || span.Parent.SpanID().String() != CLIENT_SPAN_ID {
+		t.Fatalf("span in trace %s under %s, want trace %s under %s",
+			span.SpanContext.TraceID(), span.Parent.SpanID(), CLIENT_TRACE_ID, CLIENT_SPAN_ID)
+	}
+
+	// and the upstream call continues the span
+	want := "00-" + CLIENT_TRACE_ID + "-" + span.SpanContext.SpanID().String() + "-01"
+	if traceparent := <-traceparents; traceparent != want {
+		t.Fatalf("upstream got traceparent %q, want %q", traceparent, want)
+	}
+
+	attributes := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+
+	for key, value := range map[attribute.Key]attribute.Value{
+		"gen_ai.operation.name":      attribute.StringValue("chat"),
+		"gen_ai.system":              attribute.StringValue("ollama"),
+		"gen_ai.request.model":       attribute.StringValue("test-model"),
+		"gen_ai.request.max_tokens":  attribute.IntValue(64),
+		"gen_ai.usage.input_tokens":  attribute.IntValue(10),
+		"gen_ai.usage.output_tokens": attribute.IntValue(5),
+		"server.address":             attribute.StringValue("127.0.0.1"),
+		"http.response.status_code":  attribute.IntValue(http.StatusOK),
+	} {
+		if got, ok := attributes[key]; !ok || got != value {
+			t.Errorf("attribute %s = %s, want %s", key, got.Emit(), value.Emit())
+		}
+	}
+}
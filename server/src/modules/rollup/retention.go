@@ -0,0 +1,139 @@
+package rollup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
+	"github.com/leporo/sqlf"
+)
+
+const (
+	ROLLUP_INTERVAL = time.Minute
+
+	// ranges up to RAW_RANGE are read from llm_usages, up to HOURLY_RANGE
+	// from the hourly rollup and longer ones from the daily rollup
+	RAW_RANGE    = 2 * 24 * time.Hour
+	HOURLY_RANGE = 60 * 24 * time.Hour
+)
+
+// Retention is how long usage is kept at each granularity, 0 keeps it
+// forever. Daily rollups are always kept. The proxy stores no request or
+// response payloads, so usage is all there is to retain.
+type Retention struct {
+	Raw    time.Duration
+	Hourly time.Duration
+}
+
+var (
+	retention Retention
+	running   sync.WaitGroup
+)
+
+// cutoff returns the oldest time still kept for keep.
+func cutoff(keep time.Duration) time.Time {
+	if keep <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(-keep)
+}
+
+// Table returns where usage between start and end is read from, llm_usages
+// or one of the rollups. Rollups are picked for long ranges and for ranges
+// reaching past the retention of finer ones.
+//
+// Rollup rows are matched by the start of their bucket, so a range read from
+// a rollup counts its edge buckets whole: usage early in the bucket holding
+// start is left out, usage late in the bucket holding end is counted in full.
+func Table(start time.Time, end time.Time) string {
+	length := end.Sub(start)
+
+	if length <= RAW_RANGE && !start.Before(cutoff(retention.Raw)) {
+		return "llm_usages"
+	}
+
+	if length <= HOURLY_RANGE && !start.Before(cutoff(retention.Hourly)) {
+		return HOURLY_TABLE
+	}
+
+	return DAILY_TABLE
+}
+
+// Prune deletes usage older than the retention of its table. Raw rows are
+// only deleted once they are rolled up.
+func Prune(ctx context.Context, db *sql.DB, keep Retention) (int64, error) {
+	var deleted int64
+
+	if keep.Raw > 0 {
+		query := sqlf.DeleteFrom("llm_usages").
+			Where("ts < ?", utils.FormatDatetime(cutoff(keep.Raw))).
+			Where("rolled = TRUE")
+
+		result, err := query.Exec(ctx, db)
+		if err != nil {
+			return deleted, fmt.Errorf("error pruning llm usage: %w", err)
+		}
+
+		affected, _ := result.RowsAffected()
+		deleted += affected
+	}
+
+	if keep.Hourly > 0 {
+		query := sqlf.DeleteFrom(HOURLY_TABLE).
+			Where("ts < ?", utils.FormatDatetime(hourOf(cutoff(keep.Hourly))))
+
+		result, err := query.Exec(ctx, db)
+		if err != nil {
+			return deleted, fmt.Errorf("error pruning hourly llm usage: %w", err)
+		}
+
+		affected, _ := result.RowsAffected()
+		deleted += affected
+	}
+
+	return deleted, nil
+}
+
+// Start keeps the rollups up to date and prunes usage past keep every
+// ROLLUP_INTERVAL until ctx is done.
+func Start(ctx context.Context, db *sql.DB, keep Retention) {
+	retention = keep
+
+	running.Add(1)
+	go func() {
+		defer running.Done()
+
+		ticker := time.NewTicker(ROLLUP_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			if rolled, err := Run(ctx, db); err != nil {
+				slog.Warn("failed rolling up llm usage", "err", err)
+			} else if rolled > 0 {
+				slog.Debug("rolled up llm usage", "rows", rolled)
+			}
+
+			if deleted, err := Prune(ctx, db, keep); err != nil {
+				slog.Warn("failed pruning llm usage", "err", err)
+			} else if deleted > 0 {
+				slog.Info("pruned llm usage past retention", "rows", deleted)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Wait blocks until the loop started by Start has stopped.
+func Wait() {
+	running.Wait()
+}
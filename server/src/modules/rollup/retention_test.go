@@ -0,0 +1,100 @@
+package rollup_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/rollup"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
+	"github.com/leporo/sqlf"
+)
+
+func insertUsage(t *testing.T, db *sql.DB, model string, ts time.Time) {
+	t.Helper()
+
+	query := sqlf.InsertInto("llm_usages").
+		Set("provider", "ollama").
+		Set("model_name", model).
+		Set("input_token", 10).
+		Set("output_token", 5).
+		Set("total_token", 15).
+		Set("ts", utils.FormatDatetime(ts))
+	if _, err := query.Exec(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func models(t *testing.T, db *sql.DB, table string) map[string]bool {
+	t.Helper()
+
+	rows, err := db.Query(`SELECT model_name FROM ` + table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	models := make(map[string]bool)
+	for rows.Next() {
+		var model string
+		if err := rows.Scan(&model); err != nil {
+			t.Fatal(err)
+		}
+		models[model] = true
+	}
+
+	return models
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	insertUsage(t, db, "old", now.Add(-72*time.Hour))
+	insertUsage(t, db, "recent", now.Add(-2*time.Hour))
+
+	if _, err := rollup.Run(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// old but not rolled up yet, pruning it would lose it from the rollups
+	insertUsage(t, db, "unrolled", now.Add(-72*time.Hour))
+
+	keep := rollup.Retention{Raw: 24 * time.Hour, Hourly: 48 * time.Hour}
+	if _, err := rollup.Prune(ctx, db, keep); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, check := range []struct {
+		table string
+		want  []string
+	}{
+		{"llm_usages", []string{"recent", "unrolled"}},
+		{rollup.HOURLY_TABLE, []string{"recent"}},
+		{rollup.DAILY_TABLE, []string{"old", "recent"}},
+	} {
+		got := models(t, db, check.table)
+		if len(got) != len(check.want) {
+			t.Fatalf("%s keeps %v, want %v", check.table, got, check.want)
+		}
+		for _, model := range check.want {
+			if !got[model] {
+				t.Fatalf("%s keeps %v, want %v", check.table, got, check.want)
+			}
+		}
+	}
+
+	// 0 keeps usage forever
+	if deleted, err := rollup.Prune(ctx, db, rollup.Retention{}); err != nil || deleted != 0 {
+		t.Fatalf("pruning without retention deleted %d rows: %v", deleted, err)
+	}
+}
@@ -0,0 +1,317 @@
+package rollup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/currency"
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
+	"github.com/leporo/sqlf"
+)
+
+const (
+	HOURLY_TABLE = "llm_usage_hourly"
+	DAILY_TABLE  = "llm_usage_daily"
+
+	// ROLLUP_BATCH is the most llm_usages rows rolled up per transaction.
+	ROLLUP_BATCH = 5000
+
+	// rows younger than ROLLUP_LAG wait for a later run, replicas may still
+	// be committing rows around them
+	ROLLUP_LAG = time.Minute
+)
+
+// Key is what usage is summed by within a bucket.
+type Key struct {
+	Provider    string
+	ModelName   string
+	Currency    string
+	KeyName     string
+	TeamName    string
+	ProjectName string
+}
+
+// Totals is usage summed over a bucket.
+type Totals struct {
+	Requests         int
+	InputToken       int
+	OutputToken      int
+	TotalToken       int
+	CachedInputToken int
+	CacheWriteToken  int
+	ReasoningToken   int
+	ImageCount       int
+	AudioSeconds     float64
+	InputTokenCost   float64
+	OutputTokenCost  float64
+	ImageCost        float64
+	AudioCost        float64
+	TotalTokenCost   float64
+}
+
+func (t *Totals) add(other Totals) {
+	t.Requests += other.Requests
+	t.InputToken += other.InputToken
+	t.OutputToken += other.OutputToken
+	t.TotalToken += other.TotalToken
+	t.CachedInputToken += other.CachedInputToken
+	t.CacheWriteToken += other.CacheWriteToken
+	t.ReasoningToken += other.ReasoningToken
+	t.ImageCount += other.ImageCount
+	t.AudioSeconds += other.AudioSeconds
+	t.InputTokenCost += other.InputTokenCost
+	t.OutputTokenCost += other.OutputTokenCost
+	t.ImageCost += other.ImageCost
+	t.AudioCost += other.AudioCost
+	t.TotalTokenCost += other.TotalTokenCost
+}
+
+// Negate returns totals that take t back out of a rollup.
+func (t Totals) Negate() Totals {
+	var negated Totals
+	negated.Requests = -t.Requests
+	negated.InputToken = -t.InputToken
+	negated.OutputToken = -t.OutputToken
+	negated.TotalToken = -t.TotalToken
+	negated.CachedInputToken = -t.CachedInputToken
+	negated.CacheWriteToken = -t.CacheWriteToken
+	negated.ReasoningToken = -t.ReasoningToken
+	negated.ImageCount = -t.ImageCount
+	negated.AudioSeconds = -t.AudioSeconds
+	negated.InputTokenCost = -t.InputTokenCost
+	negated.OutputTokenCost = -t.OutputTokenCost
+	negated.ImageCost = -t.ImageCost
+	negated.AudioCost = -t.AudioCost
+	negated.TotalTokenCost = -t.TotalTokenCost
+
+	return negated
+}
+
+// Usage is a single llm_usages row as it counts towards rollups.
+type Usage struct {
+	TS time.Time
+	Key
+	Totals
+}
+
+type bucket struct {
+	ts time.Time
+	Key
+}
+
+func hourOf(ts time.Time) time.Time {
+	return ts.UTC().Truncate(time.Hour)
+}
+
+func dayOf(ts time.Time) time.Time {
+	year, month, day := ts.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// Add sums usages into the hourly and daily rollups.
+func Add(ctx context.Context, tx *sql.Tx, usages []Usage) error {
+	for _, table := range []struct {
+		name     string
+		bucketOf func(time.Time) time.Time
+	}{
+		{HOURLY_TABLE, hourOf},
+		{DAILY_TABLE, dayOf},
+	} {
+		buckets := make(map[bucket]*Totals)
+		order := make([]bucket, 0)
+		for _, usage := range usages {
+			b := bucket{ts: table.bucketOf(usage.TS), Key: usage.Key}
+			totals, ok := buckets[b]
+			if !ok {
+				totals = &Totals{}
+				buckets[b] = totals
+				order = append(order, b)
+			}
+			totals.add(usage.Totals)
+		}
+
+		for _, b := range order {
+			if err := upsert(ctx, tx, table.name, b, *buckets[b]); err != nil {
+				return fmt.Errorf("error rolling up llm usage: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func upsert(ctx context.Context, tx *sql.Tx, table string, b bucket, totals Totals) error {
+	query := sqlf.InsertInto(table).
+		Set("ts", utils.FormatDatetime(b.ts)).
+		Set("provider", b.Provider).
+		Set("model_name", b.ModelName).
+		Set("currency", b.Currency).
+		Set("key_name", b.KeyName).
+		Set("team_name", b.TeamName).
+		Set("project_name", b.ProjectName).
+		Set("requests", totals.Requests).
+		Set("input_token", totals.InputToken).
+		Set("output_token", totals.OutputToken).
+		Set("total_token", totals.TotalToken).
+		Set("cached_input_token", totals.CachedInputToken).
+		Set("cache_write_token", totals.CacheWriteToken).
+		Set("reasoning_token", totals.ReasoningToken).
+		Set("image_count", totals.ImageCount).
+		Set("audio_seconds", totals.AudioSeconds).
+		Set("input_token_cost", totals.InputTokenCost).
+		Set("output_token_cost", totals.OutputTokenCost).
+		Set("image_cost", totals.ImageCost).
+		Set("audio_cost", totals.AudioCost).
+		Set("total_token_cost", totals.TotalTokenCost).
+		Clause("ON CONFLICT (ts, provider, model_name, currency, key_name, team_name, project_name) DO UPDATE SET")
+
+	columns := []string{
+		"requests", "input_token", "output_token", "total_token",
+		"cached_input_token", "cache_write_token", "reasoning_token", "image_count",
+		"audio_seconds", "input_token_cost", "output_token_cost", "image_cost",
+		"audio_cost", "total_token_cost",
+	}
+	for i, column := range columns {
+		separator := ","
+		if i == len(columns)-1 {
+			separator = ""
+		}
+		query.Clause(fmt.Sprintf("%s = %s.%s + excluded.%s%s", column, table, column, column, separator))
+	}
+
+	_, err := query.Exec(ctx, tx)
+	return err
+}
+
+// rollupBatch sums the next llm_usages rows not rolled up yet into the
+// rollups, flags them rolled and returns how many it summed. It runs under
+// ROLLUP_LOCK, so replicas never sum the same rows twice.
+func rollupBatch(ctx context.Context, db *sql.DB) (int, error) {
+	rolled := 0
+	err := database.Locked(ctx, db, database.ROLLUP_LOCK, func(ctx context.Context, conn *sql.Conn) error {
+		var err error
+		rolled, err = rollupBatchLocked(ctx, conn)
+		return err
+	})
+
+	return rolled, err
+}
+
+func rollupBatchLocked(ctx context.Context, conn *sql.Conn) (int, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error rolling up llm usage: %w", err)
+	}
+	defer tx.Rollback()
+
+	rowID, _ := database.Current().RowID()
+
+	// recent rows are left to the next run, they may still be coming in
+	query := sqlf.From("llm_usages as lu").
+		Select("lu."+rowID).
+		Select("lu.ts").
+		Select("COALESCE(lu.provider, '')").
+		Select("COALESCE(lu.model_name, '')").
+		Select("COALESCE(lu.currency, ?)", currency.DEFAULT_CURRENCY).
+		Select("COALESCE(lu.key_name, '')").
+		Select("COALESCE(lu.team_name, '')").
+		Select("COALESCE(lu.project_name, '')").
+		Select("COALESCE(lu.input_token, 0)").
+		Select("COALESCE(lu.output_token, 0)").
+		Select("COALESCE(lu.total_token, 0)").
+		Select("COALESCE(lu.cached_input_token, 0)").
+		Select("COALESCE(lu.cache_write_token, 0)").
+		Select("COALESCE(lu.reasoning_token, 0)").
+		Select("COALESCE(lu.image_count, 0)").
+		Select("COALESCE(lu.audio_seconds, 0)").
+		Select("COALESCE(lu.input_token_cost, 0)").
+		Select("COALESCE(lu.output_token_cost, 0)").
+		Select("COALESCE(lu.image_cost, 0)").
+		Select("COALESCE(lu.audio_cost, 0)").
+		Select("COALESCE(lu.total_token_cost, 0)").
+		Where("lu.rolled = FALSE").
+		Where("lu.ts < ?", utils.FormatDatetime(time.Now().Add(-ROLLUP_LAG))).
+		OrderBy("lu.ts ASC").
+		Limit(ROLLUP_BATCH)
+
+	rows, err := tx.QueryContext(ctx, query.String(), query.Args()...)
+	if err != nil {
+		return 0, fmt.Errorf("error rolling up llm usage: %w", err)
+	}
+
+	usages := make([]Usage, 0)
+	rowIDs := make([]any, 0)
+	for rows.Next() {
+		var id int64
+		usage := Usage{Totals: Totals{Requests: 1}}
+		if err := rows.Scan(
+			&id,
+			&usage.TS,
+			&usage.Provider,
+			&usage.ModelName,
+			&usage.Currency,
+			&usage.KeyName,
+			&usage.TeamName,
+			&usage.ProjectName,
+			&usage.InputToken,
+			&usage.OutputToken,
+			&usage.TotalToken,
+			&usage.CachedInputToken,
+			&usage.CacheWriteToken,
+			&usage.ReasoningToken,
+			&usage.ImageCount,
+			&usage.AudioSeconds,
+			&usage.InputTokenCost,
+			&usage.OutputTokenCost,
+			&usage.ImageCost,
+			&usage.AudioCost,
+			&usage.TotalTokenCost,
+		); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error rolling up llm usage: %w", err)
+		}
+		usage.Currency = currency.Normalize(usage.Currency)
+		usages = append(usages, usage)
+		rowIDs = append(rowIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error rolling up llm usage: %w", err)
+	}
+
+	if len(usages) == 0 {
+		return 0, nil
+	}
+
+	if err := Add(ctx, tx, usages); err != nil {
+		return 0, err
+	}
+
+	update := sqlf.Update("llm_usages").
+		Set("rolled", true).
+		Where(rowID).In(rowIDs...)
+	if _, err := update.Exec(ctx, tx); err != nil {
+		return 0, fmt.Errorf("error rolling up llm usage: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error rolling up llm usage: %w", err)
+	}
+
+	return len(usages), nil
+}
+
+// Run sums every llm_usages row not rolled up yet into the rollups.
+func Run(ctx context.Context, db *sql.DB) (int, error) {
+	total := 0
+	for {
+		rolled, err := rollupBatch(ctx, db)
+		total += rolled
+		if err != nil || rolled < ROLLUP_BATCH {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package teams
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/leporo/sqlf"
+)
+
+var (
+	ErrTeamNotFound = errors.New("team not found")
+	ErrTeamExists   = errors.New("team already exists")
+	ErrTeamInUse    = errors.New("team still has members")
+)
+
+// Team groups users with the virtual keys and usage they see. Budget caps
+// what its keys spend per month in the reporting currency, 0 leaves it
+// uncapped.
+type Team struct {
+	Name      string    `json:"name"`
+	Budget    float64   `json:"budget"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func Create(ctx context.Context, db *sql.DB, name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("team name is required")
+	}
+
+	exists, err := Exists(ctx, db, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: %s", ErrTeamExists, name)
+	}
+
+	if _, err := sqlf.InsertInto("teams").NewRow().Set("name", name).Exec(ctx, db); err != nil {
+		return fmt.Errorf("error creating team: %w", err)
+	}
+
+	return nil
+}
+
+// Delete removes the team called name once no user belongs to it. Its keys
+// and usage stay, visible to admins only.
+func Delete(ctx context.Context, db *sql.DB, name string) error {
+	var members int
+	query := sqlf.From("users").Select("COUNT(*)").To(&members).Where("team_name = ?", name)
+	if err := query.QueryRowAndClose(ctx, db); err != nil {
+		return fmt.Errorf("error deleting team: %w", err)
+	}
+	if members > 0 {
+		return fmt.Errorf("%w: %s", ErrTeamInUse, name)
+	}
+
+	result, err := sqlf.DeleteFrom("teams").Where("name = ?", name).Exec(ctx, db)
+	if err != nil {
+		return fmt.Errorf("error deleting team: %w", err)
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("%w: %s", ErrTeamNotFound, name)
+	}
+
+	return nil
+}
+
+func List(ctx context.Context, db *sql.DB) ([]Team, error) {
+	query := sqlf.From("teams").
+		OrderBy("name ASC").
+		Select("name").
+		Select("COALESCE(budget, 0)").
+		Select("created_at")
+
+	teams := make([]Team, 0)
+
+	rows, err := db.QueryContext(ctx, query.String(), query.Args()...)
+	if err != nil {
+		return teams, fmt.Errorf("error querying team: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var team Team
+		if err := rows.Scan(&team.Name, &team.Budget, &team.CreatedAt); err != nil {
+			return teams, fmt.Errorf("error querying team: %w", err)
+		}
+		teams = append(teams, team)
+	}
+	if err := rows.Err(); err != nil {
+		return teams, fmt.Errorf("error querying team: %w", err)
+	}
+
+	return teams, nil
+}
+
+func Exists(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	var count int
+	query := sqlf.From("teams").Select("COUNT(*)").To(&count).Where("name = ?", name)
+	if err := query.QueryRowAndClose(ctx, db); err != nil {
+		return false, fmt.Errorf("error querying team: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// Budget returns the monthly budget of the team called name, 0 when it has
+// none.
+func Budget(ctx context.Context, db *sql.DB, name string) (float64, error) {
+	var budget sql.NullFloat64
+	query := sqlf.From("teams").Select("budget").To(&budget).Where("name = ?", name)
+	if err := query.QueryRowAndClose(ctx, db); errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%w: %s", ErrTeamNotFound, name)
+	} else if err != nil {
+		return 0, fmt.Errorf("error querying team: %w", err)
+	}
+
+	return budget.Float64, nil
+}
+
+// SetBudget caps what the team called name spends per month, 0 removes the
+// cap.
+func SetBudget(ctx context.Context, db *sql.DB, name string, budget float64) error {
+	if budget < 0 {
+		return fmt.Errorf("budget must not be negative")
+	}
+
+	result, err := sqlf.Update("teams").Set("budget", budget).Where("name = ?", name).Exec(ctx, db)
+	if err != nil {
+		return fmt.Errorf("error updating team: %w", err)
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("%w: %s", ErrTeamNotFound, name)
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package teamsAPI
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/auth"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/budgets"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/teams"
+)
+
+type CreateTeamRequest struct {
+	Name string `json:"name"`
+}
+
+type SetBudgetRequest struct {
+	Budget float64 `json:"budget"`
+}
+
+func writeTeamError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, teams.ErrTeamNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, teams.ErrTeamExists), errors.Is(err, teams.ErrTeamInUse):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func DoListTeams(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		teamList, err := teams.List(r.Context(), db)
+		if err != nil {
+			writeTeamError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(teamList)
+	}
+}
+
+func DoCreateTeam(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request CreateTeamRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := teams.Create(r.Context(), db, request.Name); err != nil {
+			writeTeamError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func DoDeleteTeam(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := teams.Delete(r.Context(), db, r.PathValue("name")); err != nil {
+			writeTeamError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DoGetTeamBudget answers what a team spent of its budget this month, to
+// admins and to members of the team.
+func DoGetTeamBudget(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+
+		team, ok := auth.TeamScope(r.Context())
+		if !ok || (team != "" && team != name) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		status, err := budgets.TeamStatus(r.Context(), db, name)
+		if err != nil {
+			writeTeamError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+func DoSetTeamBudget(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request SetBudgetRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if request.Budget < 0 {
+			http.Error(w, "budget must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		if err := teams.SetBudget(r.Context(), db, r.PathValue("name"), request.Budget); err != nil {
+			writeTeamError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,25 @@
+package tokenizer
+
+// LoadEncoding exposes encoding for names no model maps to.
+var LoadEncoding = encoding
+
+// DropEncoding makes the encoding named name unavailable, as when it fails
+// to load, until the returned func restores it.
+func DropEncoding(name string) func() {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+
+	previous, loaded := encodings[name]
+	encodings[name] = nil
+
+	return func() {
+		encodingsMu.Lock()
+		defer encodingsMu.Unlock()
+
+		if loaded {
+			encodings[name] = previous
+		} else {
+			delete(encodings, name)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package tokenizer
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+const (
+	O200K_BASE  = "o200k_base"
+	CL100K_BASE = "cl100k_base"
+
+	// CHARS_PER_TOKEN is close enough for English text and common tokenizers
+	CHARS_PER_TOKEN = 4
+)
+
+// o200kPrefixes name the models encoded with o200k_base, the rest are
+// counted with cl100k_base, which most open models come close to.
+var o200kPrefixes = []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4", "chatgpt-4o"}
+
+var (
+	encodingsMu sync.Mutex
+	encodings   = make(map[string]*tiktoken.Tiktoken)
+)
+
+func init() {
+	// the encodings are embedded, nothing is downloaded at runtime
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// Encoding returns the name of the encoding used to count tokens of model.
+func Encoding(model string) string {
+	model = strings.ToLower(model)
+	if _, name, ok := strings.Cut(model, "/"); ok {
+		model = name // provider prefixed, like openai/gpt-4o
+	}
+
+	for _, prefix := range o200kPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return O200K_BASE
+		}
+	}
+
+	return CL100K_BASE
+}
+
+// encoding loads the encoding named name once, nil when it cannot be loaded.
+func encoding(name string) *tiktoken.Tiktoken {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+
+	if enc, ok := encodings[name]; ok {
+		return enc
+	}
+
+	enc, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		slog.Warn("failed loading tokenizer, estimating by length", "encoding", name, "err", err)
+	}
+	encodings[name] = enc
+
+	return enc
+}
+
+// Count returns the tokens text takes for model. Special tokens are counted
+// as plain text, and when the encoding is unavailable tokens are estimated
+// from the length of text.
+func Count(model string, text string) int {
+	if text == "" {
+		return 0
+	}
+
+	if enc := encoding(Encoding(model)); enc != nil {
+		return len(enc.EncodeOrdinary(text))
+	}
+
+	return Heuristic(text)
+}
+
+// Heuristic estimates the tokens of text at CHARS_PER_TOKEN characters each.
+func Heuristic(text string) int {
+	chars := len([]rune(text))
+	return (chars + CHARS_PER_TOKEN - 1) / CHARS_PER_TOKEN
+}
@@ -0,0 +1,80 @@
+package tokenizer_test
+
+import (
+	"testing"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/tokenizer"
+)
+
+func TestEncoding(t *testing.T) {
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"gpt-4o-mini", tokenizer.O200K_BASE},
+		{"GPT-5", tokenizer.O200K_BASE},
+		{"openai/o3-mini", tokenizer.O200K_BASE},
+		{"gpt-4-turbo", tokenizer.CL100K_BASE},
+		{"llama3.1:8b", tokenizer.CL100K_BASE},
+		{"", tokenizer.CL100K_BASE},
+	}
+
+	for _, tt := range tests {
+		if got := tokenizer.Encoding(tt.model); got != tt.want {
+			t.Fatalf("encoding of %q is %s, want %s", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	tests := []struct {
+		model string
+		text  string
+		want  int
+	}{
+		{"gpt-4o", "hello world", 2},
+		{"llama3", "hello world", 2},
+		{"llama3", "", 0},
+		// counted as text rather than refused as a special token
+		{"llama3", "<|endoftext|>", 7},
+	}
+
+	for _, tt := range tests {
+		if got := tokenizer.Count(tt.model, tt.text); got != tt.want {
+			t.Fatalf("%s counted %q as %d tokens, want %d", tt.model, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestUnknownEncoding(t *testing.T) {
+	if enc := tokenizer.LoadEncoding("no_such_base"); enc != nil {
+		t.Fatal("loaded an encoding that does not exist")
+	}
+
+	// a model whose encoding is unavailable is estimated by length
+	defer tokenizer.DropEncoding(tokenizer.CL100K_BASE)()
+
+	text := "the quick brown fox jumps"
+	if got, want := tokenizer.Count("llama3", text), tokenizer.Heuristic(text); got != want {
+		t.Fatalf("counted %d tokens without the encoding, want %d", got, want)
+	}
+}
+
+func TestHeuristic(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"abcd", 1},
+		{"abcde", 2},
+		// characters, not bytes
+		{"日本語の", 1},
+	}
+
+	for _, tt := range tests {
+		if got := tokenizer.Heuristic(tt.text); got != tt.want {
+			t.Fatalf("estimated %q as %d tokens, want %d", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.27.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const SERVICE_NAME = "inspectro"
+
+// Tracer is used for spans of proxied calls, it does nothing until Setup
+// installs an exporter.
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/IqbalLx/inspectro-llm")
+}
+
+// Setup installs the global tracer provider for exporter, one of none, otlp,
+// stdout or file. otlp is configured through the standard OTEL_EXPORTER_OTLP_*
+// environment variables, file appends JSON spans to path. The returned
+// function flushes and stops the exporter.
+func Setup(ctx context.Context, exporter string, path string) (func(context.Context) error, error) {
+	// incoming traceparent headers are passed on even with tracing off
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	closeFile := func() error { return nil }
+
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		otlpExporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error creating otlp exporter: %w", err)
+		}
+		spanExporter = otlpExporter
+	case "stdout":
+		stdoutExporter, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, fmt.Errorf("error creating stdout exporter: %w", err)
+		}
+		spanExporter = stdoutExporter
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("traces file is required for the file exporter")
+		}
+
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("error opening traces file %s: %w", path, err)
+		}
+		closeFile = file.Close
+
+		fileExporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error creating file exporter: %w", err)
+		}
+		spanExporter = fileExporter
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q", exporter)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(SERVICE_NAME)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		closeFile()
+		return nil, fmt.Errorf("error creating trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeErr := closeFile(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
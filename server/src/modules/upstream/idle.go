@@ -0,0 +1,80 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var ErrReadIdleTimeout = errors.New("upstream sent nothing for too long")
+
+// idleTransport cancels a request once reading its response body waits
+// longer than timeout for the next chunk, so a stream stalling after its
+// headers does not hold on to the proxy forever.
+type idleTransport struct {
+	base    *http.Transport
+	timeout time.Duration
+}
+
+func (t *idleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel(nil)
+		return resp, err
+	}
+
+	// the timer only runs while a Read waits
+	timer := time.AfterFunc(t.timeout, func() { cancel(ErrReadIdleTimeout) })
+	timer.Stop()
+
+	resp.Body = &idleBody{
+		body:    resp.Body,
+		ctx:     ctx,
+		timeout: t.timeout,
+		cancel:  cancel,
+		timer:   timer,
+	}
+
+	return resp, nil
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the
+// pooled connections.
+func (t *idleTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+}
+
+// idleBody times each Read, the time a slow client takes to accept what was
+// read does not count against the upstream.
+type idleBody struct {
+	body    io.ReadCloser
+	ctx     context.Context
+	timeout time.Duration
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.body.Read(p)
+	b.timer.Stop()
+
+	if err != nil && err != io.EOF && context.Cause(b.ctx) == ErrReadIdleTimeout {
+		err = fmt.Errorf("%w: waited %s", ErrReadIdleTimeout, b.timeout)
+	}
+
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	err := b.body.Close()
+	b.cancel(nil)
+
+	return err
+}
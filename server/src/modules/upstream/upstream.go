@@ -0,0 +1,158 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+)
+
+const (
+	DIAL_TIMEOUT            = 10 * time.Second
+	TLS_HANDSHAKE_TIMEOUT   = 10 * time.Second
+	RESPONSE_HEADER_TIMEOUT = 5 * time.Minute
+	READ_IDLE_TIMEOUT       = 2 * time.Minute
+	IDLE_CONN_TIMEOUT       = 90 * time.Second
+	MAX_IDLE_CONNS          = 100
+)
+
+var (
+	clientsMu sync.RWMutex
+	clients   = make(map[string]*http.Client)
+
+	defaultClient = mustClient(nil, "")
+)
+
+func mustClient(config *entities.ProviderHTTP, root string) *http.Client {
+	client, err := NewClient(config, root)
+	if err != nil {
+		panic(err)
+	}
+
+	return client
+}
+
+// NewClient builds a client tuned by config, with a relative CA bundle
+// resolved against root. Its connections are pooled across requests.
+func NewClient(config *entities.ProviderHTTP, root string) (*http.Client, error) {
+	if config == nil {
+		config = &entities.ProviderHTTP{}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   orDefault(config.DialTimeout, DIAL_TIMEOUT),
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   orDefault(config.TLSHandshakeTimeout, TLS_HANDSHAKE_TIMEOUT),
+		ResponseHeaderTimeout: orDefault(config.ResponseHeaderTimeout, RESPONSE_HEADER_TIMEOUT),
+		IdleConnTimeout:       orDefault(config.IdleConnTimeout, IDLE_CONN_TIMEOUT),
+		MaxIdleConns:          orDefault(config.MaxIdleConns, MAX_IDLE_CONNS),
+		MaxIdleConnsPerHost:   orDefault(config.MaxIdleConns, MAX_IDLE_CONNS),
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     !config.DisableHTTP2,
+	}
+
+	if config.DisableHTTP2 {
+		// a non-nil empty map keeps the transport from upgrading to h2
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q", config.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if config.CABundle != "" {
+		path := config.CABundle
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca bundle %s holds no certificates", path)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	// no overall timeout, streamed responses may run for minutes as long as
+	// chunks keep coming
+	return &http.Client{Transport: &idleTransport{
+		base:    transport,
+		timeout: orDefault(config.ReadIdleTimeout, READ_IDLE_TIMEOUT),
+	}}, nil
+}
+
+func orDefault[T comparable](value T, fallback T) T {
+	var zero T
+	if value == zero {
+		return fallback
+	}
+
+	return value
+}
+
+// Configure builds the clients of every provider, with relative CA bundles
+// resolved against root, and returns apply, which replaces the clients in use
+// with them. Nothing changes when one fails to build or apply is not called.
+func Configure(providers []entities.LLMProvider, root string) (apply func(), err error) {
+	configured := make(map[string]*http.Client)
+	for _, provider := range providers {
+		if provider.HTTP == nil {
+			continue
+		}
+
+		client, err := NewClient(provider.HTTP, root)
+		if err != nil {
+			return nil, fmt.Errorf("provider %q: %w", provider.Name, err)
+		}
+		configured[provider.Name] = client
+	}
+
+	return func() {
+		clientsMu.Lock()
+		previous := clients
+		clients = configured
+		clientsMu.Unlock()
+
+		for _, client := range previous {
+			client.CloseIdleConnections()
+		}
+	}, nil
+}
+
+// For returns the client requests to provider go through.
+func For(provider string) *http.Client {
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+
+	if client, ok := clients[provider]; ok {
+		return client
+	}
+
+	return defaultClient
+}
@@ -0,0 +1,136 @@
+package upstream_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/upstream"
+)
+
+const READ_IDLE_TIMEOUT = 100 * time.Millisecond
+
+func TestReadIdleTimeout(t *testing.T) {
+	cancelled, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stall":
+			fmt.Fprint(w, "data: first\n\n")
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+			case <-release:
+			}
+		case "/steady":
+			// slower overall than the timeout, but never idle that long
+			for i := 0; i < 5; i++ {
+				fmt.Fprintf(w, "data: %d\n\n", i)
+				w.(http.Flusher).Flush()
+				time.Sleep(READ_IDLE_TIMEOUT / 2)
+			}
+		}
+	}))
+	defer server.Close()
+
+	client, err := upstream.NewClient(&entities.ProviderHTTP{ReadIdleTimeout: READ_IDLE_TIMEOUT}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get(server.URL + "/steady")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("reading a steady stream: %v", err)
+	}
+	resp.Body.Close()
+
+	resp, err = client.Get(server.URL + "/stall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	start := time.Now()
+	body, err := io.ReadAll(resp.Body)
+	if !errors.Is(err, upstream.ErrReadIdleTimeout) {
+		t.Fatalf("reading a stalled stream: %v, want %v", err, upstream.ErrReadIdleTimeout)
+	}
+	if string(body) != "data: first\n\n" {
+		t.Fatalf("read %q before the stall", body)
+	}
+	if waited := time.Since(start); waited > 10*READ_IDLE_TIMEOUT {
+		t.Fatalf("gave up after %s", waited)
+	}
+
+	// the upstream request is cancelled, not just abandoned
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request still running after the timeout")
+	}
+}
+
+func TestSlowReaderIsNotIdle(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data: first\n\ndata: second\n\n")
+	}))
+	defer server.Close()
+
+	client, err := upstream.NewClient(&entities.ProviderHTTP{ReadIdleTimeout: READ_IDLE_TIMEOUT}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// a client slow to take what was read does not count against the
+	// upstream
+	time.Sleep(3 * READ_IDLE_TIMEOUT)
+
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("reading after a slow client: %v", err)
+	}
+}
+
+func TestConfigureAppliesOnDemand(t *testing.T) {
+	providers := []entities.LLMProvider{{Name: "tuned", HTTP: &entities.ProviderHTTP{MaxIdleConns: 1}}}
+	fallback := upstream.For("tuned")
+
+	apply, err := upstream.Configure(providers, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upstream.For("tuned") != fallback {
+		t.Fatal("clients changed before apply")
+	}
+
+	apply()
+	t.Cleanup(func() {
+		apply, _ := upstream.Configure(nil, "")
+		apply()
+	})
+
+	if upstream.For("tuned") == fallback {
+		t.Fatal("clients unchanged after apply")
+	}
+
+	if _, err := upstream.Configure([]entities.LLMProvider{{Name: "broken", HTTP: &entities.ProviderHTTP{Proxy: "://"}}}, ""); err == nil {
+		t.Fatal("configured a provider with an invalid proxy")
+	}
+}
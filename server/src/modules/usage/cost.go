@@ -0,0 +1,63 @@
+package usage
+
+import "github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+
+type UsageCost struct {
+	TokenCost       entities.LLMTokenCost // token prices after tier selection
+	InputTokenCost  float64
+	OutputTokenCost float64
+	ImageCost       float64
+	AudioCost       float64
+	TotalCost       float64
+}
+
+func priceOr(price *float64, fallback float64) float64 {
+	if price == nil {
+		return fallback
+	}
+
+	return *price
+}
+
+// tokenCostFor picks the highest tier the input size falls into, or the base
+// token prices when no tier applies.
+func tokenCostFor(cost entities.LLMCost, inputToken int) entities.LLMTokenCost {
+	tokenCost := cost.LLMTokenCost
+	above := -1
+
+	for _, tier := range cost.Tiers {
+		if inputToken > tier.AboveInputTokens && tier.AboveInputTokens > above {
+			tokenCost = tier.LLMTokenCost
+			above = tier.AboveInputTokens
+		}
+	}
+
+	return tokenCost
+}
+
+func (u UsageMetric) Cost(cost entities.LLMCost) UsageCost {
+	tokenCost := tokenCostFor(cost, u.InputToken)
+
+	inputPrice := tokenCost.CostPerMillionInputTokens
+	outputPrice := tokenCost.CostPerMillionOutputTokens
+
+	regularInputToken := max(u.InputToken-u.CachedInputToken-u.CacheWriteToken, 0)
+	regularOutputToken := max(u.OutputToken-u.ReasoningToken, 0)
+
+	inputTokenCost := (float64(regularInputToken)*inputPrice +
+		float64(u.CachedInputToken)*priceOr(tokenCost.CostPerMillionCachedInputTokens, inputPrice) +
+		float64(u.CacheWriteToken)*priceOr(tokenCost.CostPerMillionCacheWriteTokens, inputPrice)) / MILLION
+	outputTokenCost := (float64(regularOutputToken)*outputPrice +
+		float64(u.ReasoningToken)*priceOr(tokenCost.CostPerMillionReasoningTokens, outputPrice)) / MILLION
+	imageCost := float64(u.ImageCount) * cost.CostPerImage
+	audioCost := u.AudioSeconds * cost.CostPerAudioSecond
+
+	return UsageCost{
+		TokenCost:       tokenCost,
+		InputTokenCost:  inputTokenCost,
+		OutputTokenCost: outputTokenCost,
+		ImageCost:       imageCost,
+		AudioCost:       audioCost,
+		TotalCost:       inputTokenCost + outputTokenCost + imageCost + audioCost,
+	}
+}
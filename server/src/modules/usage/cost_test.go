@@ -0,0 +1,163 @@
+package usage_test
+
+import (
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/usage"
+)
+
+func price(p float64) *float64 {
+	return &p
+}
+
+func TestCost(t *testing.T) {
+	base := entities.LLMTokenCost{CostPerMillionInputTokens: 1, CostPerMillionOutputTokens: 2}
+
+	tests := []struct {
+		name   string
+		cost   entities.LLMCost
+		metric usage.UsageMetric
+		input  float64
+		output float64
+		total  float64
+	}{
+		{
+			"base",
+			entities.LLMCost{LLMTokenCost: base},
+			usage.UsageMetric{InputToken: 1_000_000, OutputToken: 1_000_000},
+			1, 2, 3,
+		},
+		{
+			"tier",
+			entities.LLMCost{LLMTokenCost: base, Tiers: []entities.LLMCostTier{
+				{AboveInputTokens: 128_000, LLMTokenCost: entities.LLMTokenCost{CostPerMillionInputTokens: 2, CostPerMillionOutputTokens: 4}},
+				{AboveInputTokens: 500_000, LLMTokenCost: entities.LLMTokenCost{CostPerMillionInputTokens: 3, CostPerMillionOutputTokens: 6}},
+			}},
+			usage.UsageMetric{InputToken: 200_000, OutputToken: 100_000},
+			0.4, 0.4, 0.8,
+		},
+		{
+			"at a tier boundary",
+			entities.LLMCost{LLMTokenCost: base, Tiers: []entities.LLMCostTier{
+				{AboveInputTokens: 128_000, LLMTokenCost: entities.LLMTokenCost{CostPerMillionInputTokens: 2, CostPerMillionOutputTokens: 4}},
+			}},
+			usage.UsageMetric{InputToken: 128_000},
+			0.128, 0, 0.128,
+		},
+		{
+			"cached",
+			entities.LLMCost{LLMTokenCost: entities.LLMTokenCost{
+				CostPerMillionInputTokens: 1, CostPerMillionOutputTokens: 2, CostPerMillionCachedInputTokens: price(0.1),
+			}},
+			usage.UsageMetric{InputToken: 1_000_000, CachedInputToken: 400_000},
+			0.64, 0, 0.64,
+		},
+		{
+			"cached without a cached price",
+			entities.LLMCost{LLMTokenCost: base},
+			usage.UsageMetric{InputToken: 1_000_000, CachedInputToken: 400_000},
+			1, 0, 1,
+		},
+		{
+			"cache write",
+			entities.LLMCost{LLMTokenCost: entities.LLMTokenCost{
+				CostPerMillionInputTokens: 1, CostPerMillionOutputTokens: 2, CostPerMillionCacheWriteTokens: price(1.25),
+			}},
+			usage.UsageMetric{InputToken: 1_000_000, CacheWriteToken: 200_000},
+			1.05, 0, 1.05,
+		},
+		{
+			"reasoning",
+			entities.LLMCost{LLMTokenCost: entities.LLMTokenCost{
+				CostPerMillionInputTokens: 1, CostPerMillionOutputTokens: 2, CostPerMillionReasoningTokens: price(3),
+			}},
+			usage.UsageMetric{OutputToken: 1_000_000, ReasoningToken: 500_000},
+			0, 2.5, 2.5,
+		},
+		{
+			"tier prices cached input",
+			entities.LLMCost{LLMTokenCost: base, Tiers: []entities.LLMCostTier{
+				{AboveInputTokens: 128_000, LLMTokenCost: entities.LLMTokenCost{
+					CostPerMillionInputTokens: 2, CostPerMillionOutputTokens: 4, CostPerMillionCachedInputTokens: price(0.5),
+				}},
+			}},
+			usage.UsageMetric{InputToken: 1_000_000, CachedInputToken: 1_000_000},
+			0.5, 0, 0.5,
+		},
+		{
+			"images and audio",
+			entities.LLMCost{LLMTokenCost: base, CostPerImage: 0.04, CostPerAudioSecond: 0.006},
+			usage.UsageMetric{ImageCount: 2, AudioSeconds: 10},
+			0, 0, 0.14,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cost := tt.metric.Cost(tt.cost)
+
+			for _, check := range []struct {
+				what      string
+				got, want float64
+			}{
+				{"input", cost.InputTokenCost, tt.input},
+				{"output", cost.OutputTokenCost, tt.output},
+				{"total", cost.TotalCost, tt.total},
+			} {
+				if math.Abs(check.got-check.want) > 1e-9 {
+					t.Fatalf("%s cost %v, want %v", check.what, check.got, check.want)
+				}
+			}
+		})
+	}
+}
+
+// parsed returns a parser done parsing the response body.
+func parsed(body string) usage.UsageParser {
+	pr, pw := io.Pipe()
+	go func() {
+		io.Copy(pw, strings.NewReader(body))
+		pw.Close()
+	}()
+
+	parser := usage.NewOllamaParser(pr)
+	parser.Parse()
+
+	return parser
+}
+
+func parse(body string) usage.UsageMetric {
+	return parsed(body).Get()
+}
+
+func TestParsedCacheWrites(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want usage.UsageMetric
+	}{
+		{
+			// anthropic counts cache writes apart from the prompt
+			"reported apart",
+			`{"usage":{"prompt_tokens":100,"completion_tokens":10,"total_tokens":110,"cache_creation_input_tokens":1000}}`,
+			usage.UsageMetric{InputToken: 1100, OutputToken: 10, TotalToken: 1110, CacheWriteToken: 1000},
+		},
+		{
+			"part of the prompt",
+			`{"usage":{"prompt_tokens":1100,"completion_tokens":10,"total_tokens":1110,"prompt_tokens_details":{"cached_tokens":50,"cache_write_tokens":1000}}}`,
+			usage.UsageMetric{InputToken: 1100, OutputToken: 10, TotalToken: 1110, CachedInputToken: 50, CacheWriteToken: 1000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parse(tt.body); got != tt.want {
+				t.Fatalf("parsed %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
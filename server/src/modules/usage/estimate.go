@@ -0,0 +1,78 @@
+package usage
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/tokenizer"
+)
+
+// TOKENS_PER_MESSAGE is what chat formatting adds around each message, and
+// REPLY_TOKENS primes the reply, following OpenAI's accounting.
+const (
+	TOKENS_PER_MESSAGE = 3
+	REPLY_TOKENS       = 3
+)
+
+// promptRequest holds the fields of an OpenAI style request carrying the
+// prompt, each is a string or a list.
+type promptRequest struct {
+	Model    string `json:"model"`
+	Messages []struct {
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+	Prompt json.RawMessage `json:"prompt"`
+	Input  json.RawMessage `json:"input"`
+}
+
+// promptTokens counts the prompt tokens of a request body and returns the
+// model it names, 0 tokens when it is not an OpenAI style request.
+func promptTokens(body []byte) (int, string) {
+	var request promptRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return 0, ""
+	}
+
+	tokens := tokenizer.Count(request.Model, promptText(request.Prompt)) +
+		tokenizer.Count(request.Model, promptText(request.Input))
+	for _, message := range request.Messages {
+		tokens += TOKENS_PER_MESSAGE + tokenizer.Count(request.Model, promptText(message.Content))
+	}
+	if len(request.Messages) > 0 {
+		tokens += REPLY_TOKENS
+	}
+
+	return tokens, request.Model
+}
+
+// promptText joins the text of a string, a list of strings or a list of
+// content parts with text.
+func promptText(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return ""
+	}
+
+	var joined strings.Builder
+	for _, part := range parts {
+		var content struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(part, &text); err == nil {
+			joined.WriteString(text)
+		} else if err := json.Unmarshal(part, &content); err == nil {
+			joined.WriteString(content.Text)
+		}
+	}
+
+	return joined.String()
+}
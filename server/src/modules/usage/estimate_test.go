@@ -0,0 +1,71 @@
+package usage_test
+
+import (
+	"testing"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/usage"
+)
+
+const STREAM_WITHOUT_USAGE = "{\"choices\":[{\"delta\":{\"content\":\"hello\"}}]}\n{\"choices\":[{\"delta\":{\"content\":\" world\"}}]}\n"
+
+func TestEstimate(t *testing.T) {
+	tests := []struct {
+		name      string
+		response  string
+		request   string
+		want      usage.UsageMetric
+		estimated bool
+	}{
+		{
+			// each message is framed by TOKENS_PER_MESSAGE, the reply
+			// primed by REPLY_TOKENS
+			"chat",
+			STREAM_WITHOUT_USAGE,
+			`{"model":"llama3","messages":[{"role":"system","content":"hello"},{"role":"user","content":[{"type":"text","text":"hello"},{"type":"text","text":" world"}]}]}`,
+			usage.UsageMetric{InputToken: 3 + 1 + 3 + 2 + 3, OutputToken: 2, TotalToken: 14},
+			true,
+		},
+		{
+			"completion",
+			`{"choices":[{"text":"hello world"}]}`,
+			`{"model":"gpt-4o","prompt":["hello","world"]}`,
+			usage.UsageMetric{InputToken: 2, OutputToken: 2, TotalToken: 4},
+			true,
+		},
+		{
+			"reported",
+			`{"choices":[{"message":{"content":"hi"}}],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`,
+			`{"model":"llama3","messages":[{"role":"user","content":"hello"}]}`,
+			usage.UsageMetric{InputToken: 10, OutputToken: 5, TotalToken: 15},
+			false,
+		},
+		{
+			// nothing to count is not an estimate of nothing
+			"not a prompt",
+			`{"object":"list"}`,
+			`not json`,
+			usage.UsageMetric{},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := parsed(tt.response)
+			parser.Estimate([]byte(tt.request))
+
+			if got := parser.Get(); got != tt.want {
+				t.Fatalf("usage %+v, want %+v", got, tt.want)
+			}
+
+			record, err := parser.Record(entities.ProxyContext{}, entities.GenericLLMPayload{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if record.Estimated != tt.estimated {
+				t.Fatalf("estimated %v, want %v", record.Estimated, tt.estimated)
+			}
+		})
+	}
+}
@@ -1,29 +1,69 @@
 package usage
 
 import (
-	"context"
-	"database/sql"
 	"encoding/json"
-	"fmt"
 	"io"
+	"strings"
 
 	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
-	"github.com/leporo/sqlf"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/tokenizer"
 )
 
 type ollamaUsageParser struct {
-	dec   *json.Decoder
-	usage UsageMetric
+	dec        *json.Decoder
+	reader     io.Reader
+	usage      UsageMetric
+	reported   bool // usage came from the provider rather than Estimate
+	estimated  bool
+	completion strings.Builder // reassembled from the choices, for Estimate
 }
 
 type ollamaFinalChunk struct {
-	Usage ollamaUsage `json:"usage"`
+	Usage   *ollamaUsage      `json:"usage"`
+	Data    []ollamaImageData `json:"data"`
+	Choices []ollamaChoice    `json:"choices"`
+}
+
+// ollamaChoice is a choice of a response or of a streamed chunk, kept in
+// case the provider never reports usage.
+type ollamaChoice struct {
+	Delta   ollamaMessage `json:"delta"`
+	Message ollamaMessage `json:"message"`
+	Text    string        `json:"text"` // legacy completions
+}
+
+type ollamaMessage struct {
+	Content          string `json:"content"`
+	ReasoningContent string `json:"reasoning_content"`
 }
 
 type ollamaUsage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens            int                           `json:"prompt_tokens"`
+	CompletionTokens        int                           `json:"completion_tokens"`
+	TotalTokens             int                           `json:"total_tokens"`
+	PromptTokensDetails     ollamaPromptTokensDetails     `json:"prompt_tokens_details"`
+	CompletionTokensDetails ollamaCompletionTokensDetails `json:"completion_tokens_details"`
+	// reported by proxies relaying anthropic style prompt caching, apart
+	// from prompt_tokens like anthropic does
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	// reported by audio transcription in seconds
+	Seconds float64 `json:"seconds"`
+}
+
+type ollamaPromptTokensDetails struct {
+	CachedTokens     int `json:"cached_tokens"`
+	CacheWriteTokens int `json:"cache_write_tokens"` // part of prompt_tokens
+}
+
+type ollamaCompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
+}
+
+// ollamaImageData is an item of image generation response, embedding
+// responses share the data key but carry neither field.
+type ollamaImageData struct {
+	URL     string `json:"url"`
+	B64JSON string `json:"b64_json"`
 }
 
 func (o *ollamaUsageParser) Parse() {
@@ -31,46 +71,86 @@ func (o *ollamaUsageParser) Parse() {
 		var usage ollamaFinalChunk
 		if err := o.dec.Decode(&usage); err == io.EOF {
 			break
-		} else if err != nil {
+		} else if _, ok := err.(*json.UnmarshalTypeError); ok {
 			continue // ignore error, it means json provied not in ollama format
+		} else if err != nil {
+			// the decoder cannot recover from broken json, like a stream cut
+			// short, drain the rest so the response still reaches the client
+			io.Copy(io.Discard, o.dec.Buffered())
+			io.Copy(io.Discard, o.reader)
+			break
+		}
+
+		for _, choice := range usage.Choices {
+			for _, text := range []string{
+				choice.Delta.ReasoningContent, choice.Delta.Content,
+				choice.Message.ReasoningContent, choice.Message.Content,
+				choice.Text,
+			} {
+				o.completion.WriteString(text)
+			}
 		}
 
+		imageCount := 0
+		for _, data := range usage.Data {
+			if data.URL != "" || data.B64JSON != "" {
+				imageCount++
+			}
+		}
+
+		if usage.Usage == nil && imageCount == 0 {
+			continue
+		}
+
+		if usage.Usage == nil {
+			usage.Usage = &ollamaUsage{}
+		}
+
+		// cache writes reported apart are added to the prompt they were
+		// part of
+		cacheWriteApart := usage.Usage.CacheCreationInputTokens
+
+		o.reported = true
 		o.usage = UsageMetric{
-			InputToken:  usage.Usage.PromptTokens,
-			OutputToken: usage.Usage.CompletionTokens,
-			TotalToken:  usage.Usage.TotalTokens,
+			InputToken:       usage.Usage.PromptTokens + cacheWriteApart,
+			OutputToken:      usage.Usage.CompletionTokens,
+			TotalToken:       usage.Usage.TotalTokens + cacheWriteApart,
+			CachedInputToken: usage.Usage.PromptTokensDetails.CachedTokens,
+			CacheWriteToken:  usage.Usage.PromptTokensDetails.CacheWriteTokens + cacheWriteApart,
+			ReasoningToken:   usage.Usage.CompletionTokensDetails.ReasoningTokens,
+			ImageCount:       imageCount,
+			AudioSeconds:     usage.Usage.Seconds,
 		}
 	}
 }
 
+// Estimate fills in usage the provider never reported, counting the prompt
+// in requestBody and the completion received so far with the tokenizer of
+// the model.
+func (o *ollamaUsageParser) Estimate(requestBody []byte) {
+	if o.reported {
+		return
+	}
+
+	inputToken, model := promptTokens(requestBody)
+	o.usage.InputToken = inputToken
+	o.usage.OutputToken = tokenizer.Count(model, o.completion.String())
+	o.usage.TotalToken = o.usage.InputToken + o.usage.OutputToken
+	o.estimated = o.usage.TotalToken > 0
+}
+
 func (o *ollamaUsageParser) Get() UsageMetric {
 	return o.usage
 }
 
-func (o *ollamaUsageParser) Log(ctx context.Context, db *sql.DB, proxyContext entities.ProxyContext, payload entities.GenericLLMPayload) error {
-
-	inputTokenCost := float64(o.usage.InputToken) / MILLION * proxyContext.CostPerMillionInputToken
-	outputTokenCost := float64(o.usage.OutputToken) / MILLION * proxyContext.CostPerMillionOutputToken
-
-	query := sqlf.InsertInto("llm_usages").
-		NewRow().
-		Set("provider", "ollama").
-		Set("model_name", payload.Model).
-		Set("input_token", o.usage.InputToken).
-		Set("output_token", o.usage.OutputToken).
-		Set("total_token", o.usage.TotalToken).
-		Set("input_token_cost", inputTokenCost).
-		Set("output_token_cost", outputTokenCost).
-		Set("total_token_cost", inputTokenCost+outputTokenCost)
-
-	if _, err := query.Exec(ctx, db); err != nil {
-		return fmt.Errorf("error logging llm usage data: %w", err)
-	}
+func (o *ollamaUsageParser) Record(proxyContext entities.ProxyContext, payload entities.GenericLLMPayload) (Record, error) {
+	record, err := newRecord("ollama", o.usage, proxyContext, payload)
+	record.Estimated = o.estimated
 
-	return nil
+	return record, err
 }
 
 func NewOllamaParser(pipeReader *io.PipeReader) UsageParser {
 	dec := json.NewDecoder(pipeReader)
-	return &ollamaUsageParser{dec: dec}
+	return &ollamaUsageParser{dec: dec, reader: pipeReader}
 }
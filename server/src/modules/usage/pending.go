@@ -0,0 +1,93 @@
+package usage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+)
+
+// WRITE_TIMEOUT bounds how long a request waits for room in a full writer
+// buffer before its usage goes to the spool.
+const WRITE_TIMEOUT = 5 * time.Second
+
+var (
+	writerMu sync.RWMutex
+	writer   *Writer
+	spool    *Spool
+)
+
+// Start makes LogAsync hand usage to a Writer batching it into db, spooling
+// to spoolDir what the database refuses and replaying it from there.
+func Start(db *sql.DB, spoolDir string, bufferSize int, batchSize int, interval time.Duration) error {
+	s, err := OpenSpool(spoolDir)
+	if err != nil {
+		return err
+	}
+
+	s.Start(db, REPLAY_INTERVAL)
+
+	writerMu.Lock()
+	defer writerMu.Unlock()
+
+	spool = s
+	writer = NewWriter(db, s, bufferSize, batchSize, interval)
+
+	return nil
+}
+
+// LogAsync queues the usage of parser for writing, detached from the request
+// so it survives the client going away. A buffer staying full for
+// WRITE_TIMEOUT sends the usage to the spool instead. Wait flushes the queue
+// during shutdown.
+func LogAsync(ctx context.Context, db *sql.DB, parser UsageParser, proxyContext entities.ProxyContext, payload entities.GenericLLMPayload) {
+	ctx = context.WithoutCancel(ctx)
+
+	record, err := parser.Record(proxyContext, payload)
+	if err != nil {
+		slog.Error("failed logging usage", "model", payload.Model, "err", err)
+		return
+	}
+
+	// the lock is not held while waiting, Wait may swap the writer meanwhile
+	writerMu.RLock()
+	w, s := writer, spool
+	writerMu.RUnlock()
+
+	if w == nil {
+		// not started or already flushed by Wait, write in the caller instead
+		if err = insertRecords(ctx, db, []Record{record}); err != nil {
+			spoolOrDrop(s, []Record{record}, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, WRITE_TIMEOUT)
+	defer cancel()
+
+	if err = w.Write(ctx, record); err != nil {
+		spoolOrDrop(s, []Record{record}, fmt.Errorf("error queueing usage: %w", err))
+	}
+}
+
+// Wait blocks until queued usage is written or spooled, or ctx expires.
+func Wait(ctx context.Context) error {
+	writerMu.Lock()
+	w, s := writer, spool
+	writer = nil
+	writerMu.Unlock()
+
+	if w == nil {
+		return nil
+	}
+
+	err := w.Close(ctx)
+
+	// records the writer still spools after a timeout land in a new segment
+	return errors.Join(err, s.Close())
+}
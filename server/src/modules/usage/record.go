@@ -0,0 +1,116 @@
+package usage
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/currency"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
+	"github.com/leporo/sqlf"
+)
+
+// Record is a row of llm_usages, priced when the request finished.
+type Record struct {
+	// RequestID tells records apart, so replaying a spool segment twice
+	// writes each record once. Records spooled before it have none.
+	RequestID     string
+	TS            time.Time
+	Provider      string
+	ModelName     string
+	Usage         UsageMetric
+	Cost          UsageCost
+	PriceSnapshot string
+	Currency      string
+	KeyName       string
+	TeamName      string
+	ProjectName   string
+	Cancelled     bool
+	Estimated     bool // tokens counted locally, the provider reported none
+}
+
+// newRecord prices metric with the price of proxyContext.
+func newRecord(provider string, metric UsageMetric, proxyContext entities.ProxyContext, payload entities.GenericLLMPayload) (Record, error) {
+	priceSnapshot, err := json.Marshal(proxyContext.Cost)
+	if err != nil {
+		return Record{}, fmt.Errorf("error logging llm usage data: %w", err)
+	}
+
+	requestID := make([]byte, 16)
+	if _, err := rand.Read(requestID); err != nil {
+		return Record{}, fmt.Errorf("error logging llm usage data: %w", err)
+	}
+
+	return Record{
+		RequestID:     hex.EncodeToString(requestID),
+		TS:            time.Now(),
+		Provider:      provider,
+		ModelName:     payload.Model,
+		Usage:         metric,
+		Cost:          metric.Cost(proxyContext.Cost),
+		PriceSnapshot: string(priceSnapshot),
+		Currency:      currency.Normalize(proxyContext.Currency),
+		KeyName:       proxyContext.KeyName,
+		TeamName:      proxyContext.TeamName,
+		ProjectName:   proxyContext.Project,
+		Cancelled:     proxyContext.Cancelled,
+	}, nil
+}
+
+// insertRecords writes records with a single multi-row insert, skipping
+// those already written.
+func insertRecords(ctx context.Context, db *sql.DB, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	query := sqlf.InsertInto("llm_usages")
+	for _, record := range records {
+		// NULLs never conflict, unlike empty ids
+		var requestID any
+		if record.RequestID != "" {
+			requestID = record.RequestID
+		}
+
+		query.NewRow().
+			Set("request_id", requestID).
+			Set("ts", utils.FormatDatetime(record.TS)).
+			Set("provider", record.Provider).
+			Set("model_name", record.ModelName).
+			Set("input_token", record.Usage.InputToken).
+			Set("output_token", record.Usage.OutputToken).
+			Set("total_token", record.Usage.TotalToken).
+			Set("cached_input_token", record.Usage.CachedInputToken).
+			Set("cache_write_token", record.Usage.CacheWriteToken).
+			Set("reasoning_token", record.Usage.ReasoningToken).
+			Set("image_count", record.Usage.ImageCount).
+			Set("audio_seconds", record.Usage.AudioSeconds).
+			Set("input_token_cost", record.Cost.InputTokenCost).
+			Set("output_token_cost", record.Cost.OutputTokenCost).
+			Set("image_cost", record.Cost.ImageCost).
+			Set("audio_cost", record.Cost.AudioCost).
+			Set("total_token_cost", record.Cost.TotalCost).
+			Set("cost_per_million_input_token", record.Cost.TokenCost.CostPerMillionInputTokens).
+			Set("cost_per_million_output_token", record.Cost.TokenCost.CostPerMillionOutputTokens).
+			Set("price_snapshot", record.PriceSnapshot).
+			Set("currency", record.Currency).
+			Set("key_name", record.KeyName).
+			Set("team_name", record.TeamName).
+			Set("project_name", record.ProjectName).
+			Set("cancelled", record.Cancelled).
+			Set("estimated", record.Estimated)
+	}
+
+	query.Clause("ON CONFLICT DO NOTHING")
+
+	if _, err := query.Exec(ctx, db); err != nil {
+		return fmt.Errorf("error logging llm usage data: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,280 @@
+package usage
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SEGMENT_MAX_SIZE = 16 << 20
+	REPLAY_INTERVAL  = 30 * time.Second
+	REPLAY_BATCH     = 500
+)
+
+// Spool keeps usage records the database refused in append-only JSONL
+// segments under dir, and replays them into the database in the background
+// so billing data outlives a locked or unreachable database.
+type Spool struct {
+	dir string
+
+	mu      sync.Mutex
+	segment *os.File
+	size    int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func OpenSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("error opening usage spool: %w", err)
+	}
+
+	return &Spool{dir: dir}, nil
+}
+
+// Append writes records to the current segment and syncs it to disk before
+// returning.
+func (s *Spool) Append(records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.segment == nil || s.size >= SEGMENT_MAX_SIZE {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	w := bufio.NewWriter(s.segment)
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("error spooling usage: %w", err)
+		}
+
+		n, _ := w.Write(append(line, '\n'))
+		s.size += int64(n)
+	}
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("error spooling usage: %w", err)
+	}
+
+	if err := s.segment.Sync(); err != nil {
+		return fmt.Errorf("error spooling usage: %w", err)
+	}
+
+	return nil
+}
+
+// rotate closes the current segment so replay can pick it up and opens a
+// new one. s.mu must be held.
+func (s *Spool) rotate() error {
+	if err := s.closeSegment(); err != nil {
+		return err
+	}
+
+	// a segment is never reopened, replay may be reading or removing it
+	var f *os.File
+	for nanos := time.Now().UnixNano(); ; nanos++ {
+		name := filepath.Join(s.dir, fmt.Sprintf("usage-%d.jsonl", nanos))
+
+		var err error
+		f, err = os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0666)
+		if err == nil {
+			break
+		} else if !os.IsExist(err) {
+			return fmt.Errorf("error spooling usage: %w", err)
+		}
+	}
+
+	s.segment = f
+	s.size = 0
+
+	return nil
+}
+
+func (s *Spool) closeSegment() error {
+	if s.segment == nil {
+		return nil
+	}
+
+	err := s.segment.Close()
+	s.segment = nil
+	if err != nil {
+		return fmt.Errorf("error closing usage spool segment: %w", err)
+	}
+
+	return nil
+}
+
+// Start replays spooled records into db right away and then every interval
+// until Close.
+func (s *Spool) Start(db *sql.DB, interval time.Duration) {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.Replay(context.Background(), db); err != nil {
+				slog.Warn("failed replaying usage spool", "err", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops replaying and closes the current segment, it is replayed on
+// the next start.
+func (s *Spool) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closeSegment()
+}
+
+// Replay writes every closed segment to db, oldest first, removing each once
+// it is written. A segment failing part way is rewritten with the records
+// still left, and records already in db are skipped by their request id, so
+// a crash before the removal writes none twice.
+func (s *Spool) Replay(ctx context.Context, db *sql.DB) error {
+	segments, err := s.closedSegments()
+	if err != nil {
+		return err
+	}
+
+	// names carry a nanosecond timestamp, so sorting them sorts by age
+	sort.Strings(segments)
+
+	for _, segment := range segments {
+		if err := s.replaySegment(ctx, db, segment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closedSegments closes the current segment and lists every segment. Both
+// happen under s.mu, so appends made after go to a new segment not listed.
+func (s *Spool) closedSegments() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.closeSegment(); err != nil {
+		return nil, err
+	}
+
+	return filepath.Glob(filepath.Join(s.dir, "usage-*.jsonl"))
+}
+
+func (s *Spool) replaySegment(ctx context.Context, db *sql.DB, segment string) error {
+	records, err := readSegment(segment)
+	if err != nil {
+		return err
+	}
+
+	for len(records) > 0 {
+		batch := records[:min(len(records), REPLAY_BATCH)]
+		if err := insertRecords(ctx, db, batch); err != nil {
+			if rewriteErr := writeSegment(segment, records); rewriteErr != nil {
+				return fmt.Errorf("%w, and rewriting %s failed: %w", err, segment, rewriteErr)
+			}
+
+			return err
+		}
+
+		records = records[len(batch):]
+	}
+
+	slog.Info("replayed usage spool segment", "segment", filepath.Base(segment))
+
+	return os.Remove(segment)
+}
+
+func readSegment(segment string) ([]Record, error) {
+	f, err := os.Open(segment)
+	if err != nil {
+		return nil, fmt.Errorf("error reading usage spool: %w", err)
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// a crash mid append leaves a torn last line, the rest is intact
+			slog.Warn("skipping unreadable usage spool line", "segment", filepath.Base(segment), "err", err)
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading usage spool: %w", err)
+	}
+
+	return records, nil
+}
+
+// writeSegment replaces segment with records through a rename, so a crash
+// leaves either the old or the new content.
+func writeSegment(segment string, records []Record) error {
+	tmp := segment + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, segment)
+}
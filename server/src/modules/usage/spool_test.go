@@ -0,0 +1,157 @@
+package usage_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/usage"
+)
+
+func spooledRecords(n int) []usage.Record {
+	records := make([]usage.Record, n)
+	for i := range records {
+		records[i] = newRecord("test-model")
+		records[i].RequestID = fmt.Sprintf("request-%d", i)
+	}
+
+	return records
+}
+
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+
+	segments, err := filepath.Glob(filepath.Join(dir, "usage-*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return segments
+}
+
+func TestSpoolReplay(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	dir := t.TempDir()
+
+	spool, err := usage.OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := spooledRecords(3)
+	if err := spool.Append(records[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(records[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if got := segments(t, dir); len(got) != 1 {
+		t.Fatalf("appends went to %d segments, want 1", len(got))
+	}
+
+	// keep the segment to replay it again as after a crash before removal
+	segment := segments(t, dir)[0]
+	content, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := spool.Replay(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if count := countUsages(t, db); count != 3 {
+		t.Fatalf("replayed %d records, want 3", count)
+	}
+	if got := segments(t, dir); len(got) != 0 {
+		t.Fatalf("replay left segments %v", got)
+	}
+
+	if err := os.WriteFile(segment, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Replay(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if count := countUsages(t, db); count != 3 {
+		t.Fatalf("replaying a segment twice left %d records, want 3", count)
+	}
+
+	// replay closed the segment, appends after go to a new one
+	if err := spool.Append(spooledRecords(1)); err != nil {
+		t.Fatal(err)
+	}
+	if got := segments(t, dir); len(got) != 1 || got[0] == segment {
+		t.Fatalf("append after replay went to %v, want a new segment", got)
+	}
+	if err := spool.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolRotatesFullSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	spool, err := usage.OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	// one append may overshoot the size, the next goes to a new segment
+	full := make([]usage.Record, 0)
+	for size := 0; size < usage.SEGMENT_MAX_SIZE; size += 200 {
+		full = append(full, newRecord("test-model"))
+	}
+
+	if err := spool.Append(full); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(spooledRecords(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := segments(t, dir); len(got) != 2 {
+		t.Fatalf("spooled into %d segments, want 2", len(got))
+	}
+}
+
+func TestSpoolSkipsTornTail(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	dir := t.TempDir()
+
+	spool, err := usage.OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := spool.Append(spooledRecords(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash mid append leaves half a line behind
+	f, err := os.OpenFile(segments(t, dir)[0], os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"RequestID":"request-torn","TS":"2024-`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := spool.Replay(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if count := countUsages(t, db); count != 2 {
+		t.Fatalf("replayed %d records, want the 2 intact", count)
+	}
+	if got := segments(t, dir); len(got) != 0 {
+		t.Fatalf("replay left segments %v", got)
+	}
+}
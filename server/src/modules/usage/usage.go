@@ -1,8 +1,6 @@
 package usage
 
 import (
-	"context"
-	"database/sql"
 	"fmt"
 	"io"
 
@@ -11,16 +9,27 @@ import (
 
 var MILLION = 1_000_000.00
 
+// UsageMetric counts what a request consumed. CachedInputToken and
+// CacheWriteToken are part of InputToken, ReasoningToken is part of
+// OutputToken. Parsers add in what providers report apart from them.
 type UsageMetric struct {
-	InputToken  int
-	OutputToken int
-	TotalToken  int
+	InputToken       int
+	OutputToken      int
+	TotalToken       int
+	CachedInputToken int
+	CacheWriteToken  int
+	ReasoningToken   int
+	ImageCount       int
+	AudioSeconds     float64
 }
 
 type UsageParser interface {
 	Parse()
 	Get() UsageMetric
-	Log(ctx context.Context, db *sql.DB, proxyContext entities.ProxyContext, payload entities.GenericLLMPayload) error
+	Record(proxyContext entities.ProxyContext, payload entities.GenericLLMPayload) (Record, error)
+	// Estimate fills in usage the response ended without, as when the
+	// client went away mid-stream or the provider does not report it.
+	Estimate(requestBody []byte)
 }
 
 func UsageParserFactory(provider string, pr *io.PipeReader) (UsageParser, error) {
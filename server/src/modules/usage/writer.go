@@ -0,0 +1,191 @@
+package usage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	WRITE_ATTEMPTS = 5
+	RETRY_BACKOFF  = 100 * time.Millisecond
+	FLUSH_INTERVAL = time.Second
+)
+
+var ErrWriterClosed = errors.New("usage writer closed")
+
+var (
+	spooledRecords atomic.Int64
+	droppedRecords atomic.Int64
+)
+
+// SpooledRecords counts the usage records spooled since the start, because
+// the database refused them or the writer buffer stayed full.
+func SpooledRecords() int64 {
+	return spooledRecords.Load()
+}
+
+// DroppedRecords counts the usage records lost since the start, refused by
+// the database and the spool alike.
+func DroppedRecords() int64 {
+	return droppedRecords.Load()
+}
+
+// Writer batches usage records into multi-row inserts, written once
+// batchSize records are buffered or every interval. Write blocks while the
+// buffer is full, so a slow database slows callers down rather than growing
+// memory. Batches the database keeps refusing go to spool.
+type Writer struct {
+	db        *sql.DB
+	spool     *Spool
+	records   chan Record
+	batchSize int
+	interval  time.Duration
+	done      chan struct{}
+
+	// Close waits for writes in progress before closing records, and wakes
+	// those blocked on a full buffer through closing
+	mu      sync.Mutex
+	closed  bool
+	closing chan struct{}
+	writing sync.WaitGroup
+}
+
+func NewWriter(db *sql.DB, spool *Spool, bufferSize int, batchSize int, interval time.Duration) *Writer {
+	if interval <= 0 {
+		interval = FLUSH_INTERVAL
+	}
+
+	w := &Writer{
+		db:        db,
+		spool:     spool,
+		records:   make(chan Record, max(bufferSize, 1)),
+		batchSize: max(batchSize, 1),
+		interval:  interval,
+		done:      make(chan struct{}),
+		closing:   make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+// Write buffers record, waiting for room until ctx is done. It fails with
+// ErrWriterClosed once Close was called, leaving record to the caller.
+func (w *Writer) Write(ctx context.Context, record Record) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrWriterClosed
+	}
+	w.writing.Add(1)
+	w.mu.Unlock()
+	defer w.writing.Done()
+
+	select {
+	case w.records <- record:
+		return nil
+	case <-w.closing:
+		return ErrWriterClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops taking records and waits until the buffered ones are written
+// or ctx expires.
+func (w *Writer) Close(ctx context.Context) error {
+	w.mu.Lock()
+	w.closed = true
+	close(w.closing)
+	w.mu.Unlock()
+
+	w.writing.Wait()
+	close(w.records)
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, w.batchSize)
+	for {
+		select {
+		case record, ok := <-w.records:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+
+			batch = append(batch, record)
+			if len(batch) >= w.batchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// flush writes batch, retrying with backoff since errors like a locked
+// sqlite database usually pass, and spools it when they do not.
+func (w *Writer) flush(batch []Record) {
+	if len(batch) == 0 {
+		return
+	}
+
+	backoff := RETRY_BACKOFF
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = insertRecords(context.Background(), w.db, batch); err == nil {
+			return
+		}
+
+		// the last failure goes straight to the spool
+		if attempt == WRITE_ATTEMPTS {
+			break
+		}
+
+		slog.Warn("failed writing usage, retrying", "records", len(batch), "attempt", attempt, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	spoolOrDrop(w.spool, batch, err)
+}
+
+// spoolOrDrop keeps batch in spool after it could not be written for err.
+func spoolOrDrop(spool *Spool, batch []Record, err error) {
+	if spool != nil {
+		spoolErr := spool.Append(batch)
+		if spoolErr == nil {
+			spooledRecords.Add(int64(len(batch)))
+			slog.Warn("spooled usage records", "records", len(batch), "err", err)
+			return
+		}
+
+		err = fmt.Errorf("%w, and spooling failed: %w", err, spoolErr)
+	}
+
+	droppedRecords.Add(int64(len(batch)))
+	slog.Error("dropped usage records", "records", len(batch), "err", err)
+}
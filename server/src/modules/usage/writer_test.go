@@ -0,0 +1,165 @@
+package usage_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/usage"
+)
+
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func countUsages(t *testing.T, db *sql.DB) int {
+	t.Helper()
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM llm_usages`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func newRecord(model string) usage.Record {
+	return usage.Record{
+		TS:        time.Now(),
+		Provider:  "ollama",
+		ModelName: model,
+		Usage:     usage.UsageMetric{InputToken: 10, OutputToken: 5, TotalToken: 15},
+		Currency:  "USD",
+	}
+}
+
+// eventually waits for check to hold, failing the test after a while.
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if check() {
+			return
+		}
+	}
+
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestWriterBatches(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	// only a full batch or Close writes, the interval never passes
+	w := usage.NewWriter(db, nil, 16, 3, time.Hour)
+
+	for i := 0; i < 4; i++ {
+		if err := w.Write(ctx, newRecord("test-model")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	eventually(t, "a full batch", func() bool { return countUsages(t, db) == 3 })
+
+	time.Sleep(50 * time.Millisecond)
+	if count := countUsages(t, db); count != 3 {
+		t.Fatalf("wrote %d records before the batch was full, want 3", count)
+	}
+
+	if err := w.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count := countUsages(t, db); count != 4 {
+		t.Fatalf("close left %d records written, want 4", count)
+	}
+
+	if err := w.Write(ctx, newRecord("test-model")); !errors.Is(err, usage.ErrWriterClosed) {
+		t.Fatalf("writing after close: %v, want %v", err, usage.ErrWriterClosed)
+	}
+}
+
+func TestWriterFlushesEveryInterval(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	w := usage.NewWriter(db, nil, 16, 100, 20*time.Millisecond)
+	defer w.Close(ctx)
+
+	if err := w.Write(ctx, newRecord("test-model")); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "the interval flush", func() bool { return countUsages(t, db) == 1 })
+}
+
+func TestWriterBackpressure(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	spool, err := usage.OpenSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a closed database keeps the writer retrying its first batch while
+	// the one record buffer fills up
+	broken := openDB(t)
+	broken.Close()
+	w := usage.NewWriter(broken, spool, 1, 1, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if err := w.Write(ctx, newRecord("test-model")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := w.Write(timeout, newRecord("test-model")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("writing to a full buffer: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// close wakes a write waiting for room rather than waiting on it
+	blocked := make(chan error, 1)
+	go func() { blocked <- w.Write(ctx, newRecord("test-model")) }()
+	time.Sleep(20 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- w.Close(ctx) }()
+
+	select {
+	case err := <-blocked:
+		if !errors.Is(err, usage.ErrWriterClosed) {
+			t.Fatalf("blocked write: %v, want %v", err, usage.ErrWriterClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close did not wake a blocked write")
+	}
+
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	// what the database refused is replayed from the spool
+	if err := spool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Replay(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if count := countUsages(t, db); count != 2 {
+		t.Fatalf("replayed %d records, want the 2 buffered", count)
+	}
+}
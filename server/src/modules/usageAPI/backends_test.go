@@ -0,0 +1,332 @@
+package usageAPI_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/auth"
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/proxy"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/rollup"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/usage"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/usageAPI"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
+)
+
+const (
+	ADMIN_TOKEN = "test-admin-token"
+	REQUESTS    = 3
+
+	// each request costs 1000 input tokens at 1 and 500 output tokens at 2
+	// per million
+	REQUEST_COST = 0.002
+)
+
+func TestUsagePipelineOnSQLite(t *testing.T) {
+	testUsagePipeline(t, "file:"+filepath.Join(t.TempDir(), "inspectro.db"))
+}
+
+// TestUsagePipelineOnPostgres runs against INSPECTRO_TEST_POSTGRES_DSN, or
+// an embedded postgres fetched on first use.
+func TestUsagePipelineOnPostgres(t *testing.T) {
+	dsn := os.Getenv("INSPECTRO_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		if testing.Short() {
+			t.Skip("embedded postgres is skipped in short mode")
+		}
+
+		dsn = startPostgres(t)
+	}
+
+	testUsagePipeline(t, postgresSchema(t, dsn))
+}
+
+func startPostgres(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	dir := t.TempDir()
+	cache, _ := os.UserCacheDir()
+	config := embeddedpostgres.DefaultConfig().
+		Port(port).
+		RuntimePath(filepath.Join(dir, "runtime")).
+		DataPath(filepath.Join(dir, "data")).
+		CachePath(filepath.Join(cache, "inspectro", "embedded-postgres")).
+		Logger(&bytes.Buffer{})
+
+	postgres := embeddedpostgres.NewDatabase(config)
+	if err := postgres.Start(); err != nil {
+		t.Skipf("embedded postgres unavailable, set INSPECTRO_TEST_POSTGRES_DSN instead: %v", err)
+	}
+	t.Cleanup(func() { postgres.Stop() })
+
+	return config.GetConnectionURL() + "?sslmode=disable"
+}
+
+// postgresSchema creates a schema of its own for the test in the database
+// of dsn and returns a dsn using it.
+func postgresSchema(t *testing.T, dsn string) string {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	schema := fmt.Sprintf("inspectro_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if db, err := sql.Open("pgx", dsn); err == nil {
+			db.Exec("DROP SCHEMA " + schema + " CASCADE")
+			db.Close()
+		}
+	})
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+
+	return dsn + separator + "search_path=" + schema
+}
+
+// testUsagePipeline migrates the database of dsn, logs usage through the
+// proxy, and reads, rolls up and reprices it through the api.
+func testUsagePipeline(t *testing.T, dsn string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer watcher.Wait()
+	defer cancel()
+
+	// migrating twice leaves the schema as it is
+	for i := 0; i < 2; i++ {
+		db, err := database.OpenDB(dsn)
+		if err != nil {
+			t.Fatalf("migrating: %v", err)
+		}
+		db.Close()
+	}
+
+	db, err := database.OpenDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"hi"}}],"usage":{"prompt_tokens":1000,"completion_tokens":500,"total_tokens":1500}}`)
+	}))
+	defer upstreamServer.Close()
+
+	configPath := filepath.Join(t.TempDir(), "llm.yaml")
+	config := fmt.Sprintf(`providers:
+  - name: ollama
+    apiBase: %s
+    apiKey: upstream-key
+models:
+  - name: test-model
+    provider: ollama
+    costPerMillionInputToken: 1
+    costPerMillionOutputToken: 2
+`, upstreamServer.URL)
+	if err := os.WriteFile(configPath, []byte(config), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := watcher.SyncLLM(ctx, db, configPath); err != nil {
+		t.Fatalf("syncing llm.yaml: %v", err)
+	}
+
+	if err := usage.Start(db, t.TempDir(), 16, 16, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	proxyHandler := proxy.ProxyRequest(db, true, "/proxy")
+	for i := 0; i < REQUESTS; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/proxy/v1/chat/completions",
+			strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hello"}]}`))
+		rec := httptest.NewRecorder()
+		proxyHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("proxying: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	if err := usage.Wait(ctx); err != nil {
+		t.Fatalf("writing usage: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/usage", usageAPI.DoGetLLMUsage(db))
+	mux.HandleFunc("POST /api/usage/recompute", auth.RequireAdmin(usageAPI.DoRecomputeLLMUsage(db)))
+	api := auth.Middleware(db, ADMIN_TOKEN, mux)
+
+	now := time.Now()
+	day := fmt.Sprintf("startTS=%d&endTS=%d", now.Add(-24*time.Hour).Unix(), now.Add(time.Minute).Unix())
+	quarter := fmt.Sprintf("startTS=%d&endTS=%d", now.Add(-90*24*time.Hour).Unix(), now.Add(time.Minute).Unix())
+
+	checkSpending(t, api, day, REQUESTS*REQUEST_COST)
+
+	// old enough to be rolled up
+	if _, err := db.ExecContext(ctx, "UPDATE llm_usages SET ts = "+placeholder(1), utils.FormatDatetime(now.Add(-2*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	rolled, err := rollup.Run(ctx, db)
+	if err != nil {
+		t.Fatalf("rolling up: %v", err)
+	}
+	if rolled != REQUESTS {
+		t.Fatalf("rolled up %d rows, want %d", rolled, REQUESTS)
+	}
+
+	// a long range reads the daily rollup
+	checkSpending(t, api, quarter, REQUESTS*REQUEST_COST)
+
+	report, _, err := usageAPI.GetUsageReport(ctx, db, uint64(now.Add(-90*24*time.Hour).Unix()), uint64(now.Unix()), usageAPI.Scope{}, "")
+	if err != nil {
+		t.Fatalf("reporting: %v", err)
+	}
+	if len(report) != 1 || report[0].Requests != REQUESTS || report[0].TotalToken != REQUESTS*1500 {
+		t.Fatalf("report %+v, want %d requests of 1500 tokens", report, REQUESTS)
+	}
+
+	// a new base price applies from now on, what was logged keeps its price
+	if err := watcher.UpdateLLM(ctx, db, func(llms *watcher.LLMModels) error {
+		llms.Models[0].CostPerMillionInputTokens = 10
+		llms.Models[0].CostPerMillionOutputTokens = 20
+		return nil
+	}); err != nil {
+		t.Fatalf("changing the base price: %v", err)
+	}
+
+	recompute(t, api, day)
+	checkSpending(t, api, day, REQUESTS*REQUEST_COST)
+
+	// a price from before the requests doubles what they cost
+	if err := watcher.UpdateLLM(ctx, db, func(llms *watcher.LLMModels) error {
+		llms.Models[0].Prices = append(llms.Models[0].Prices, entities.LLMPrice{
+			ValidFrom: now.Add(-3 * time.Hour).Truncate(time.Second),
+			LLMCost: entities.LLMCost{LLMTokenCost: entities.LLMTokenCost{
+				CostPerMillionInputTokens:  2,
+				CostPerMillionOutputTokens: 4,
+			}},
+		})
+		return nil
+	}); err != nil {
+		t.Fatalf("adding a price: %v", err)
+	}
+
+	if updated := recompute(t, api, day); updated != REQUESTS {
+		t.Fatalf("recomputed %d rows, want %d", updated, REQUESTS)
+	}
+
+	checkSpending(t, api, day, 2*REQUESTS*REQUEST_COST)
+	checkSpending(t, api, quarter, 2*REQUESTS*REQUEST_COST)
+
+	// ranges longer than a batch are repriced batch by batch
+	for i := 0; i < usageAPI.RECOMPUTE_BATCH; i++ {
+		if _, err := db.ExecContext(ctx, "INSERT INTO llm_usages (provider, model_name, input_token, output_token, total_token, currency, ts) VALUES ('ollama', 'test-model', 1000, 500, 1500, 'USD', "+placeholder(1)+")",
+			utils.FormatDatetime(now.Add(-time.Hour))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// rows keep the currency they were billed in when the provider changes
+	if err := watcher.UpdateLLM(ctx, db, func(llms *watcher.LLMModels) error {
+		llms.Providers[0].Currency = "EUR"
+		llms.Currency.Rates = map[string]float64{"EUR": 0.9}
+		return nil
+	}); err != nil {
+		t.Fatalf("changing the provider currency: %v", err)
+	}
+
+	if updated := recompute(t, api, day); updated != REQUESTS+usageAPI.RECOMPUTE_BATCH {
+		t.Fatalf("recomputed %d rows, want %d", updated, REQUESTS+usageAPI.RECOMPUTE_BATCH)
+	}
+
+	var currencies int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM llm_usages WHERE currency <> 'USD'").Scan(&currencies); err != nil {
+		t.Fatal(err)
+	}
+	if currencies != 0 {
+		t.Fatalf("recomputing moved %d rows to the new provider currency", currencies)
+	}
+}
+
+// placeholder returns the n-th bound argument in the dialect of the current
+// backend.
+func placeholder(n int) string {
+	if database.Current().Name() == "postgres" {
+		return fmt.Sprintf("$%d", n)
+	}
+
+	return "?"
+}
+
+// recompute reprices the usage of the range in query and returns how many
+// rows changed.
+func recompute(t *testing.T, api http.Handler, query string) int64 {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/usage/recompute?"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+ADMIN_TOKEN)
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("recomputing: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var recomputed usageAPI.RecomputeResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &recomputed); err != nil {
+		t.Fatal(err)
+	}
+
+	return recomputed.Updated
+}
+
+// checkSpending gets /api/usage for query and checks what the range cost.
+func checkSpending(t *testing.T, api http.Handler, query string, want float64) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/usage?"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+ADMIN_TOKEN)
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("getting usage: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var response usageAPI.UsageResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if math.Abs(response.CurrrentSpending.Money-want) > 1e-9 {
+		t.Fatalf("range cost %v, want %v", response.CurrrentSpending.Money, want)
+	}
+	if math.Abs(response.AllTimeSpending.Money-want) > 1e-9 {
+		t.Fatalf("all time cost %v, want %v", response.AllTimeSpending.Money, want)
+	}
+}
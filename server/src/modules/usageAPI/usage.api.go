@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/auth"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/currency"
 	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
 )
 
@@ -17,11 +20,19 @@ type LLMUsageResponse struct {
 }
 
 type UsageResponse struct {
+	Currency         string             `json:"currency"`
 	AllTimeSpending  Spending           `json:"all_time_spending"`
 	CurrrentSpending Spending           `json:"current_spending"`
 	Usages           []LLMUsageResponse `json:"usages"`
 }
 
+// withoutModel drops fields already present on the LLMUsageResponse group.
+func withoutModel(usage entities.LLMUsage) entities.LLMUsage {
+	usage.Provider = ""
+	usage.ModelName = ""
+	return usage
+}
+
 func groupLLMUsageData(data []entities.LLMUsage) ([]LLMUsageResponse, error) {
 	groupedData := make(map[string]*LLMUsageResponse)
 
@@ -34,28 +45,12 @@ func groupLLMUsageData(data []entities.LLMUsage) ([]LLMUsageResponse, error) {
 				ModelName: item.ModelName,
 				Usages:    make([]entities.LLMUsage, 0),
 			}
-			curr.Usages = append(curr.Usages, entities.LLMUsage{
-				InputToken:      item.InputToken,
-				OutputToken:     item.OutputToken,
-				TotalToken:      item.TotalToken,
-				InputTokenCost:  item.InputTokenCost,
-				OutputTokenCost: item.OutputTokenCost,
-				TotalTokenCost:  item.TotalTokenCost,
-				TS:              item.TS,
-			})
+			curr.Usages = append(curr.Usages, withoutModel(item))
 
 			groupedData[key] = &curr
 
 		} else {
-			appendedUsages := append(existing.Usages, entities.LLMUsage{
-				InputToken:      item.InputToken,
-				OutputToken:     item.OutputToken,
-				TotalToken:      item.TotalToken,
-				InputTokenCost:  item.InputTokenCost,
-				OutputTokenCost: item.OutputTokenCost,
-				TotalTokenCost:  item.TotalTokenCost,
-				TS:              item.TS,
-			})
+			appendedUsages := append(existing.Usages, withoutModel(item))
 
 			existing.Usages = appendedUsages
 		}
@@ -69,36 +64,93 @@ func groupLLMUsageData(data []entities.LLMUsage) ([]LLMUsageResponse, error) {
 	return responses, nil
 }
 
+// convertLLMUsage converts every cost of usages from their billing currency
+// into target, in place.
+func convertLLMUsage(usages []entities.LLMUsage, rates currency.Rates, target string) error {
+	for i := range usages {
+		usage := &usages[i]
+		for _, cost := range []*float64{
+			&usage.InputTokenCost,
+			&usage.OutputTokenCost,
+			&usage.TotalTokenCost,
+			&usage.ImageCost,
+			&usage.AudioCost,
+			&usage.CostPerMillionInputToken,
+			&usage.CostPerMillionOutputToken,
+		} {
+			converted, err := rates.Convert(*cost, usage.BillingCurrency, target)
+			if err != nil {
+				return err
+			}
+			*cost = converted
+		}
+	}
+
+	return nil
+}
+
+func parseTSRange(query url.Values) (uint64, uint64, error) {
+	startTS, ok := query["startTS"]
+	if !ok {
+		return 0, 0, fmt.Errorf("startTS not found")
+	}
+
+	endTS, ok := query["endTS"]
+	if !ok {
+		return 0, 0, fmt.Errorf("endTS not found")
+	}
+
+	cvtStartTS, err := strconv.ParseUint(startTS[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed parsing startTS: %v", err)
+	}
+
+	cvtEndTS, err := strconv.ParseUint(endTS[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed parsing endTS: %v", err)
+	}
+
+	return cvtStartTS, cvtEndTS, nil
+}
+
 func DoGetLLMUsage(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query()
-
-		startTS, ok := query["startTS"]
-		if !ok {
-			http.Error(w, "startTS not found", http.StatusBadRequest)
+		cvtStartTS, cvtEndTS, err := parseTSRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		endTS, ok := query["endTS"]
-		if !ok {
-			http.Error(w, "endTS not found", http.StatusBadRequest)
+		rates, err := currency.LoadRates(r.Context(), db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		cvtStartTS, err := strconv.ParseUint(startTS[0], 10, 64)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed parsing startTS: %v", err), http.StatusBadRequest)
+		target := rates.Reporting
+		if requested := r.URL.Query().Get("currency"); requested != "" {
+			target = currency.Normalize(requested)
+			if _, ok := rates.Rates[target]; !ok {
+				http.Error(w, fmt.Sprintf("no exchange rate for %s", target), http.StatusBadRequest)
+				return
+			}
+		}
+
+		team, ok := auth.TeamScope(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
 
-		cvtEndTS, err := strconv.ParseUint(endTS[0], 10, 64)
+		scope := Scope{Team: team, Project: r.URL.Query().Get("project")}
+
+		llmUsageData, err := GetRolledLLMUsage(r.Context(), db, cvtStartTS, cvtEndTS, scope)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed parsing endTS: %v", err), http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		llmUsageData, err := getLLMUsage(r.Context(), db, cvtStartTS, cvtEndTS)
-		if err != nil {
+		if err := convertLLMUsage(llmUsageData, rates, target); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -108,13 +160,13 @@ func DoGetLLMUsage(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		allTimeSpending, err := getAlltimeSpending(r.Context(), db)
+		allTimeSpending, err := getAlltimeSpending(r.Context(), db, scope, rates, target)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		currentSpending, err := getDateRangeSpending(r.Context(), db, cvtStartTS, cvtEndTS)
+		currentSpending, err := getDateRangeSpending(r.Context(), db, cvtStartTS, cvtEndTS, scope, rates, target)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -127,6 +179,7 @@ func DoGetLLMUsage(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
 		}
 
 		llmResponse := &UsageResponse{
+			Currency:         target,
 			AllTimeSpending:  allTimeSpending,
 			CurrrentSpending: currentSpending,
 			Usages:           llmUsages,
@@ -137,3 +190,29 @@ func DoGetLLMUsage(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
 		json.NewEncoder(w).Encode(llmResponse)
 	}
 }
+
+type RecomputeResponse struct {
+	Updated int64 `json:"updated"`
+}
+
+// DoRecomputeLLMUsage reprices usages between startTS and endTS with the
+// model prices that were in effect at the time of each usage.
+func DoRecomputeLLMUsage(db *sql.DB) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cvtStartTS, cvtEndTS, err := parseTSRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		updated, err := recomputeLLMUsageCost(r.Context(), db, cvtStartTS, cvtEndTS)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(RecomputeResponse{Updated: updated})
+	}
+}
@@ -3,9 +3,17 @@ package usageAPI
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/currency"
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
 	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/rollup"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/usage"
 	"github.com/leporo/sqlf"
 )
 
@@ -14,96 +22,681 @@ type Spending struct {
 	Token float64 `json:"token"`
 }
 
-func getLLMUsage(ctx context.Context, db *sql.DB, startTS uint64, endTS uint64) ([]entities.LLMUsage, error) {
-	query := sqlf.
-		From("llm_usages as lu").
-		OrderBy("lu.ts ASC").
-		Where("datetime(?, 'unixepoch') <= ts", startTS).
-		Where("datetime(?, 'unixepoch') >= ts", endTS).
-		Select("lu.provider").
+// Scope limits usage to a team and a project, empty fields keep all usage.
+type Scope struct {
+	Team    string
+	Project string
+}
+
+func scopeUsage(query *sqlf.Stmt, scope Scope) *sqlf.Stmt {
+	if scope.Team != "" {
+		query.Where("lu.team_name = ?", scope.Team)
+	}
+	if scope.Project != "" {
+		query.Where("lu.project_name = ?", scope.Project)
+	}
+
+	return query
+}
+
+// inRange limits query to usage between the unix timestamps startTS and
+// endTS.
+func inRange(query *sqlf.Stmt, startTS uint64, endTS uint64) *sqlf.Stmt {
+	unixTime := database.Current().UnixTime()
+
+	return query.
+		Where(unixTime+" <= lu.ts", startTS).
+		Where(unixTime+" >= lu.ts", endTS)
+}
+
+// usageSource is a table usage is read from, aliased as lu.
+type usageSource struct {
+	table    string
+	rolled   bool // a rollup, each row sums the usage of a bucket
+	unrolled bool // only rows of llm_usages not summed into the rollups yet
+}
+
+func (s usageSource) from() *sqlf.Stmt {
+	query := sqlf.From(s.table + " as lu")
+	if s.unrolled {
+		query.Where("lu.rolled = FALSE")
+	}
+
+	return query
+}
+
+// requests is the expression counting the requests of grouped rows.
+func (s usageSource) requests() string {
+	if s.rolled {
+		return sumInt("lu.requests")
+	}
+
+	return "COUNT(*)"
+}
+
+// currencyColumn is the billing currency of a usage row. It binds no
+// argument, so grouping by it matches the selected expression on postgres.
+var currencyColumn = "COALESCE(lu.currency, '" + currency.DEFAULT_CURRENCY + "')"
+
+// sumInt sums an integer column as an integer, postgres sums BIGINT columns
+// into NUMERIC.
+func sumInt(column string) string {
+	return "CAST(COALESCE(SUM(" + column + "), 0) AS BIGINT)"
+}
+
+var rawUsage = []usageSource{{table: "llm_usages"}}
+
+// usageSources returns where usage of table is read from. A rollup misses
+// the rows not summed into it yet, those are read from llm_usages on top.
+func usageSources(table string) []usageSource {
+	if table == "llm_usages" {
+		return rawUsage
+	}
+
+	return []usageSource{
+		{table: table, rolled: true},
+		{table: "llm_usages", unrolled: true},
+	}
+}
+
+// rangeSources returns where usage between the unix timestamps startTS and
+// endTS is read from, see rollup.Table.
+func rangeSources(startTS uint64, endTS uint64) []usageSource {
+	return usageSources(rollup.Table(time.Unix(int64(startTS), 0), time.Unix(int64(endTS), 0)))
+}
+
+// GetLLMUsage returns every usage row between startTS and endTS.
+func GetLLMUsage(ctx context.Context, db *sql.DB, startTS uint64, endTS uint64, scope Scope) ([]entities.LLMUsage, error) {
+	return getLLMUsage(ctx, db, rawUsage, startTS, endTS, scope)
+}
+
+// GetRolledLLMUsage returns usage between startTS and endTS, summed per hour
+// or per day when the range is long.
+func GetRolledLLMUsage(ctx context.Context, db *sql.DB, startTS uint64, endTS uint64, scope Scope) ([]entities.LLMUsage, error) {
+	return getLLMUsage(ctx, db, rangeSources(startTS, endTS), startTS, endTS, scope)
+}
+
+func getLLMUsage(ctx context.Context, db *sql.DB, sources []usageSource, startTS uint64, endTS uint64, scope Scope) ([]entities.LLMUsage, error) {
+	llmUsages := make([]entities.LLMUsage, 0)
+
+	for _, source := range sources {
+		query := source.from().
+			OrderBy("lu.ts ASC").
+			Select("lu.provider").
+			Select("lu.model_name").
+			Select("lu.input_token").
+			Select("lu.output_token").
+			Select("lu.total_token").
+			Select("lu.input_token_cost").
+			Select("lu.output_token_cost").
+			Select("lu.total_token_cost").
+			Select("lu.ts").
+			Select("COALESCE(lu.cached_input_token, 0)").
+			Select("COALESCE(lu.cache_write_token, 0)").
+			Select("COALESCE(lu.reasoning_token, 0)").
+			Select("COALESCE(lu.image_count, 0)").
+			Select("COALESCE(lu.audio_seconds, 0)").
+			Select("COALESCE(lu.image_cost, 0)").
+			Select("COALESCE(lu.audio_cost, 0)")
+		if source.rolled {
+			// prices differ within a bucket
+			query.
+				Select("0").
+				Select("0").
+				Select("lu.requests").
+				Select("FALSE").
+				Select("FALSE")
+		} else {
+			query.
+				Select("COALESCE(lu.cost_per_million_input_token, 0)").
+				Select("COALESCE(lu.cost_per_million_output_token, 0)").
+				Select("1").
+				Select("COALESCE(lu.cancelled, FALSE)").
+				Select("COALESCE(lu.estimated, FALSE)")
+		}
+		query.
+			Select("COALESCE(lu.currency, ?)", currency.DEFAULT_CURRENCY).
+			Select("COALESCE(lu.key_name, '')").
+			Select("COALESCE(lu.team_name, '')").
+			Select("COALESCE(lu.project_name, '')")
+		inRange(query, startTS, endTS)
+		scopeUsage(query, scope)
+
+		sql, args := query.String(), query.Args()
+		rows, err := db.QueryContext(ctx, sql, args...)
+		if err != nil {
+			return llmUsages, fmt.Errorf("error querying llm usage: %v", err)
+		}
+
+		for rows.Next() {
+			var llmUsage entities.LLMUsage
+			if err := rows.Scan(
+				&llmUsage.Provider,
+				&llmUsage.ModelName,
+				&llmUsage.InputToken,
+				&llmUsage.OutputToken,
+				&llmUsage.TotalToken,
+				&llmUsage.InputTokenCost,
+				&llmUsage.OutputTokenCost,
+				&llmUsage.TotalTokenCost,
+				&llmUsage.TS,
+				&llmUsage.CachedInputToken,
+				&llmUsage.CacheWriteToken,
+				&llmUsage.ReasoningToken,
+				&llmUsage.ImageCount,
+				&llmUsage.AudioSeconds,
+				&llmUsage.ImageCost,
+				&llmUsage.AudioCost,
+				&llmUsage.CostPerMillionInputToken,
+				&llmUsage.CostPerMillionOutputToken,
+				&llmUsage.Requests,
+				&llmUsage.Cancelled,
+				&llmUsage.Estimated,
+				&llmUsage.BillingCurrency,
+				&llmUsage.KeyName,
+				&llmUsage.TeamName,
+				&llmUsage.ProjectName,
+			); err != nil {
+				panic(err)
+			}
+			llmUsages = append(llmUsages, llmUsage)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return llmUsages, fmt.Errorf("error querying llm: %v", err)
+		}
+	}
+
+	if len(sources) > 1 {
+		sort.SliceStable(llmUsages, func(i, j int) bool {
+			return llmUsages[i].TS.Before(llmUsages[j].TS)
+		})
+	}
+
+	return llmUsages, nil
+}
+
+// sumSpending adds up spending per billing currency, converted into target.
+func sumSpending(ctx context.Context, db *sql.DB, query *sqlf.Stmt, rates currency.Rates, target string) (Spending, error) {
+	var spending Spending
+
+	query.
+		Select(currencyColumn).
+		Select("COALESCE(SUM(lu.total_token_cost), 0)").
+		Select(sumInt("lu.total_token")).
+		GroupBy(currencyColumn)
+
+	sql, args := query.String(), query.Args()
+
+	rows, err := db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return spending, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var billingCurrency string
+		var money, token float64
+		if err := rows.Scan(&billingCurrency, &money, &token); err != nil {
+			return spending, err
+		}
+
+		converted, err := rates.Convert(money, billingCurrency, target)
+		if err != nil {
+			return spending, err
+		}
+
+		spending.Money += converted
+		spending.Token += token
+	}
+	if err := rows.Err(); err != nil {
+		return spending, err
+	}
+
+	return spending, nil
+}
+
+// sumSourcesSpending adds up the spending of every source, build narrows
+// the query of each.
+func sumSourcesSpending(ctx context.Context, db *sql.DB, sources []usageSource, build func(query *sqlf.Stmt), rates currency.Rates, target string) (Spending, error) {
+	var spending Spending
+
+	for _, source := range sources {
+		query := source.from()
+		build(query)
+
+		sourceSpending, err := sumSpending(ctx, db, query, rates, target)
+		if err != nil {
+			return spending, err
+		}
+
+		spending.Money += sourceSpending.Money
+		spending.Token += sourceSpending.Token
+	}
+
+	return spending, nil
+}
+
+// getAlltimeSpending reads the daily rollup, raw usage may be pruned.
+func getAlltimeSpending(ctx context.Context, db *sql.DB, scope Scope, rates currency.Rates, target string) (Spending, error) {
+	return sumSourcesSpending(ctx, db, usageSources(rollup.DAILY_TABLE), func(query *sqlf.Stmt) {
+		scopeUsage(query, scope)
+	}, rates, target)
+}
+
+func getDateRangeSpending(ctx context.Context, db *sql.DB, startTS uint64, endTS uint64, scope Scope, rates currency.Rates, target string) (Spending, error) {
+	return sumSourcesSpending(ctx, db, rangeSources(startTS, endTS), func(query *sqlf.Stmt) {
+		inRange(query, startTS, endTS)
+		scopeUsage(query, scope)
+	}, rates, target)
+}
+
+// GetSpending returns what scope spent between startTS and endTS, converted
+// into target.
+func GetSpending(ctx context.Context, db *sql.DB, startTS uint64, endTS uint64, scope Scope, rates currency.Rates, target string) (Spending, error) {
+	return getDateRangeSpending(ctx, db, startTS, endTS, scope, rates, target)
+}
+
+// RECOMPUTE_BATCH is the most llm_usages rows repriced per transaction.
+const RECOMPUTE_BATCH = 500
+
+type llmPrice struct {
+	ValidFrom time.Time
+	Cost      entities.LLMCost
+}
+
+type llmUsageMetric struct {
+	RowID     int64
+	ModelName string
+	TS        time.Time
+	Metric    usage.UsageMetric
+	IsRolled  bool         // summed into the rollups already
+	Rolled    rollup.Usage // as summed into the rollups before repricing
+}
+
+// getLLMPrices returns every known price per model, oldest first.
+func getLLMPrices(ctx context.Context, conn *sql.Conn) (map[string][]llmPrice, error) {
+	query := sqlf.From("llm_prices as p").
+		Join("llms as l", "l.name = p.model_name").
+		OrderBy("p.model_name ASC").
+		OrderBy("p.validFrom ASC").
+		Select("p.model_name").
+		Select("p.validFrom").
+		Select("p.cost")
+
+	prices := make(map[string][]llmPrice)
+
+	rows, err := conn.QueryContext(ctx, query.String(), query.Args()...)
+	if err != nil {
+		return prices, fmt.Errorf("error querying llm price: %v", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var modelName, cost string
+		var price llmPrice
+		if err := rows.Scan(&modelName, &price.ValidFrom, &cost); err != nil {
+			return prices, fmt.Errorf("error querying llm price: %v", err)
+		}
+
+		if err := json.Unmarshal([]byte(cost), &price.Cost); err != nil {
+			return prices, fmt.Errorf("error decoding llm price of %s: %v", modelName, err)
+		}
+
+		prices[modelName] = append(prices[modelName], price)
+	}
+	if err := rows.Err(); err != nil {
+		return prices, fmt.Errorf("error querying llm price: %v", err)
+	}
+
+	return prices, nil
+}
+
+// getLLMUsageMetrics returns the next RECOMPUTE_BATCH usage rows between
+// startTS and endTS after the row afterRowID.
+func getLLMUsageMetrics(ctx context.Context, conn *sql.Conn, startTS uint64, endTS uint64, afterRowID int64) ([]llmUsageMetric, error) {
+	rowID, _ := database.Current().RowID()
+
+	query := sqlf.From("llm_usages as lu").
+		Select("lu."+rowID).
 		Select("lu.model_name").
+		Select("lu.ts").
+		Select("COALESCE(lu.rolled, FALSE)").
 		Select("lu.input_token").
 		Select("lu.output_token").
 		Select("lu.total_token").
-		Select("lu.input_token_cost").
-		Select("lu.output_token_cost").
-		Select("lu.total_token_cost").
-		Select("lu.ts")
+		Select("COALESCE(lu.cached_input_token, 0)").
+		Select("COALESCE(lu.cache_write_token, 0)").
+		Select("COALESCE(lu.reasoning_token, 0)").
+		Select("COALESCE(lu.image_count, 0)").
+		Select("COALESCE(lu.audio_seconds, 0)").
+		Select("COALESCE(lu.provider, '')").
+		Select("COALESCE(lu.currency, ?)", currency.DEFAULT_CURRENCY).
+		Select("COALESCE(lu.key_name, '')").
+		Select("COALESCE(lu.team_name, '')").
+		Select("COALESCE(lu.project_name, '')").
+		Select("COALESCE(lu.input_token_cost, 0)").
+		Select("COALESCE(lu.output_token_cost, 0)").
+		Select("COALESCE(lu.image_cost, 0)").
+		Select("COALESCE(lu.audio_cost, 0)").
+		Select("COALESCE(lu.total_token_cost, 0)").
+		Where("lu."+rowID+" > ?", afterRowID).
+		OrderBy("lu." + rowID + " ASC").
+		Limit(RECOMPUTE_BATCH)
+	inRange(query, startTS, endTS)
 
-	llmUsages := make([]entities.LLMUsage, 0)
+	metrics := make([]llmUsageMetric, 0)
 
-	sql, args := query.String(), query.Args()
-	rows, err := db.QueryContext(ctx, sql, args...)
+	rows, err := conn.QueryContext(ctx, query.String(), query.Args()...)
 	if err != nil {
-		return llmUsages, fmt.Errorf("error querying llm usage: %v", err)
+		return metrics, fmt.Errorf("error querying llm usage: %v", err)
 	}
 
 	defer rows.Close()
 
 	for rows.Next() {
-		var llmUsage entities.LLMUsage
+		var metric llmUsageMetric
 		if err := rows.Scan(
-			&llmUsage.Provider,
-			&llmUsage.ModelName,
-			&llmUsage.InputToken,
-			&llmUsage.OutputToken,
-			&llmUsage.TotalToken,
-			&llmUsage.InputTokenCost,
-			&llmUsage.OutputTokenCost,
-			&llmUsage.TotalTokenCost,
-			&llmUsage.TS,
+			&metric.RowID,
+			&metric.ModelName,
+			&metric.TS,
+			&metric.IsRolled,
+			&metric.Metric.InputToken,
+			&metric.Metric.OutputToken,
+			&metric.Metric.TotalToken,
+			&metric.Metric.CachedInputToken,
+			&metric.Metric.CacheWriteToken,
+			&metric.Metric.ReasoningToken,
+			&metric.Metric.ImageCount,
+			&metric.Metric.AudioSeconds,
+			&metric.Rolled.Provider,
+			&metric.Rolled.Currency,
+			&metric.Rolled.KeyName,
+			&metric.Rolled.TeamName,
+			&metric.Rolled.ProjectName,
+			&metric.Rolled.InputTokenCost,
+			&metric.Rolled.OutputTokenCost,
+			&metric.Rolled.ImageCost,
+			&metric.Rolled.AudioCost,
+			&metric.Rolled.TotalTokenCost,
 		); err != nil {
-			panic(err)
+			return metrics, fmt.Errorf("error querying llm usage: %v", err)
 		}
-		llmUsages = append(llmUsages, llmUsage)
+		metric.Rolled.TS = metric.TS
+		metric.Rolled.ModelName = metric.ModelName
+		metric.Rolled.Currency = currency.Normalize(metric.Rolled.Currency)
+		metric.Rolled.Totals = rollupTotals(metric.Metric, metric.Rolled.Totals)
+		metrics = append(metrics, metric)
 	}
 	if err := rows.Err(); err != nil {
-		return llmUsages, fmt.Errorf("error querying llm: %v", err)
+		return metrics, fmt.Errorf("error querying llm usage: %v", err)
 	}
 
-	return llmUsages, nil
+	return metrics, nil
 }
 
-func getAlltimeSpending(ctx context.Context, db *sql.DB) (Spending, error) {
-	var spending Spending
-	query := sqlf.From("llm_usages as lu").
-		Select("SUM(lu.total_token_cost) AS money").
-		Select("SUM(lu.total_token) AS token").
-		Limit(1)
+// rollupTotals counts metric as one request costing what cost holds.
+func rollupTotals(metric usage.UsageMetric, cost rollup.Totals) rollup.Totals {
+	cost.Requests = 1
+	cost.InputToken = metric.InputToken
+	cost.OutputToken = metric.OutputToken
+	cost.TotalToken = metric.TotalToken
+	cost.CachedInputToken = metric.CachedInputToken
+	cost.CacheWriteToken = metric.CacheWriteToken
+	cost.ReasoningToken = metric.ReasoningToken
+	cost.ImageCount = metric.ImageCount
+	cost.AudioSeconds = metric.AudioSeconds
 
-	sql, args := query.String(), query.Args()
+	return cost
+}
 
-	row := db.QueryRowContext(ctx, sql, args...)
-	err := row.Scan(
-		&spending.Money,
-		&spending.Token,
-	)
+// priceAt returns the last price that became valid at or before ts.
+func priceAt(prices []llmPrice, ts time.Time) (llmPrice, bool) {
+	var found llmPrice
+	ok := false
+
+	for _, price := range prices {
+		if price.ValidFrom.After(ts) {
+			break
+		}
+
+		found = price
+		ok = true
+	}
+
+	return found, ok
+}
+
+// recomputeLLMUsageCost reprices usage between startTS and endTS under
+// ROLLUP_LOCK, so no row is rolled up at its old cost meanwhile.
+func recomputeLLMUsageCost(ctx context.Context, db *sql.DB, startTS uint64, endTS uint64) (int64, error) {
+	var updated int64
+	err := database.Locked(ctx, db, database.ROLLUP_LOCK, func(ctx context.Context, conn *sql.Conn) error {
+		var err error
+		updated, err = recomputeLLMUsageCostLocked(ctx, conn, startTS, endTS)
+		return err
+	})
+
+	return updated, err
+}
+
+func recomputeLLMUsageCostLocked(ctx context.Context, conn *sql.Conn, startTS uint64, endTS uint64) (int64, error) {
+	prices, err := getLLMPrices(ctx, conn)
 	if err != nil {
-		return spending, err
+		return 0, err
 	}
 
-	return spending, nil
+	var updated, afterRowID int64
+	for {
+		metrics, err := getLLMUsageMetrics(ctx, conn, startTS, endTS, afterRowID)
+		if err != nil {
+			return updated, err
+		}
+
+		repriced, err := recomputeBatch(ctx, conn, prices, metrics)
+		updated += repriced
+		if err != nil || len(metrics) < RECOMPUTE_BATCH {
+			return updated, err
+		}
+
+		afterRowID = metrics[len(metrics)-1].RowID
+	}
 }
 
-func getDateRangeSpending(ctx context.Context, db *sql.DB, startTS uint64, endTS uint64) (Spending, error) {
-	var spending Spending
-	query := sqlf.From("llm_usages as lu").
-		Where("datetime(?, 'unixepoch') <= ts", startTS).
-		Where("datetime(?, 'unixepoch') >= ts", endTS).
-		Select("SUM(lu.total_token_cost) AS money").
-		Select("SUM(lu.total_token) AS token").
-		Limit(1)
+// recomputeBatch reprices metrics at the prices in effect when each was
+// logged, in one UPDATE. Rows keep the currency they were billed in.
+func recomputeBatch(ctx context.Context, conn *sql.Conn, prices map[string][]llmPrice, metrics []llmUsageMetric) (int64, error) {
+	rowID, _ := database.Current().RowID()
 
-	sql, args := query.String(), query.Args()
+	columns := []string{
+		"input_token_cost", "output_token_cost", "image_cost", "audio_cost", "total_token_cost",
+		"cost_per_million_input_token", "cost_per_million_output_token", "price_snapshot",
+	}
+	cases := make([][]any, len(columns))
+	rowIDs := make([]any, 0, len(metrics))
+
+	// rows already summed into the rollups are moved there from their old
+	// cost to the new one
+	var rolled []rollup.Usage
+
+	for _, metric := range metrics {
+		price, ok := priceAt(prices[metric.ModelName], metric.TS)
+		if !ok {
+			continue // model no longer configured, keep what was logged
+		}
 
-	row := db.QueryRowContext(ctx, sql, args...)
-	err := row.Scan(
-		&spending.Money,
-		&spending.Token,
-	)
+		priceSnapshot, err := json.Marshal(price.Cost)
+		if err != nil {
+			return 0, fmt.Errorf("error recomputing llm usage: %w", err)
+		}
+
+		cost := metric.Metric.Cost(price.Cost)
+
+		values := []any{
+			cost.InputTokenCost, cost.OutputTokenCost, cost.ImageCost, cost.AudioCost, cost.TotalCost,
+			cost.TokenCost.CostPerMillionInputTokens, cost.TokenCost.CostPerMillionOutputTokens, string(priceSnapshot),
+		}
+		for i, value := range values {
+			cases[i] = append(cases[i], metric.RowID, value)
+		}
+		rowIDs = append(rowIDs, metric.RowID)
+
+		if metric.IsRolled {
+			repriced := metric.Rolled
+			repriced.Totals = rollupTotals(metric.Metric, rollup.Totals{
+				InputTokenCost:  cost.InputTokenCost,
+				OutputTokenCost: cost.OutputTokenCost,
+				ImageCost:       cost.ImageCost,
+				AudioCost:       cost.AudioCost,
+				TotalTokenCost:  cost.TotalCost,
+			})
+
+			previous := metric.Rolled
+			previous.Totals = previous.Totals.Negate()
+
+			rolled = append(rolled, previous, repriced)
+		}
+	}
+
+	if len(rowIDs) == 0 {
+		return 0, nil
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
 	if err != nil {
-		return spending, err
+		return 0, fmt.Errorf("error recomputing llm usage: %w", err)
 	}
+	defer tx.Rollback()
 
-	return spending, nil
+	// each column is set per row through CASE, the casts type the bound
+	// values for postgres
+	query := sqlf.Update("llm_usages")
+	for i, column := range columns {
+		valueType := "FLOAT"
+		if column == "price_snapshot" {
+			valueType = "TEXT"
+		}
+
+		expr := "CASE " + rowID + strings.Repeat(" WHEN ? THEN CAST(? AS "+valueType+")", len(rowIDs)) + " END"
+		query.SetExpr(column, expr, cases[i]...)
+	}
+	query.Where(rowID).In(rowIDs...)
+
+	if _, err := query.Exec(ctx, tx); err != nil {
+		return 0, fmt.Errorf("error recomputing llm usage: %w", err)
+	}
+
+	if err := rollup.Add(ctx, tx, rolled); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error recomputing llm usage: %w", err)
+	}
+
+	return int64(len(rowIDs)), nil
+}
+
+type ReportRow struct {
+	Provider    string  `json:"provider"`
+	ModelName   string  `json:"model_name"`
+	Requests    int     `json:"requests"`
+	InputToken  int     `json:"input_token"`
+	OutputToken int     `json:"output_token"`
+	TotalToken  int     `json:"total_token"`
+	Cost        float64 `json:"cost"`
+}
+
+// GetUsageReport sums usage between startTS and endTS per model, with costs
+// converted into target, or into the reporting currency when target is
+// empty. It returns the currency costs are in.
+func GetUsageReport(ctx context.Context, db *sql.DB, startTS uint64, endTS uint64, scope Scope, target string) ([]ReportRow, string, error) {
+	report := make([]ReportRow, 0)
+
+	rates, err := currency.LoadRates(ctx, db)
+	if err != nil {
+		return report, "", err
+	}
+
+	if target == "" {
+		target = rates.Reporting
+	}
+	target = currency.Normalize(target)
+
+	sources := rangeSources(startTS, endTS)
+
+	// the same model billed in several currencies or read from several
+	// sources is still one row
+	index := make(map[[2]string]int)
+
+	for _, source := range sources {
+		query := source.from().
+			GroupBy("lu.provider, lu.model_name, " + currencyColumn).
+			Select("lu.provider").
+			Select("lu.model_name").
+			Select(currencyColumn).
+			Select(source.requests()).
+			Select(sumInt("lu.input_token")).
+			Select(sumInt("lu.output_token")).
+			Select(sumInt("lu.total_token")).
+			Select("COALESCE(SUM(lu.total_token_cost), 0)")
+		inRange(query, startTS, endTS)
+		scopeUsage(query, scope)
+
+		rows, err := db.QueryContext(ctx, query.String(), query.Args()...)
+		if err != nil {
+			return report, target, fmt.Errorf("error querying llm usage: %v", err)
+		}
+
+		for rows.Next() {
+			var row ReportRow
+			var billingCurrency string
+			if err := rows.Scan(
+				&row.Provider,
+				&row.ModelName,
+				&billingCurrency,
+				&row.Requests,
+				&row.InputToken,
+				&row.OutputToken,
+				&row.TotalToken,
+				&row.Cost,
+			); err != nil {
+				rows.Close()
+				return report, target, fmt.Errorf("error querying llm usage: %v", err)
+			}
+
+			if row.Cost, err = rates.Convert(row.Cost, billingCurrency, target); err != nil {
+				rows.Close()
+				return report, target, err
+			}
+
+			key := [2]string{row.Provider, row.ModelName}
+			if i, ok := index[key]; ok {
+				report[i].Requests += row.Requests
+				report[i].InputToken += row.InputToken
+				report[i].OutputToken += row.OutputToken
+				report[i].TotalToken += row.TotalToken
+				report[i].Cost += row.Cost
+				continue
+			}
+
+			index[key] = len(report)
+			report = append(report, row)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return report, target, fmt.Errorf("error querying llm usage: %v", err)
+		}
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Provider != report[j].Provider {
+			return report[i].Provider < report[j].Provider
+		}
+		return report[i].ModelName < report[j].ModelName
+	})
+
+	return report, target, nil
 }
@@ -1,6 +1,9 @@
 package utils
 
-import "os"
+import (
+	"os"
+	"time"
+)
 
 func FolderExists(path string) bool {
 	_, err := os.Stat(path)
@@ -12,3 +15,11 @@ func FolderExists(path string) bool {
 	}
 	return false
 }
+
+// DATETIME_LAYOUT matches sqlite CURRENT_TIMESTAMP, so formatted values
+// compare correctly against DATETIME columns
+const DATETIME_LAYOUT = "2006-01-02 15:04:05"
+
+func FormatDatetime(t time.Time) string {
+	return t.UTC().Format(DATETIME_LAYOUT)
+}
@@ -1,4 +1,22 @@
 package watcher
 
-const CONFIG_ROOT = "./data/config"
-const LLM_CONFIG_PATH = CONFIG_ROOT + "/llm.yaml"
+import "path/filepath"
+
+const DEFAULT_LLM_CONFIG_PATH = "./data/config/llm.yaml"
+
+var llmConfigPath = DEFAULT_LLM_CONFIG_PATH
+
+// UseConfigPath points SyncLLM and llm.yaml updates at path.
+func UseConfigPath(path string) {
+	llmConfigPath = path
+}
+
+func ConfigPath() string {
+	return llmConfigPath
+}
+
+// ConfigRoot is the directory of llm.yaml, other config files are resolved
+// relative to it.
+func ConfigRoot() string {
+	return filepath.Dir(llmConfigPath)
+}
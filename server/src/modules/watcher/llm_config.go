@@ -0,0 +1,414 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leporo/sqlf"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+var configMu sync.Mutex // serializes writes to llm.yaml
+
+func loadLLMConfig(viperLLM *viper.Viper) (*LLMModels, error) {
+	llms := &LLMModels{}
+
+	if err := viperLLM.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error loading %s: %s", llmConfigPath, err)
+	}
+
+	if err := viperLLM.Unmarshal(&llms); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", llmConfigPath, err)
+	}
+
+	// viper lowercases map keys, currency codes are kept uppercase
+	for i := range llms.Providers {
+		llms.Providers[i].Currency = strings.ToUpper(llms.Providers[i].Currency)
+	}
+
+	llms.Currency.BaseCurrency = strings.ToUpper(llms.Currency.BaseCurrency)
+	llms.Currency.ReportingCurrency = strings.ToUpper(llms.Currency.ReportingCurrency)
+	if llms.Currency.Rates != nil {
+		rates := make(map[string]float64)
+		for code, rate := range llms.Currency.Rates {
+			rates[strings.ToUpper(code)] = rate
+		}
+		llms.Currency.Rates = rates
+	}
+
+	return llms, nil
+}
+
+// LoadLLMConfig reads llm.yaml without syncing it anywhere.
+func LoadLLMConfig() (*LLMModels, error) {
+	return readLLMConfig()
+}
+
+func readLLMConfig() (*LLMModels, error) {
+	viperLLM := viper.New()
+	viperLLM.SetConfigFile(llmConfigPath)
+	viperLLM.SetConfigType("yaml")
+
+	return loadLLMConfig(viperLLM)
+}
+
+// writeLLMConfig replaces llm.yaml through a temp file and rename, so the
+// watcher never picks up a half-written file. Comments and keys llms does
+// not know are kept from the current file.
+func writeLLMConfig(llms *LLMModels) error {
+	unpriced, err := UnpricedModels()
+	if err != nil {
+		return err
+	}
+
+	var updated yaml.Node
+	if err := updated.Encode(llms); err != nil {
+		return fmt.Errorf("error encoding %s: %w", llmConfigPath, err)
+	}
+	omitUnpricedCost(&updated, llms, unpriced)
+
+	current, err := os.ReadFile(llmConfigPath)
+	if err != nil {
+		return fmt.Errorf("error loading %s: %w", llmConfigPath, err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(current, &doc); err != nil {
+		return fmt.Errorf("error reading %s: %w", llmConfigPath, err)
+	}
+
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) == 1 {
+		doc.Content[0] = mergeNode(doc.Content[0], &updated, reflect.TypeOf(llms))
+	} else {
+		doc = updated
+	}
+
+	var content bytes.Buffer
+	enc := yaml.NewEncoder(&content)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return fmt.Errorf("error encoding %s: %w", llmConfigPath, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(llmConfigPath), ".llm.yaml.*")
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", llmConfigPath, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing %s: %w", llmConfigPath, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %w", llmConfigPath, err)
+	}
+
+	if err := os.Rename(tmp.Name(), llmConfigPath); err != nil {
+		return fmt.Errorf("error writing %s: %w", llmConfigPath, err)
+	}
+
+	return nil
+}
+
+// omitUnpricedCost keeps models that had no price in llm.yaml, and still
+// have none, without one when writing it back, so they stay recognizable by
+// UnpricedModels.
+func omitUnpricedCost(doc *yaml.Node, llms *LLMModels, unpriced map[string]bool) {
+	keep := make(map[string]bool)
+	for _, llm := range llms.Models {
+		keep[llm.Name] = !unpriced[llm.Name] ||
+			llm.CostPerMillionInputTokens != 0 || llm.CostPerMillionOutputTokens != 0
+	}
+
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		if doc.Content[i].Value != "models" {
+			continue
+		}
+
+		for _, model := range doc.Content[i+1].Content {
+			name := ""
+			for j := 0; j+1 < len(model.Content); j += 2 {
+				if model.Content[j].Value == "name" {
+					name = model.Content[j+1].Value
+				}
+			}
+
+			fields := make([]*yaml.Node, 0, len(model.Content))
+			for j := 0; j+1 < len(model.Content); j += 2 {
+				key := model.Content[j].Value
+				if !keep[name] && (key == "costPerMillionInputToken" || key == "costPerMillionOutputToken") {
+					continue
+				}
+				fields = append(fields, model.Content[j], model.Content[j+1])
+			}
+
+			model.Content = fields
+		}
+	}
+}
+
+// mergeNode writes updated, encoded from a value of type t, into node as
+// read from llm.yaml and returns the result. Comments and the order of keys
+// in node are kept, and so are keys t has no field for.
+func mergeNode(node *yaml.Node, updated *yaml.Node, t reflect.Type) *yaml.Node {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == nil || node.Kind != updated.Kind {
+		return updated
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		mergeMapping(node, updated, t)
+	case yaml.SequenceNode:
+		mergeSequence(node, updated, t.Elem())
+	case yaml.ScalarNode:
+		if node.Tag != updated.Tag || node.Value != updated.Value {
+			node.Tag, node.Value, node.Style = updated.Tag, updated.Value, updated.Style
+		}
+	default:
+		return updated
+	}
+
+	return node
+}
+
+func mergeMapping(node *yaml.Node, updated *yaml.Node, t reflect.Type) {
+	values := make(map[string]*yaml.Node)
+	order := make([]*yaml.Node, 0, len(updated.Content)/2)
+	for i := 0; i+1 < len(updated.Content); i += 2 {
+		values[updated.Content[i].Value] = updated.Content[i+1]
+		order = append(order, updated.Content[i])
+	}
+
+	content := make([]*yaml.Node, 0, len(node.Content))
+	merged := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+
+		fieldType, known := keyType(t, key.Value)
+		if updatedValue, ok := values[key.Value]; ok {
+			value = mergeNode(value, updatedValue, fieldType)
+			merged[key.Value] = true
+		} else if known {
+			continue // cleared, omitempty left it out of updated
+		}
+
+		content = append(content, key, value)
+	}
+
+	for _, key := range order {
+		if !merged[key.Value] {
+			content = append(content, key, values[key.Value])
+		}
+	}
+
+	node.Content = content
+}
+
+// mergeSequence merges the items of updated into the items of node they
+// replace, matched by name, by value for scalars and by position otherwise.
+func mergeSequence(node *yaml.Node, updated *yaml.Node, elem reflect.Type) {
+	byKey := make(map[string]*yaml.Node)
+	for _, item := range node.Content {
+		if key := itemKey(item); key != "" && byKey[key] == nil {
+			byKey[key] = item
+		}
+	}
+
+	content := make([]*yaml.Node, 0, len(updated.Content))
+	for i, item := range updated.Content {
+		if key := itemKey(item); key != "" {
+			if current, ok := byKey[key]; ok {
+				delete(byKey, key)
+				item = mergeNode(current, item, elem)
+			}
+		} else if i < len(node.Content) && itemKey(node.Content[i]) == "" {
+			item = mergeNode(node.Content[i], item, elem)
+		}
+
+		content = append(content, item)
+	}
+
+	node.Content = content
+}
+
+func itemKey(item *yaml.Node) string {
+	switch item.Kind {
+	case yaml.ScalarNode:
+		return item.Value
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			if item.Content[i].Value == "name" {
+				return item.Content[i+1].Value
+			}
+		}
+	}
+
+	return ""
+}
+
+// keyType returns the type of the value at key in a mapping encoded from a
+// value of type t, and whether t has it at all.
+func keyType(t reflect.Type, key string) (reflect.Type, bool) {
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem(), true
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, options, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+
+			if strings.Contains(options, "inline") {
+				if fieldType, ok := keyType(field.Type, key); ok {
+					return fieldType, true
+				}
+				continue
+			}
+
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			if name == key {
+				return field.Type, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// pruneLLM removes providers and models that are no longer part of llms.
+func pruneLLM(ctx context.Context, tx *sql.Tx, llms *LLMModels) error {
+	modelNames := make([]interface{}, 0, len(llms.Models))
+	for _, llm := range llms.Models {
+		modelNames = append(modelNames, llm.Name)
+	}
+
+	llmQuery := sqlf.DeleteFrom("llms")
+	if len(modelNames) > 0 {
+		llmQuery.Where("name NOT").In(modelNames...)
+	}
+
+	if _, err := llmQuery.Exec(ctx, tx); err != nil {
+		return fmt.Errorf("error deleting llm data: %w", err)
+	}
+
+	llmPriceQuery := sqlf.DeleteFrom("llm_prices")
+	if len(modelNames) > 0 {
+		llmPriceQuery.Where("model_name NOT").In(modelNames...)
+	}
+
+	if _, err := llmPriceQuery.Exec(ctx, tx); err != nil {
+		return fmt.Errorf("error deleting llm price data: %w", err)
+	}
+
+	providerNames := make([]interface{}, 0, len(llms.Providers))
+	for _, provider := range llms.Providers {
+		providerNames = append(providerNames, provider.Name)
+	}
+
+	llmProviderQuery := sqlf.DeleteFrom("llm_providers")
+	if len(providerNames) > 0 {
+		llmProviderQuery.Where("name NOT").In(providerNames...)
+	}
+
+	if _, err := llmProviderQuery.Exec(ctx, tx); err != nil {
+		return fmt.Errorf("error deleting llm provider data: %w", err)
+	}
+
+	return nil
+}
+
+func updateLLMConfig(update func(llms *LLMModels) error) (*LLMModels, error) {
+	llms, err := readLLMConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := update(llms); err != nil {
+		return nil, err
+	}
+
+	if err := writeLLMConfig(llms); err != nil {
+		return nil, err
+	}
+
+	return llms, nil
+}
+
+// UpdateLLMConfig loads llm.yaml, applies update to it and writes the result
+// back, leaving the sync into the database to a running watcher. Nothing is
+// written when update returns an error.
+func UpdateLLMConfig(update func(llms *LLMModels) error) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	_, err := updateLLMConfig(update)
+	return err
+}
+
+// UpdateLLM works like UpdateLLMConfig but also syncs the result into db
+// right away.
+func UpdateLLM(ctx context.Context, db *sql.DB, update func(llms *LLMModels) error) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	llms, err := updateLLMConfig(update)
+	if err != nil {
+		return err
+	}
+
+	err = syncLLM(ctx, db, llms, true)
+	setSyncError(err)
+	if err != nil {
+		return err
+	}
+
+	lastSync = time.Now()
+
+	return nil
+}
+
+// UnpricedModels returns the models in llm.yaml that set neither
+// costPerMillionInputToken nor costPerMillionOutputToken. Zero is a valid
+// price, so this looks at the raw file rather than LLMModels.
+func UnpricedModels() (map[string]bool, error) {
+	content, err := os.ReadFile(llmConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading %s: %w", llmConfigPath, err)
+	}
+
+	var raw struct {
+		Models []struct {
+			Name                       string   `yaml:"name"`
+			CostPerMillionInputTokens  *float64 `yaml:"costPerMillionInputToken"`
+			CostPerMillionOutputTokens *float64 `yaml:"costPerMillionOutputToken"`
+		} `yaml:"models"`
+	}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", llmConfigPath, err)
+	}
+
+	unpriced := make(map[string]bool)
+	for _, llm := range raw.Models {
+		if llm.CostPerMillionInputTokens == nil && llm.CostPerMillionOutputTokens == nil {
+			unpriced[llm.Name] = true
+		}
+	}
+
+	return unpriced, nil
+}
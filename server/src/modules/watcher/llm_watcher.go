@@ -3,127 +3,540 @@ package watcher
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/currency"
 	"github.com/IqbalLx/inspectro-llm/server/src/modules/entities"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/upstream"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
 	"github.com/fsnotify/fsnotify"
 	"github.com/leporo/sqlf"
 	"github.com/spf13/viper"
 )
 
 type LLMModels struct {
-	Providers []entities.LLMProvider `yaml:"providers"`
-	Models    []entities.LLM         `yaml:"models"`
+	Providers []entities.LLMProvider  `yaml:"providers"`
+	Models    []entities.LLM          `yaml:"models"`
+	Currency  entities.CurrencyConfig `yaml:"currency,omitempty"`
+	Projects  []entities.Project      `yaml:"projects,omitempty"`
+
+	// DefaultProject is the project of requests naming none, it must be
+	// set once there are projects
+	DefaultProject string `mapstructure:"defaultProject" yaml:"defaultProject,omitempty"`
 }
 
 var lastSync time.Time // to dedup
 
-func SyncLLM(db *sql.DB) error {
-	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+// syncLLM writes llms into db in a single transaction, pruning providers and
+// models no longer part of llms when prune is set. The provider clients only
+// change once it commits.
+func syncLLM(ctx context.Context, db *sql.DB, llms *LLMModels, prune bool) error {
+	applyClients, err := upstream.Configure(llms.Providers, ConfigRoot())
+	if err != nil {
+		return err
+	}
 
-	_, err := os.Stat(LLM_CONFIG_PATH)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		if os.IsNotExist(err) {
-			err := os.Mkdir(CONFIG_ROOT, 0777)
-			if err != nil {
-				return fmt.Errorf("error creating dir %s: %w", CONFIG_ROOT, err)
-			}
+		return fmt.Errorf("error syncing llm data: %w", err)
+	}
+	defer tx.Rollback()
 
-			file, err := os.Create(LLM_CONFIG_PATH)
-			if err != nil {
-				return fmt.Errorf("error initializing %s: %w", LLM_CONFIG_PATH, err)
-			}
-			defer file.Close()
-		} else {
-			return fmt.Errorf("error initializing %s: %w", LLM_CONFIG_PATH, err)
+	if err := writeLLM(ctx, tx, llms); err != nil {
+		return err
+	}
+
+	if prune {
+		if err := pruneLLM(ctx, tx, llms); err != nil {
+			return err
 		}
 	}
 
-	viperLLM := viper.New()
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error syncing llm data: %w", err)
+	}
 
-	viperLLM.SetConfigFile(LLM_CONFIG_PATH)
-	viperLLM.SetConfigType("yaml")
+	applyClients()
 
-	iqro := func() error {
-		llms := &LLMModels{}
+	return nil
+}
 
-		if err := viperLLM.ReadInConfig(); err != nil {
-			return fmt.Errorf("error loading %s: %s", LLM_CONFIG_PATH, err)
+func writeLLM(ctx context.Context, tx *sql.Tx, llms *LLMModels) error {
+	if len(llms.Providers) > 0 {
+		llmProviderQuery := sqlf.InsertInto("llm_providers")
+		for _, provider := range llms.Providers {
+			llmProviderQuery.NewRow().
+				Set("name", provider.Name).
+				Set("apiBase", provider.APIBase).
+				Set("apiKey", provider.APIKey).
+				Set("currency", currency.Normalize(provider.Currency)).
+				Set("disableStreamUsage", provider.DisableStreamUsage)
 		}
 
-		if err := viperLLM.Unmarshal(&llms); err != nil {
-			return fmt.Errorf("error reading %s: %w", LLM_CONFIG_PATH, err)
+		llmProviderQuery.
+			Clause("ON CONFLICT (name) DO UPDATE SET").
+			Expr("apiBase = EXCLUDED.apiBase").
+			Expr("apiKey = EXCLUDED.apiKey").
+			Expr("currency = EXCLUDED.currency").
+			Expr("disableStreamUsage = EXCLUDED.disableStreamUsage")
+
+		if _, err := llmProviderQuery.Exec(ctx, tx); err != nil {
+			return fmt.Errorf("error inserting llm provider data: %w", err)
 		}
+	}
 
-		if len(llms.Providers) > 0 {
-			llmProviderQuery := sqlf.InsertInto("llm_providers")
-			for _, provider := range llms.Providers {
-				llmProviderQuery.NewRow().
-					Set("name", provider.Name).
-					Set("apiBase", provider.APIBase).
-					Set("apiKey", provider.APIKey)
-			}
+	if len(llms.Models) > 0 {
+		llmQuery := sqlf.InsertInto("llms")
+		for _, llm := range llms.Models {
+			llmQuery.NewRow().
+				Set("name", llm.Name).
+				Set("provider", llm.Provider).
+				Set("costPerMillionInputToken", llm.CostPerMillionInputTokens).
+				Set("costPerMillionOutputToken", llm.CostPerMillionOutputTokens)
+		}
 
-			llmProviderQuery.
-				Clause("ON CONFLICT (name) DO UPDATE SET").
-				Expr("apiBase = EXCLUDED.apiBase").
-				Expr("apiKey = EXCLUDED.apiKey")
+		llmQuery.
+			Clause("ON CONFLICT (name) DO UPDATE SET").
+			Expr("provider = EXCLUDED.provider").
+			Expr("costPerMillionInputToken = EXCLUDED.costPerMillionInputToken").
+			Expr("costPerMillionOutputToken = EXCLUDED.costPerMillionOutputToken")
 
-			if _, err := llmProviderQuery.Exec(context.Background(), db); err != nil {
-				return fmt.Errorf("error inserting llm provider data: %w", err)
-			}
+		if _, err := llmQuery.Exec(ctx, tx); err != nil {
+			return fmt.Errorf("error inserting llm data: %w", err)
 		}
 
-		if len(llms.Models) > 0 {
-			llmQuery := sqlf.InsertInto("llms")
-			for _, llm := range llms.Models {
-				llmQuery.NewRow().
-					Set("name", llm.Name).
-					Set("provider", llm.Provider).
-					Set("costPerMillionInputToken", llm.CostPerMillionInputTokens).
-					Set("costPerMillionOutputToken", llm.CostPerMillionOutputTokens)
-			}
+		if err := writeLLMPrices(ctx, tx, llms.Models); err != nil {
+			return err
+		}
+	}
+
+	if err := syncProjects(ctx, tx, llms.Projects, llms.DefaultProject); err != nil {
+		return err
+	}
+
+	return syncCurrency(ctx, tx, llms.Currency, llms.Providers)
+}
+
+// writeLLMPrices replaces the dated prices of models with theirs. Base
+// prices are kept as history instead: a changed base price applies from now
+// on, so usage logged before keeps the price it was made at. Dated prices
+// win over the base price, a change to it is only recorded while none of
+// them is in effect.
+func writeLLMPrices(ctx context.Context, tx *sql.Tx, models []entities.LLM) error {
+	now := time.Now().Truncate(time.Second)
+	modelNames := make([]interface{}, 0, len(models))
+	llmPriceQuery := sqlf.InsertInto("llm_prices")
+	prices := 0
+	addPrice := func(modelName string, validFrom time.Time, cost entities.LLMCost, isBase bool) error {
+		encodedCost, err := json.Marshal(cost)
+		if err != nil {
+			return fmt.Errorf("error encoding llm price of %s: %w", modelName, err)
+		}
+
+		llmPriceQuery.NewRow().
+			Set("model_name", modelName).
+			Set("validFrom", utils.FormatDatetime(validFrom)).
+			Set("costPerMillionInputToken", cost.CostPerMillionInputTokens).
+			Set("costPerMillionOutputToken", cost.CostPerMillionOutputTokens).
+			Set("cost", string(encodedCost)).
+			Set("is_base", isBase)
+		prices++
+
+		return nil
+	}
+
+	for _, llm := range models {
+		modelNames = append(modelNames, llm.Name)
+
+		baseCost, err := lastBaseCost(ctx, tx, llm.Name)
+		if err != nil {
+			return err
+		}
+
+		encodedCost, err := json.Marshal(llm.LLMCost)
+		if err != nil {
+			return fmt.Errorf("error encoding llm price of %s: %w", llm.Name, err)
+		}
+
+		// a base price at the time of a dated price would take its row
+		validFroms := make(map[int64]bool)
+		datedInEffect := false
+		for _, price := range llm.Prices {
+			validFroms[price.ValidFrom.Unix()] = true
+			datedInEffect = datedInEffect || !price.ValidFrom.After(now)
+		}
 
-			llmQuery.
-				Clause("ON CONFLICT (name) DO UPDATE SET").
-				Expr("provider = EXCLUDED.provider").
-				Expr("costPerMillionInputToken = EXCLUDED.costPerMillionInputToken").
-				Expr("costPerMillionOutputToken = EXCLUDED.costPerMillionOutputToken")
+		// the first base price covers everything before the first dated price
+		switch {
+		case baseCost == "" && !validFroms[0]:
+			err = addPrice(llm.Name, time.Unix(0, 0), llm.LLMCost, true)
+		case baseCost != "" && baseCost != string(encodedCost) && !datedInEffect:
+			err = addPrice(llm.Name, now, llm.LLMCost, true)
+		}
+		if err != nil {
+			return err
+		}
 
-			if _, err := llmQuery.Exec(context.Background(), db); err != nil {
-				return fmt.Errorf("error inserting llm data: %w", err)
+		for _, price := range llm.Prices {
+			if err := addPrice(llm.Name, price.ValidFrom, price.LLMCost, false); err != nil {
+				return err
 			}
 		}
+	}
+
+	llmPriceQuery.
+		Clause("ON CONFLICT (model_name, validFrom) DO UPDATE SET").
+		Expr("costPerMillionInputToken = EXCLUDED.costPerMillionInputToken").
+		Expr("costPerMillionOutputToken = EXCLUDED.costPerMillionOutputToken").
+		Expr("cost = EXCLUDED.cost").
+		Expr("is_base = EXCLUDED.is_base")
+
+	if _, err := sqlf.DeleteFrom("llm_prices").
+		Where("is_base = FALSE").
+		Where("model_name").In(modelNames...).
+		Exec(ctx, tx); err != nil {
+		return fmt.Errorf("error deleting llm price data: %w", err)
+	}
 
+	if prices == 0 {
 		return nil
 	}
 
-	if err = iqro(); err != nil {
+	if _, err := llmPriceQuery.Exec(ctx, tx); err != nil {
+		return fmt.Errorf("error inserting llm price data: %w", err)
+	}
+
+	return nil
+}
+
+// lastBaseCost returns the encoded base price of model last synced, empty
+// when it has none yet.
+func lastBaseCost(ctx context.Context, tx *sql.Tx, model string) (string, error) {
+	query := sqlf.From("llm_prices").
+		Select("cost").
+		Where("model_name = ?", model).
+		Where("is_base = TRUE").
+		OrderBy("validFrom DESC").
+		Limit(1)
+
+	var cost sql.NullString
+	err := tx.QueryRowContext(ctx, query.String(), query.Args()...).Scan(&cost)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("error querying llm price of %s: %w", model, err)
+	}
+
+	return cost.String, nil
+}
+
+// syncProjects replaces the projects in db with projects, marking the one
+// called defaultProject. Usage and keys of a removed project are kept.
+func syncProjects(ctx context.Context, tx *sql.Tx, projects []entities.Project, defaultProject string) error {
+	if err := ValidateDefaultProject(projects, defaultProject); err != nil {
 		return err
 	}
 
-	viperLLM.OnConfigChange(func(e fsnotify.Event) {
-		now := time.Now()
-		elapsed := now.Sub(lastSync)
+	if _, err := sqlf.DeleteFrom("project_models").Exec(ctx, tx); err != nil {
+		return fmt.Errorf("error deleting project data: %w", err)
+	}
 
-		if elapsed.Milliseconds() < 200 {
-			return
+	if _, err := sqlf.DeleteFrom("projects").Exec(ctx, tx); err != nil {
+		return fmt.Errorf("error deleting project data: %w", err)
+	}
+
+	if len(projects) == 0 {
+		return nil
+	}
+
+	projectQuery := sqlf.InsertInto("projects")
+	projectModelQuery := sqlf.InsertInto("project_models")
+	hasModels := false
+	for _, project := range projects {
+		projectQuery.NewRow().
+			Set("name", project.Name).
+			Set("budget", project.Budget).
+			Set("is_default", project.Name == defaultProject)
+
+		for _, model := range project.Models {
+			projectModelQuery.NewRow().
+				Set("project_name", project.Name).
+				Set("model_name", model)
+			hasModels = true
 		}
+	}
 
-		logger.Info("config file changed:", "name", e.Name)
+	// duplicates are reported by validate-config, syncing keeps the first
+	projectQuery.Clause("ON CONFLICT DO NOTHING")
+	projectModelQuery.Clause("ON CONFLICT DO NOTHING")
 
-		if err := iqro(); err != nil {
-			logger.Warn("got error after file changes, changes ignored", "err", err)
-			return
+	if _, err := projectQuery.Exec(ctx, tx); err != nil {
+		return fmt.Errorf("error inserting project data: %w", err)
+	}
+
+	if hasModels {
+		if _, err := projectModelQuery.Exec(ctx, tx); err != nil {
+			return fmt.Errorf("error inserting project data: %w", err)
 		}
+	}
 
-		lastSync = time.Now()
-	})
+	return nil
+}
 
-	viperLLM.WatchConfig()
+// ValidateDefaultProject checks that defaultProject names one of projects,
+// and is set once there are any.
+func ValidateDefaultProject(projects []entities.Project, defaultProject string) error {
+	if len(projects) == 0 {
+		if defaultProject != "" {
+			return fmt.Errorf("error syncing projects: default project %s is not configured", defaultProject)
+		}
+		return nil
+	}
+
+	if defaultProject == "" {
+		return fmt.Errorf("error syncing projects: defaultProject must name the project of requests naming none")
+	}
+
+	for _, project := range projects {
+		if project.Name == defaultProject {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("error syncing projects: default project %s is not configured", defaultProject)
+}
+
+// resolveRates merges the configured rates with the rates file, returning
+// the base and reporting currency and the rates against base.
+func resolveRates(config entities.CurrencyConfig) (string, string, map[string]float64, error) {
+	base := currency.Normalize(config.BaseCurrency)
+	reporting := base
+	if config.ReportingCurrency != "" {
+		reporting = currency.Normalize(config.ReportingCurrency)
+	}
+
+	rates := make(map[string]float64)
+	for code, rate := range config.Rates {
+		rates[currency.Normalize(code)] = rate
+	}
+
+	if config.RatesFile != "" {
+		path := config.RatesFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(ConfigRoot(), path)
+		}
+
+		fileBase, fileRates, err := currency.ReadRatesFile(path)
+		if err != nil {
+			return "", "", nil, err
+		}
+
+		// rebase file rates onto the configured base currency
+		baseRate := 1.0
+		if fileBase != base {
+			if baseRate = fileRates[base]; baseRate == 0 {
+				return "", "", nil, fmt.Errorf("error reading rates file %s: no rate for %s", path, base)
+			}
+		}
+
+		for code, rate := range fileRates {
+			rates[code] = rate / baseRate
+		}
+	}
+
+	rates[base] = 1
+
+	if _, ok := rates[reporting]; !ok {
+		return "", "", nil, fmt.Errorf("error syncing currency: no rate for reporting currency %s", reporting)
+	}
+
+	for code, rate := range rates {
+		if rate <= 0 {
+			return "", "", nil, fmt.Errorf("error syncing currency: rate of %s must be positive", code)
+		}
+	}
+
+	return base, reporting, rates, nil
+}
+
+// ValidateCurrency checks the currency config, including its rates file.
+func ValidateCurrency(config entities.CurrencyConfig) error {
+	_, _, _, err := resolveRates(config)
+	return err
+}
+
+// CurrencyRates returns the rates of the currency config against its base
+// currency.
+func CurrencyRates(config entities.CurrencyConfig) (map[string]float64, error) {
+	_, _, rates, err := resolveRates(config)
+	return rates, err
+}
+
+func syncCurrency(ctx context.Context, tx *sql.Tx, config entities.CurrencyConfig, providers []entities.LLMProvider) error {
+	base, reporting, rates, err := resolveRates(config)
+	if err != nil {
+		return err
+	}
+
+	// usage of a provider without a rate could not be reported
+	for _, provider := range providers {
+		code := currency.Normalize(provider.Currency)
+		if _, ok := rates[code]; !ok {
+			return fmt.Errorf("error syncing currency: no rate for %s of provider %s", code, provider.Name)
+		}
+	}
+
+	currencyQuery := sqlf.InsertInto("currencies")
+	for code, rate := range rates {
+		currencyQuery.NewRow().
+			Set("code", code).
+			Set("rate", rate).
+			Set("is_base", code == base).
+			Set("is_reporting", code == reporting)
+	}
+
+	if _, err := sqlf.DeleteFrom("currencies").Exec(ctx, tx); err != nil {
+		return fmt.Errorf("error deleting currency data: %w", err)
+	}
+
+	if _, err := currencyQuery.Exec(ctx, tx); err != nil {
+		return fmt.Errorf("error inserting currency data: %w", err)
+	}
 
 	return nil
 }
+
+var (
+	watching sync.WaitGroup
+
+	syncErrMu sync.Mutex
+	syncErr   error // of the last sync of llm.yaml
+)
+
+// SyncLLM syncs llm.yaml at configPath into db and keeps watching it for
+// changes until ctx is done.
+func SyncLLM(ctx context.Context, db *sql.DB, configPath string) error {
+	UseConfigPath(configPath)
+
+	_, err := os.Stat(llmConfigPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err := os.MkdirAll(ConfigRoot(), 0777)
+			if err != nil {
+				return fmt.Errorf("error creating dir %s: %w", ConfigRoot(), err)
+			}
+
+			file, err := os.Create(llmConfigPath)
+			if err != nil {
+				return fmt.Errorf("error initializing %s: %w", llmConfigPath, err)
+			}
+			defer file.Close()
+		} else {
+			return fmt.Errorf("error initializing %s: %w", llmConfigPath, err)
+		}
+	}
+
+	viperLLM := viper.New()
+
+	viperLLM.SetConfigFile(llmConfigPath)
+	viperLLM.SetConfigType("yaml")
+
+	// the db may hold providers and models removed from llm.yaml while the
+	// server was down
+	llms, err := loadLLMConfig(viperLLM)
+	if err != nil {
+		return err
+	}
+
+	if err = syncLLM(ctx, db, llms, true); err != nil {
+		return err
+	}
+
+	// llm.yaml is replaced through rename, so its directory is watched
+	// rather than the file itself
+	fileWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error watching %s: %w", llmConfigPath, err)
+	}
+
+	if err := fileWatcher.Add(ConfigRoot()); err != nil {
+		fileWatcher.Close()
+		return fmt.Errorf("error watching %s: %w", llmConfigPath, err)
+	}
+
+	watching.Add(1)
+	go func() {
+		defer watching.Done()
+		defer fileWatcher.Close()
+
+		watchLLM(ctx, db, viperLLM, fileWatcher)
+	}()
+
+	return nil
+}
+
+func watchLLM(ctx context.Context, db *sql.DB, viperLLM *viper.Viper, fileWatcher *fsnotify.Watcher) {
+	logger := slog.Default()
+	configFile := filepath.Clean(llmConfigPath)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err, ok := <-fileWatcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warn("error watching config file", "err", err)
+		case e, ok := <-fileWatcher.Events:
+			if !ok {
+				return
+			}
+
+			if filepath.Clean(e.Name) != configFile || !e.Has(fsnotify.Write|fsnotify.Create) {
+				continue
+			}
+
+			configMu.Lock()
+			if time.Since(lastSync).Milliseconds() >= 200 {
+				logger.Info("config file changed:", "name", e.Name)
+
+				llms, err := loadLLMConfig(viperLLM)
+				if err == nil {
+					err = syncLLM(ctx, db, llms, true)
+				}
+
+				setSyncError(err)
+				if err != nil {
+					logger.Warn("got error after file changes, changes ignored", "err", err)
+				} else {
+					lastSync = time.Now()
+				}
+			}
+			configMu.Unlock()
+		}
+	}
+}
+
+func setSyncError(err error) {
+	syncErrMu.Lock()
+	defer syncErrMu.Unlock()
+	syncErr = err
+}
+
+// SyncError returns why the last sync of llm.yaml into the db failed, nil
+// when it succeeded. The db keeps the config of the last sync that did.
+func SyncError() error {
+	syncErrMu.Lock()
+	defer syncErrMu.Unlock()
+	return syncErr
+}
+
+// Wait blocks until the watcher started by SyncLLM has stopped.
+func Wait() {
+	watching.Wait()
+}
@@ -0,0 +1,273 @@
+package watcher_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	database "github.com/IqbalLx/inspectro-llm/server/src/modules/db"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/llmAPI"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/projects"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/upstream"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/utils"
+	"github.com/IqbalLx/inspectro-llm/server/src/modules/watcher"
+)
+
+func TestProviderCurrencyNeedsRate(t *testing.T) {
+	const config = `providers:
+  - name: ollama
+    apiBase: http://127.0.0.1:11434
+    currency: EUR
+models:
+  - name: test-model
+    provider: ollama
+    costPerMillionInputToken: 1
+    costPerMillionOutputToken: 2
+`
+
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	configPath := filepath.Join(t.TempDir(), "llm.yaml")
+	for _, rates := range []string{"", "currency:\n  rates:\n    EUR: 0.9\n"} {
+		if err := os.WriteFile(configPath, []byte(config+rates), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		err := watcher.SyncLLM(ctx, db, configPath)
+		cancel()
+		watcher.Wait()
+
+		llms, loadErr := watcher.LoadLLMConfig()
+		if loadErr != nil {
+			t.Fatal(loadErr)
+		}
+		validateErr := llmAPI.ValidateLLMModels(llms)
+
+		if rates == "" {
+			if err == nil || !strings.Contains(err.Error(), "no rate for EUR") {
+				t.Fatalf("synced a provider billing in EUR without a rate: %v", err)
+			}
+			if validateErr == nil || !strings.Contains(validateErr.Error(), "no rate for currency EUR") {
+				t.Fatalf("validated a provider billing in EUR without a rate: %v", validateErr)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("syncing: %v", err)
+		}
+		if validateErr != nil {
+			t.Fatalf("validating: %v", validateErr)
+		}
+	}
+}
+
+func TestDefaultProject(t *testing.T) {
+	const config = `providers:
+  - name: ollama
+    apiBase: http://127.0.0.1:11434
+projects:
+  - name: staging
+  - name: production
+`
+
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		name           string
+		defaultProject string
+		err            string
+	}{
+		{"missing", "", "defaultProject must name"},
+		{"unknown", "defaultProject: testing\n", "default project testing is not configured"},
+		{"configured", "defaultProject: staging\n", ""},
+	}
+
+	configPath := filepath.Join(t.TempDir(), "llm.yaml")
+	for _, tt := range tests {
+		if err := os.WriteFile(configPath, []byte(config+tt.defaultProject), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		err := watcher.SyncLLM(ctx, db, configPath)
+		cancel()
+		watcher.Wait()
+
+		if tt.err == "" {
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("%s: synced projects without a valid default: %v", tt.name, err)
+		}
+	}
+
+	name, err := projects.Default(context.Background(), db)
+	if err != nil || name != "staging" {
+		t.Fatalf("default project %q, %v, want staging", name, err)
+	}
+}
+
+func TestFailedSyncKeepsClients(t *testing.T) {
+	const config = `providers:
+  - name: ollama
+    apiBase: http://127.0.0.1:11434
+    currency: EUR
+    http:
+      maxIdleConns: 1
+`
+
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	configPath := filepath.Join(t.TempDir(), "llm.yaml")
+	if err := os.WriteFile(configPath, []byte(config), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	before := upstream.For("ollama")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer watcher.Wait()
+	defer cancel()
+
+	// the transaction fails on the currency without a rate
+	if err := watcher.SyncLLM(ctx, db, configPath); err == nil {
+		t.Fatal("synced a provider currency without a rate")
+	}
+
+	if upstream.For("ollama") != before {
+		t.Fatal("a failed sync changed the provider clients")
+	}
+}
+
+func TestBasePriceChange(t *testing.T) {
+	const config = `providers:
+  - name: ollama
+    apiBase: http://127.0.0.1:11434
+models:
+  - name: test-model
+    provider: ollama
+    costPerMillionInputToken: %d
+    costPerMillionOutputToken: 1
+`
+
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	dated := fmt.Sprintf("    prices:\n      - validFrom: %s\n        costPerMillionInputToken: 2\n        costPerMillionOutputToken: 1\n", now.Format(time.RFC3339))
+
+	tests := []struct {
+		name  string
+		base  int
+		dated string
+		want  float64
+	}{
+		{"dated in effect", 1, dated, 2},
+		// in the same second as the dated price, which still wins
+		{"base changed", 3, dated, 2},
+		{"dated removed", 3, "", 3},
+	}
+
+	configPath := filepath.Join(t.TempDir(), "llm.yaml")
+	for _, tt := range tests {
+		if err := os.WriteFile(configPath, []byte(fmt.Sprintf(config, tt.base)+tt.dated), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		err := watcher.SyncLLM(ctx, db, configPath)
+		cancel()
+		watcher.Wait()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		var price float64
+		err = db.QueryRow(`SELECT costPerMillionInputToken FROM llm_prices
+			WHERE model_name = 'test-model' AND validFrom <= ?
+			ORDER BY validFrom DESC LIMIT 1`, utils.FormatDatetime(time.Now())).Scan(&price)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if price != tt.want {
+			t.Fatalf("%s: price in effect %v, want %v", tt.name, price, tt.want)
+		}
+	}
+}
+
+func TestWatchPrunesRemovedModels(t *testing.T) {
+	const config = `providers:
+  - name: ollama
+    apiBase: http://127.0.0.1:11434
+models:
+  - name: kept-model
+    provider: ollama
+`
+	const removed = `  - name: removed-model
+    provider: ollama
+`
+
+	db, err := database.OpenDB("file:" + filepath.Join(t.TempDir(), "inspectro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// reads wait for the sync rather than fail its commit on the busy file
+	db.SetMaxOpenConns(1)
+
+	configPath := filepath.Join(t.TempDir(), "llm.yaml")
+	if err := os.WriteFile(configPath, []byte(config+removed), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer watcher.Wait()
+	defer cancel()
+
+	if err := watcher.SyncLLM(ctx, db, configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// changes right after a sync are taken as part of it
+	time.Sleep(300 * time.Millisecond)
+	if err := os.WriteFile(configPath, []byte(config), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		var models int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM llms WHERE name = 'removed-model'`).Scan(&models); err != nil {
+			t.Fatal(err)
+		}
+		if models == 0 {
+			return
+		}
+	}
+
+	t.Fatal("model removed from llm.yaml is still synced")
+}
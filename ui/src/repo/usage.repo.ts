@@ -17,6 +17,7 @@ export type LLMUsage = {
   output_token_cost: number;
   total_token_cost: number;
   ts: string;
+  requests: number; // more than one when read from a rollup
 };
 
 export type Spending = {
@@ -104,13 +105,13 @@ export function mapUsageForUI(
         existing!.input_token_cost += usage.input_token_cost;
         existing!.output_token_cost += usage.output_token_cost;
         existing!.total_token_cost += usage.total_token_cost;
-        existing!.request_count += 1;
+        existing!.request_count += usage.requests;
 
         usagePerDayMap.set(dateKey, existing!);
         return;
       }
 
-      usagePerDayMap.set(dateKey, { ...usage, request_count: 1 });
+      usagePerDayMap.set(dateKey, { ...usage, request_count: usage.requests });
     });
 
     const dataPerSpanDatetime = dateRange.map((date) => {